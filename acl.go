@@ -0,0 +1,61 @@
+package httprelay
+
+import (
+	"net"
+
+	io_ "github.com/cobratbq/goutils/std/io"
+	"github.com/cobratbq/goutils/std/log"
+	"golang.org/x/net/proxy"
+)
+
+// WrapACL wraps a listener with an access control list that only accepts connections originating
+// from the addresses specified. The specification is a comma-separated list in the format of
+// `proxy.PerHost.AddFromString`, i.e. the same format as the blocked addresses. Clients are matched
+// by IP address, therefore only IP addresses and CIDR ranges are effective.
+func WrapACL(listener net.Listener, spec string) *ACLListener {
+	// The ACL refuses by default and allows the addresses that bypass.
+	allowed := proxy.NewPerHost(&NopDialer{}, allowDialer{})
+	allowed.AddFromString(spec)
+	return &ACLListener{Listener: listener, allowed: allowed}
+}
+
+// LoopbackAddresses is the specification of an access control list that only allows loopback
+// addresses.
+const LoopbackAddresses = "127.0.0.0/8,::1"
+
+// ACLListener is a listener that only accepts connections from allowed client addresses. Denied
+// connections are logged and closed immediately after accepting, i.e. before any HTTP parsing.
+type ACLListener struct {
+	net.Listener
+	allowed *proxy.PerHost
+}
+
+// Accept accepts the next connection that originates from an allowed address.
+func (l *ACLListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.Permits(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Warnln("Denied connection from", conn.RemoteAddr().String())
+		io_.CloseLogged(conn, "Failed to close denied connection: %+v")
+	}
+}
+
+// Permits checks whether the address is allowed by the access control list. Connections through
+// Unix domain sockets are always permitted, as access is controlled by the socket's file
+// permissions.
+func (l *ACLListener) Permits(addr net.Addr) bool {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		return true
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	_, err := l.allowed.Dial("tcp", net.JoinHostPort(tcpAddr.IP.String(), "0"))
+	return err == nil
+}
@@ -0,0 +1,61 @@
+package httprelay
+
+import (
+	"net"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestACLListenerSpec(t *testing.T) {
+	acl := WrapACL(nil, "10.0.0.0/8, 192.168.1.1,2001:db8::/32,,::1")
+	for _, ip := range []string{"10.1.2.3", "192.168.1.1", "2001:db8::2", "::1"} {
+		assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}), true)
+	}
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 1234}), false)
+	// Invalid entries, and host names that cannot match a client address, do not allow anything.
+	acl = WrapACL(nil, "localhost,10.0.0.0/33,192.168.1")
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "192.168.1.0", "::1"} {
+		assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}), false)
+	}
+}
+
+func TestACLListenerLoopback(t *testing.T) {
+	acl := WrapACL(nil, LoopbackAddresses)
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}), true)
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 1234}), true)
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}), false)
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}), false)
+}
+
+func TestACLListenerPermits(t *testing.T) {
+	acl := WrapACL(nil, "10.0.0.0/8,2001:db8::1")
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}), true)
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3"), Port: 1234}), true)
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("11.0.0.1"), Port: 1234}), false)
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}), true)
+	assert.Equal(t, acl.Permits(&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1234}), false)
+	assert.Equal(t, acl.Permits(&net.UnixAddr{Name: "@", Net: "unix"}), true)
+	assert.Equal(t, acl.Permits(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}), false)
+}
+
+func TestACLListenerAccept(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	acl := WrapACL(listener, "10.0.0.0/8")
+	// A denied connection is closed by the listener, while the accept-loop continues.
+	go func() {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+		var buf [1]byte
+		conn.Read(buf[:])
+		conn.Close()
+		acl.Close()
+	}()
+	conn, err := acl.Accept()
+	assert.Nil(t, conn)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,81 @@
+package httprelay
+
+import (
+	"io"
+	"net"
+	"strings"
+)
+
+// adblockOptions are the filter options that are compatible with blocking at host level. Blocking
+// at host level cannot distinguish first-party from third-party requests, nor resource types.
+// Rules limited to third-party requests are accepted, as these target hosts that serve third-party
+// content in the first place. Other options restrict rules in ways that cannot be honored, so
+// applying such rules would block more than intended.
+var adblockOptions = map[string]struct{}{
+	"third-party": {}, "3p": {}, "important": {}, "all": {}, "document": {}, "doc": {},
+}
+
+// LoadAdblock loads the host-level subset of an Adblock Plus filter list from provided reader.
+// Supported are blocking rules `||domain^`, which block the domain and its subdomains, and
+// exception rules `@@||domain^`, which exempt the domain and its subdomains from blocking. Options
+// `$third-party`, `$important`, `$all` and `$document` are accepted, though `$important` does not
+// override exceptions. Other rules, such as cosmetic rules and URL patterns, are counted in the
+// report as unsupported.
+func (b *BlocklistDialer) LoadAdblock(in io.Reader) (BlocklistReport, error) {
+	return b.LoadFormat(in, BlocklistAdblock)
+}
+
+// loadAdblockLine loads a single line of an Adblock Plus filter list.
+func loadAdblockLine(target blocklistTarget, report *BlocklistReport, line string) {
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		// skip comments and header
+		return
+	}
+	domain, exception, reason := parseAdblockRule(line)
+	switch {
+	case reason != "":
+		report.Unsupported[reason]++
+	case exception:
+		target.addException(domain)
+		report.Exceptions++
+	case net.ParseIP(domain) != nil:
+		target.addHost(domain)
+		report.Blocked++
+	default:
+		target.addDomain(domain)
+		report.Blocked++
+	}
+}
+
+// parseAdblockRule parses a host-level rule. Returns the normalized domain and whether the rule is
+// an exception, or the reason why the rule is not supported.
+func parseAdblockRule(line string) (string, bool, string) {
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") ||
+		strings.Contains(line, "#$#") {
+		return "", false, "cosmetic"
+	}
+	exception := strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+	if len(line) > 1 && line[0] == '/' && (strings.HasSuffix(line, "/") || strings.Contains(line, "/$")) {
+		return "", false, "regular expression"
+	}
+	pattern, options, _ := strings.Cut(line, "$")
+	if options != "" {
+		for _, option := range strings.Split(options, ",") {
+			if _, ok := adblockOptions[strings.TrimSpace(option)]; !ok {
+				name, _, _ := strings.Cut(option, "=")
+				return "", false, "option '" + name + "'"
+			}
+		}
+	}
+	domain, ok := strings.CutPrefix(pattern, "||")
+	if !ok {
+		return "", false, "URL pattern"
+	}
+	domain = strings.TrimSuffix(domain, "|")
+	domain, ok = strings.CutSuffix(domain, "^")
+	if !ok || domain == "" || strings.ContainsAny(domain, "/*^|:?=") {
+		return "", false, "URL pattern"
+	}
+	return normalizeHost(domain), exception, ""
+}
@@ -0,0 +1,78 @@
+package httprelay
+
+import (
+	"strings"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+const testAdblockList = `[Adblock Plus 2.0]
+! Title: test list
+||ads.example^
+||Tracker.example^$third-party
+||metrics.example^|
+||192.0.2.1^
+||important.example^$important,all
+@@||ok.ads.example^
+@@||partner.example^$document
+example.com##.banner
+##.advertisement
+||example.org/ads/*
+/banner/*/img^
+||script.example^$script
+||social.example^$domain=example.com
+||first.example^$~third-party
+/^https?:\/\/ads\./
+`
+
+func TestBlocklistDialerLoadAdblock(t *testing.T) {
+	b := BlocklistDialer{List: make(map[string]struct{}), Dialer: &TestNopDialer{}}
+	report, err := b.LoadAdblock(strings.NewReader(testAdblockList))
+	assert.Nil(t, err)
+	assert.Equal(t, report.Blocked, 5)
+	assert.Equal(t, report.Exceptions, 2)
+	assert.Equal(t, report.UnsupportedTotal(), 8)
+	assert.Equal(t, report.Unsupported["cosmetic"], 2)
+	assert.Equal(t, report.Unsupported["URL pattern"], 2)
+	assert.Equal(t, report.Unsupported["regular expression"], 1)
+	assert.Equal(t, report.Unsupported["option 'script'"], 1)
+	assert.Equal(t, report.Unsupported["option 'domain'"], 1)
+	assert.Equal(t, report.Unsupported["option '~third-party'"], 1)
+	assert.Equal(t, report.String(), "5 blocking rules, 2 exception rules, 8 unsupported rules "+
+		"(2 URL pattern, 2 cosmetic, 1 option 'domain', 1 option 'script', 1 option '~third-party', 1 regular expression)")
+	for _, addr := range []string{"ads.example:80", "www.ads.example:443", "tracker.example:443", "metrics.example:80", "192.0.2.1:443", "important.example:443"} {
+		if _, err := b.Dial("tcp", addr); err != ErrBlockedHost {
+			t.Errorf("Expected address '%s' to be blocked.", addr)
+		}
+	}
+	for _, addr := range []string{"ok.ads.example:443", "img.ok.ads.example:443", "example.com:80", "script.example:80", "notads.example:80", "[2001:db8::1]:443"} {
+		if _, err := b.Dial("tcp", addr); err != nil {
+			t.Errorf("Expected address '%s' to be allowed.", addr)
+		}
+	}
+}
+
+func TestBlocklistDialerExceptionsOverrideHosts(t *testing.T) {
+	b := BlocklistDialer{List: make(map[string]struct{}), Dialer: &TestNopDialer{}}
+	assert.Nil(t, b.Load(strings.NewReader("0.0.0.0 partner.example\n0.0.0.0 ads.example\n")))
+	_, err := b.LoadAdblock(strings.NewReader("@@||partner.example^\n"))
+	assert.Nil(t, err)
+	_, err = b.Dial("tcp", "partner.example:443")
+	assert.Nil(t, err)
+	_, err = b.Dial("tcp", "ads.example:443")
+	assert.Equal(t, err, error(ErrBlockedHost))
+}
+
+func TestWrapBlocklistBlockingAdblock(t *testing.T) {
+	dialer, err := WrapBlocklistBlocking(&TestNopDialer{}, "test/adblock.txt", BlocklistAdblock, nil)
+	assert.Nil(t, err)
+	_, err = dialer.Dial("tcp", "www.ads.example:443")
+	assert.Equal(t, err, error(ErrBlockedHost))
+	_, err = dialer.Dial("tcp", "tracker.example:443")
+	assert.Equal(t, err, error(ErrBlockedHost))
+	_, err = dialer.Dial("tcp", "cdn.ads.example:443")
+	assert.Nil(t, err)
+	_, err = ParseBlocklistFormat("unknown")
+	assert.NotNil(t, err)
+}
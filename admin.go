@@ -0,0 +1,279 @@
+package httprelay
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cobratbq/goutils/std/log"
+	http_ "github.com/cobratbq/goutils/std/net/http"
+	"golang.org/x/net/proxy"
+)
+
+// AdminHandler serves the administrative endpoint. The administrative endpoint is intended to be
+// exposed on a separate, non-public listener.
+type AdminHandler struct {
+	Metrics *Metrics
+	// Cache is the (optional) response cache that can be purged through the endpoint.
+	Cache *Cache
+	// Blocklists are the (optional) named blocklists that can be enabled and disabled through the
+	// endpoint.
+	Blocklists *BlocklistRegistry
+	// Stats are the (optional) statistics of blocked hosts that can be queried through the endpoint.
+	Stats *BlocklistStats
+	// Listeners are the (optional) listeners against which hosts are looked up.
+	Listeners []AdminListener
+}
+
+// AdminListener is a listener of the proxy, as known to the administrative endpoint.
+type AdminListener struct {
+	// Address is the address of the listener, by which it is selected.
+	Address string
+	// Dialer is the dialer of the listener, including any blocking.
+	Dialer proxy.Dialer
+	// Blocklists are the named blocklists that the listener uses.
+	Blocklists []*Blocklist
+}
+
+func (a *AdminHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == "/metrics":
+		resp.Header().Set("Content-Type", "application/json")
+		io.WriteString(resp, a.Metrics.String())
+	case req.URL.Path == "/cache/purge" && a.Cache != nil:
+		a.purgeCache(resp, req)
+	case req.URL.Path == "/blocklists" && a.Blocklists != nil:
+		a.listBlocklists(resp, req)
+	case strings.HasPrefix(req.URL.Path, "/blocklists/") && a.Blocklists != nil:
+		a.toggleBlocklist(resp, req)
+	case req.URL.Path == "/blocked" && a.Stats != nil:
+		a.reportBlocked(resp, req)
+	case req.URL.Path == "/lookup" && (a.Blocklists != nil || len(a.Listeners) > 0):
+		a.lookupHost(resp, req)
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+// purgeCache purges the stored response for the URI in query parameter 'url', or all stored
+// responses if absent.
+func (a *AdminHandler) purgeCache(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http_.RespondMethodNotAllowed(resp, []string{http.MethodPost}, nil)
+		return
+	}
+	var err error
+	if target := req.URL.Query().Get("url"); target != "" {
+		err = a.Cache.Purge(target)
+	} else {
+		err = a.Cache.PurgeAll()
+	}
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// respondJSON responds with the value encoded as JSON.
+func respondJSON(resp http.ResponseWriter, value any) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		log.Warnln("Failed to encode response of administrative endpoint:", err.Error())
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	resp.Write(encoded)
+}
+
+// blocklistStatus is the status of a named blocklist, as listed by listBlocklists.
+type blocklistStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Entries int    `json:"entries"`
+}
+
+// listBlocklists responds with the named blocklists as JSON array of objects with name, enabled
+// state and number of entries.
+func (a *AdminHandler) listBlocklists(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http_.RespondMethodNotAllowed(resp, []string{http.MethodGet, http.MethodHead}, nil)
+		return
+	}
+	lists := a.Blocklists.Lists()
+	statuses := make([]blocklistStatus, 0, len(lists))
+	for _, list := range lists {
+		statuses = append(statuses, blocklistStatus{Name: list.Name, Enabled: list.Enabled(), Entries: list.Len()})
+	}
+	respondJSON(resp, statuses)
+}
+
+// toggleBlocklist enables or disables the named blocklist according to query parameter 'enabled'.
+func (a *AdminHandler) toggleBlocklist(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http_.RespondMethodNotAllowed(resp, []string{http.MethodPost}, nil)
+		return
+	}
+	list := a.Blocklists.Lookup(strings.TrimPrefix(req.URL.Path, "/blocklists/"))
+	if list == nil {
+		http.NotFound(resp, req)
+		return
+	}
+	enabled, err := strconv.ParseBool(req.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(resp, "query parameter 'enabled' must be 'true' or 'false'", http.StatusBadRequest)
+		return
+	}
+	list.SetEnabled(enabled)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// defaultTopBlocked is the number of entries reported by reportBlocked if not specified.
+const defaultTopBlocked = 10
+
+// blockedReport is the report of blocked hosts by reportBlocked.
+type blockedReport struct {
+	Top        []blockedEntry    `json:"top"`
+	Blocklists map[string]uint64 `json:"blocklists"`
+	Clients    map[string]uint64 `json:"clients"`
+}
+
+// blockedEntry is the number of hits of an entry of a blocklist, as reported by reportBlocked.
+type blockedEntry struct {
+	List  string `json:"list"`
+	Entry string `json:"entry"`
+	Hits  uint64 `json:"hits"`
+}
+
+// reportBlocked responds with the statistics of blocked hosts as JSON object with the top entries
+// by hits (query parameter 'top', 10 if absent), and the hits per blocklist and per client.
+func (a *AdminHandler) reportBlocked(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http_.RespondMethodNotAllowed(resp, []string{http.MethodGet, http.MethodHead}, nil)
+		return
+	}
+	top := defaultTopBlocked
+	if value := req.URL.Query().Get("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil || top < 1 {
+			http.Error(resp, "query parameter 'top' must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	report := blockedReport{
+		Top:        []blockedEntry{},
+		Blocklists: hitCountsByKey(a.Stats.lists.top(0)),
+		Clients:    hitCountsByKey(a.Stats.clients.top(0)),
+	}
+	for _, entry := range a.Stats.topEntries(top) {
+		report.Top = append(report.Top, blockedEntry{List: entry.list, Entry: entry.entry, Hits: entry.hits})
+	}
+	respondJSON(resp, &report)
+}
+
+// hitCountsByKey returns the hit counts as map of hits by key.
+func hitCountsByKey(counts []hitCount) map[string]uint64 {
+	byKey := make(map[string]uint64, len(counts))
+	for _, count := range counts {
+		byKey[count.key] = count.hits
+	}
+	return byKey
+}
+
+// lookupResult is the result of looking up a host by lookupHost.
+type lookupResult struct {
+	Listener string        `json:"listener,omitempty"`
+	Host     string        `json:"host"`
+	Blocked  bool          `json:"blocked"`
+	List     *string       `json:"list"`
+	Matches  []lookupMatch `json:"matches"`
+}
+
+// lookupMatch is an entry of a named blocklist that matches the host looked up by lookupHost.
+type lookupMatch struct {
+	List    string `json:"list"`
+	Enabled bool   `json:"enabled"`
+	Rule    string `json:"rule"`
+	Entry   string `json:"entry"`
+	Blocks  bool   `json:"blocks"`
+	Reason  string `json:"reason"`
+}
+
+// lookupHost responds with the result of looking up the host in query parameter 'host', as JSON
+// object with the normalized host, whether it is blocked and by which blocklist, and every matching
+// entry of the named blocklists with the reason it matches. If listeners are known, the host is
+// checked against the dialer of the listener in query parameter 'listener', which may be omitted if
+// there is only one. Otherwise, the host is looked up in all named blocklists.
+func (a *AdminHandler) lookupHost(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http_.RespondMethodNotAllowed(resp, []string{http.MethodGet, http.MethodHead}, nil)
+		return
+	}
+	host := req.URL.Query().Get("host")
+	if host == "" {
+		http.Error(resp, "query parameter 'host' is required", http.StatusBadRequest)
+		return
+	}
+	if len(a.Listeners) == 0 {
+		respondJSON(resp, lookupLists(host, a.Blocklists.Lists()))
+		return
+	}
+	var listener *AdminListener
+	if address := req.URL.Query().Get("listener"); address != "" {
+		for i := range a.Listeners {
+			if a.Listeners[i].Address == address {
+				listener = &a.Listeners[i]
+				break
+			}
+		}
+		if listener == nil {
+			http.Error(resp, "unknown listener: "+address, http.StatusNotFound)
+			return
+		}
+	} else if len(a.Listeners) == 1 {
+		listener = &a.Listeners[0]
+	} else {
+		http.Error(resp, "query parameter 'listener' is required", http.StatusBadRequest)
+		return
+	}
+	result := lookupLists(host, listener.Blocklists)
+	result.Listener = listener.Address
+	// The dialer of the listener decides, as it includes the address rules and unnamed blocklist.
+	err := checkHost(req.Context(), listener.Dialer, fullHost(result.Host, "443"), false)
+	result.Blocked, result.List = isBlocked(err), nil
+	var blocked *BlockedError
+	if errors.As(err, &blocked) {
+		result.List = &blocked.List
+	}
+	respondJSON(resp, result)
+}
+
+// lookupLists looks up the host in the named blocklists.
+func lookupLists(host string, lists []*Blocklist) *lookupResult {
+	host, matches := explainLists(host, lists)
+	result := lookupResult{Host: host, Matches: make([]lookupMatch, 0, len(matches))}
+	// Exceptions of enabled blocklists take precedence over blocks of all blocklists.
+	excepted := false
+	for i := range matches {
+		excepted = excepted || (matches[i].rule == ruleException && matches[i].list.Enabled())
+	}
+	for i := range matches {
+		match := &matches[i]
+		if !excepted && !result.Blocked && match.blocks() {
+			result.Blocked, result.List = true, &match.list.Name
+		}
+		result.Matches = append(result.Matches, lookupMatch{
+			List:    match.list.Name,
+			Enabled: match.list.Enabled(),
+			Rule:    match.rule,
+			Entry:   match.entry,
+			Blocks:  match.blocks(),
+			Reason:  match.reason(host),
+		})
+	}
+	return &result
+}
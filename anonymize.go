@@ -0,0 +1,128 @@
+package httprelay
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cobratbq/goutils/std/errors"
+)
+
+// commonUserAgent is a common user agent string, i.e. Firefox ESR on Windows, for use in
+// anonymizing profiles. A common value blends in with other traffic.
+const commonUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:128.0) Gecko/20100101 Firefox/128.0"
+
+// RefererPolicy determines the treatment of the Referer header.
+type RefererPolicy uint
+
+const (
+	// RefererPreserve forwards the Referer header as-is.
+	RefererPreserve RefererPolicy = iota
+	// RefererOrigin reduces the Referer header to the origin of the referring page.
+	RefererOrigin
+	// RefererRemove removes the Referer header.
+	RefererRemove
+)
+
+// AnonymizeProfile describes which identifying request headers are removed or normalized before a
+// request leaves the relay.
+type AnonymizeProfile struct {
+	// Name is the name of the profile.
+	Name string
+	// Remove lists headers that are removed.
+	Remove []string
+	// RemovePrefixes lists prefixes of headers that are removed, e.g. `Sec-Ch-` for client hints.
+	RemovePrefixes []string
+	// Set contains headers that are set to a fixed value, replacing the client's value if present.
+	Set map[string]string
+	// Referer is the treatment of the Referer header.
+	Referer RefererPolicy
+}
+
+// Anonymizing profiles, in order of increasing strictness:
+//   - `minimal` removes headers that reveal the client or the path taken: `From`, `Via`,
+//     `Forwarded`, `X-Forwarded-*`, `X-Real-Ip` and client hints (`Sec-Ch-*`).
+//   - `standard` additionally sets `User-Agent` and `Accept-Language` to common values, reduces
+//     `Referer` to the origin, and removes `If-None-Match` which enables ETag-based tracking.
+//   - `strict` additionally removes `Referer`, `Cookie`, `If-Modified-Since`, and the `DNT` and
+//     `Sec-Gpc` preference signals, which make the client more distinguishable.
+var (
+	AnonymizeMinimal = AnonymizeProfile{
+		Name:           "minimal",
+		Remove:         []string{"From", "Via", "Forwarded", "X-Real-Ip"},
+		RemovePrefixes: []string{"X-Forwarded-", "Sec-Ch-"},
+		Referer:        RefererPreserve,
+	}
+	AnonymizeStandard = AnonymizeProfile{
+		Name:           "standard",
+		Remove:         []string{"From", "Via", "Forwarded", "X-Real-Ip", "If-None-Match"},
+		RemovePrefixes: []string{"X-Forwarded-", "Sec-Ch-"},
+		Set:            map[string]string{"User-Agent": commonUserAgent, "Accept-Language": "en-US,en;q=0.5"},
+		Referer:        RefererOrigin,
+	}
+	AnonymizeStrict = AnonymizeProfile{
+		Name: "strict",
+		Remove: []string{"From", "Via", "Forwarded", "X-Real-Ip", "If-None-Match", "If-Modified-Since",
+			"Cookie", "Dnt", "Sec-Gpc"},
+		RemovePrefixes: []string{"X-Forwarded-", "Sec-Ch-"},
+		Set:            map[string]string{"User-Agent": commonUserAgent, "Accept-Language": "en-US,en;q=0.5"},
+		Referer:        RefererRemove,
+	}
+)
+
+// LookupAnonymizeProfile looks up an anonymizing profile by name.
+func LookupAnonymizeProfile(name string) (*AnonymizeProfile, error) {
+	for _, profile := range []*AnonymizeProfile{&AnonymizeMinimal, &AnonymizeStandard, &AnonymizeStrict} {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+	return nil, errors.Context(ErrUnknownAnonymizeProfile, "'"+name+"'")
+}
+
+// ErrUnknownAnonymizeProfile indicates that the anonymizing profile is not known.
+var ErrUnknownAnonymizeProfile = errors.NewStringError("unknown anonymizing profile")
+
+// Apply removes and normalizes identifying headers according to the profile. A nil profile does not
+// change any headers.
+func (p *AnonymizeProfile) Apply(header http.Header) {
+	if p == nil {
+		return
+	}
+	for _, name := range p.Remove {
+		header.Del(name)
+	}
+	for name := range header {
+		for _, prefix := range p.RemovePrefixes {
+			if strings.HasPrefix(name, prefix) {
+				delete(header, name)
+				break
+			}
+		}
+	}
+	for name, value := range p.Set {
+		header.Set(name, value)
+	}
+	switch p.Referer {
+	case RefererOrigin:
+		if referer := header.Get("Referer"); referer != "" {
+			if origin := refererOrigin(referer); origin != "" {
+				header.Set("Referer", origin)
+			} else {
+				header.Del("Referer")
+			}
+		}
+	case RefererRemove:
+		header.Del("Referer")
+	}
+}
+
+// refererOrigin reduces a referer to its origin, formatted as URL with empty path. Returns "" if the
+// referer is not a valid absolute URL.
+func refererOrigin(referer string) string {
+	u, err := url.Parse(referer)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host + "/"
+}
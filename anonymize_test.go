@@ -0,0 +1,122 @@
+package httprelay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+// testIdentifyingRequest creates a request with headers typical of a browser, including
+// identifying headers.
+func testIdentifyingRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64; rv:140.0) Gecko/20100101 Firefox/140.0")
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Accept-Language", "nl-NL,nl;q=0.9,en;q=0.5")
+	req.Header.Set("Referer", "https://search.example.org/results?q=secret")
+	req.Header.Set("From", "user@example.org")
+	req.Header.Set("Via", "1.1 internal-proxy")
+	req.Header.Set("Forwarded", "for=192.168.1.10")
+	req.Header.Set("X-Forwarded-For", "192.168.1.10")
+	req.Header.Set("X-Forwarded-Host", "intranet")
+	req.Header.Set("Sec-CH-UA", `"Chromium";v="140"`)
+	req.Header.Set("Sec-CH-UA-Platform", `"Linux"`)
+	req.Header.Set("If-None-Match", `"tracking-id-1234"`)
+	req.Header.Set("If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT")
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("DNT", "1")
+	req.Header.Set("Sec-GPC", "1")
+	return req
+}
+
+// testForwardedHeaders sends the request through the proxy handler and returns the headers as
+// received by the origin server, formatted as sorted "Name: value" lines.
+func testForwardedHeaders(t *testing.T, profile *AnonymizeProfile, req *http.Request) []string {
+	var received []string
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		for name, values := range req.Header {
+			received = append(received, name+": "+strings.Join(values, ", "))
+		}
+	}))
+	defer origin.Close()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, Anonymize: profile}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	sort.Strings(received)
+	return received
+}
+
+func testExpectHeaders(t *testing.T, received []string, expected []string) {
+	t.Helper()
+	sort.Strings(expected)
+	if strings.Join(received, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected headers leaving the relay:\n%s\nexpected:\n%s",
+			strings.Join(received, "\n"), strings.Join(expected, "\n"))
+	}
+}
+
+func TestAnonymizeMinimal(t *testing.T) {
+	received := testForwardedHeaders(t, &AnonymizeMinimal, testIdentifyingRequest())
+	testExpectHeaders(t, received, []string{
+		"Accept: text/html",
+		"Accept-Language: nl-NL,nl;q=0.9,en;q=0.5",
+		"Cookie: session=1",
+		"Dnt: 1",
+		`If-Modified-Since: Mon, 01 Jan 2024 00:00:00 GMT`,
+		`If-None-Match: "tracking-id-1234"`,
+		"Referer: https://search.example.org/results?q=secret",
+		"Sec-Gpc: 1",
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:140.0) Gecko/20100101 Firefox/140.0",
+	})
+}
+
+func TestAnonymizeStandard(t *testing.T) {
+	received := testForwardedHeaders(t, &AnonymizeStandard, testIdentifyingRequest())
+	testExpectHeaders(t, received, []string{
+		"Accept: text/html",
+		"Accept-Language: en-US,en;q=0.5",
+		"Cookie: session=1",
+		"Dnt: 1",
+		`If-Modified-Since: Mon, 01 Jan 2024 00:00:00 GMT`,
+		"Referer: https://search.example.org/",
+		"Sec-Gpc: 1",
+		"User-Agent: " + commonUserAgent,
+	})
+}
+
+func TestAnonymizeStrict(t *testing.T) {
+	received := testForwardedHeaders(t, &AnonymizeStrict, testIdentifyingRequest())
+	testExpectHeaders(t, received, []string{
+		"Accept: text/html",
+		"Accept-Language: en-US,en;q=0.5",
+		"User-Agent: " + commonUserAgent,
+	})
+}
+
+func TestAnonymizeDisabled(t *testing.T) {
+	received := testForwardedHeaders(t, nil, testIdentifyingRequest())
+	assert.Equal(t, len(received), 16)
+}
+
+func TestAnonymizeStandardInvalidReferer(t *testing.T) {
+	header := http.Header{}
+	header.Set("Referer", "/relative/path")
+	AnonymizeStandard.Apply(header)
+	assert.KeyAbsent(t, header, "Referer")
+}
+
+func TestLookupAnonymizeProfile(t *testing.T) {
+	for _, name := range []string{"minimal", "standard", "strict"} {
+		profile, err := LookupAnonymizeProfile(name)
+		assert.Nil(t, err)
+		assert.Equal(t, profile.Name, name)
+	}
+	if _, err := LookupAnonymizeProfile("paranoid"); err == nil {
+		t.Fatal("Expected error for unknown profile.")
+	}
+}
@@ -1,15 +1,13 @@
 package httprelay
 
 import (
-	"bufio"
+	"context"
 	"io"
 	"log"
 	"net"
 	"os"
 	"strings"
 
-	bufio_ "github.com/cobratbq/goutils/std/bufio"
-	"github.com/cobratbq/goutils/std/builtin/set"
 	"github.com/cobratbq/goutils/std/builtin/slices"
 	"github.com/cobratbq/goutils/std/errors"
 	io_ "github.com/cobratbq/goutils/std/io"
@@ -18,26 +16,75 @@ import (
 )
 
 // WrapPerHostBlocking wraps a dialer with a PerHost conditional bypass dialer that refuses dialing
-// any address that is local or custom specified according to parameters specified.
+// any address that is local or custom specified according to parameters specified. Host names are
+// never resolved: networks only match IP literals, host names only match hosts and zones.
 func WrapPerHostBlocking(dialer proxy.Dialer, local bool, custom string) proxy.Dialer {
-	// Prepare dialer to block addresses
+	// Prepare dialer to block addresses, and an identically configured dialer that only checks.
 	perHostDialer := proxy.NewPerHost(dialer, &NopDialer{})
-	if local {
-		slices.ForEach(net_.PrivateNetworks, perHostDialer.AddNetwork)
+	checkDialer := proxy.NewPerHost(allowDialer{}, &NopDialer{})
+	for _, perHost := range []*proxy.PerHost{perHostDialer, checkDialer} {
+		if local {
+			slices.ForEach(net_.PrivateNetworks, perHost.AddNetwork)
+		}
+		if custom != "" {
+			perHost.AddFromString(custom)
+		}
+	}
+	return &perHostBlockingDialer{PerHost: perHostDialer, check: checkDialer, next: dialer}
+}
+
+// perHostBlockingDialer is the PerHost dialer of WrapPerHostBlocking, extended such that addresses
+// can be checked without dialing.
+type perHostBlockingDialer struct {
+	*proxy.PerHost
+	// check is configured identically, but with a dialer that allows without dialing.
+	check *proxy.PerHost
+	next  proxy.Dialer
+}
+
+func (p *perHostBlockingDialer) checkHost(ctx context.Context, addr string, count bool) error {
+	if _, err := p.check.DialContext(ctx, "tcp", addr); err != nil {
+		return err
 	}
-	if custom != "" {
-		perHostDialer.AddFromString(custom)
+	return checkHost(ctx, p.next, addr, count)
+}
+
+// allowDialer allows any address without dialing. It returns neither a connection nor an error.
+type allowDialer struct{}
+
+func (allowDialer) Dial(network, addr string) (net.Conn, error) {
+	return nil, nil
+}
+
+// hostChecker is implemented by dialers that refuse addresses, such that an address can be checked
+// without dialing.
+type hostChecker interface {
+	// checkHost returns the error with which dialing the address would be refused, if any. Count
+	// indicates whether a refusal counts in statistics, as if dialing was attempted.
+	checkHost(ctx context.Context, addr string, count bool) error
+}
+
+// checkHost checks whether the dialer chain would refuse the address, without dialing. Only dialers
+// that implement hostChecker are checked, up to the first dialer that does not.
+func checkHost(ctx context.Context, dialer proxy.Dialer, addr string, count bool) error {
+	if checker, ok := dialer.(hostChecker); ok {
+		return checker.checkHost(ctx, addr, count)
 	}
-	return perHostDialer
+	return nil
 }
 
-// WrapBlocklistBlocking loads a blocklist from specified file and includes it in the dialer. Any
-// address present on the blocklist will not be allowed to dial.
-func WrapBlocklistBlocking(dialer proxy.Dialer, fileName string) (proxy.Dialer, error) {
+// WrapBlocklistBlocking loads a blocklist in the specified format from specified file and includes
+// it in the dialer. Any address present on the blocklist will not be allowed to dial. Sinks are the
+// addresses that indicate blocked hosts in hosts-formatted and dnsmasq blocklists, nil for
+// DefaultSinks.
+func WrapBlocklistBlocking(dialer proxy.Dialer, fileName string, format BlocklistFormat, sinks []string) (proxy.Dialer, error) {
 	blocklistDialer := BlocklistDialer{
-		List:   make(map[string]struct{}, 0),
-		Dialer: dialer}
-	if err := loadHostsFile(&blocklistDialer, fileName); err != nil {
+		List:       make(map[string]struct{}, 0),
+		Domains:    make(map[string]struct{}, 0),
+		Exceptions: make(map[string]struct{}, 0),
+		Sinks:      sinks,
+		Dialer:     dialer}
+	if err := loadBlocklistFile(&blocklistDialer, fileName, format); err != nil {
 		return nil, errors.Context(err, "failed to load blocklist: "+fileName)
 	}
 	return &blocklistDialer, nil
@@ -45,57 +92,177 @@ func WrapBlocklistBlocking(dialer proxy.Dialer, fileName string) (proxy.Dialer,
 
 // loadHostsFile loads a `hosts`-formatted blocklist into provided BlocklistDialer.
 func loadHostsFile(dialer *BlocklistDialer, filename string) error {
-	hostsFile, err := os.Open(filename)
+	return loadBlocklistFile(dialer, filename, BlocklistHosts)
+}
+
+// loadBlocklistFile loads a blocklist in the specified format into provided BlocklistDialer.
+func loadBlocklistFile(dialer *BlocklistDialer, filename string, format BlocklistFormat) error {
+	blocklistFile, err := os.Open(filename)
 	if err != nil {
 		return errors.Context(err, "failed to open file "+filename)
 	}
-	defer io_.CloseLogged(hostsFile, "failed to close hosts file")
-	return dialer.Load(hostsFile)
+	defer io_.CloseLogged(blocklistFile, "failed to close blocklist file")
+	report, err := dialer.LoadFormat(blocklistFile, format)
+	if err != nil {
+		return err
+	}
+	logBlocklistReport(filename, &report)
+	return nil
 }
 
-// BlocklistDialer checks the loaded blocklist before dialing.
+// logBlocklistReport logs the report of loading the named blocklist.
+func logBlocklistReport(name string, report *BlocklistReport) {
+	log.Printf("Loaded %s-formatted blocklist '%s': %s", report.Format, name, report.String())
+}
+
+// BlocklistDialer checks the loaded blocklist before dialing. Host names are matched as provided,
+// without resolving them.
 type BlocklistDialer struct {
-	List   map[string]struct{}
+	// List contains the blocked hosts, which are matched exactly.
+	List map[string]struct{}
+	// Domains contains the blocked domains, which are matched including their subdomains.
+	Domains map[string]struct{}
+	// Exceptions contains the domains, including their subdomains, that are never blocked. These
+	// take precedence over List and Domains.
+	Exceptions map[string]struct{}
+	// Lists are the named blocklists that are checked in addition to the entries above. Hosts
+	// blocked by a named blocklist are refused with a BlockedError.
+	Lists []*Blocklist
+	// Stats (optional) counts the blocked hosts per entry, per blocklist and per client.
+	Stats *BlocklistStats
+	// Sinks are the addresses that indicate a blocked host in hosts-formatted and dnsmasq
+	// blocklists. Nil indicates DefaultSinks.
+	Sinks  []string
 	Dialer proxy.Dialer
 }
 
 // Dial checks the address against the blocklist and if not present uses the provided dialer to dial
-// the address.
+// the address. Both host names and (IPv4 and IPv6) IP literals are matched.
 func (b *BlocklistDialer) Dial(network, addr string) (net.Conn, error) {
-	if i := strings.IndexByte(addr, ':'); i > -1 {
-		addr = addr[:i]
+	return b.DialContext(context.Background(), network, addr)
+}
+
+// DialContext checks the address against the blocklist and if not present uses the provided dialer
+// to dial the address with context.
+func (b *BlocklistDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if err := b.check(ctx, addr, true); err != nil {
+		return nil, err
 	}
-	if _, ok := b.List[addr]; ok {
-		return nil, ErrBlockedHost
+	return dialContext(ctx, b.Dialer, network, addr)
+}
+
+func (b *BlocklistDialer) checkHost(ctx context.Context, addr string, count bool) error {
+	if err := b.check(ctx, addr, count); err != nil {
+		return err
+	}
+	return checkHost(ctx, b.Dialer, addr, count)
+}
+
+// check checks the address against the blocklist and the enabled named blocklists, and counts the
+// hit if blocked and count is set. Exceptions of any of the blocklists take precedence over blocks of all
+// blocklists, such that a blocklist with exceptions acts as allowlist.
+func (b *BlocklistDialer) check(ctx context.Context, addr string, count bool) error {
+	host := normalizeHost(hostname(addr))
+	if b.excepted(host) {
+		return nil
+	}
+	if rule, entry := b.matchBlock(host); rule != "" {
+		if count {
+			b.Stats.count(ctx, "", entry)
+		}
+		return ErrBlockedHost
+	}
+	for _, list := range b.Lists {
+		if !list.Enabled() {
+			continue
+		}
+		if rule, entry := list.matchBlock(host); rule != "" {
+			if count {
+				b.Stats.count(ctx, list.Name, entry)
+			}
+			return &BlockedError{Host: host, List: list.Name}
+		}
+	}
+	return nil
+}
+
+// Kinds of rules that match a host.
+const (
+	// ruleHost blocks the host exactly.
+	ruleHost = "host"
+	// ruleDomain blocks the domain including its subdomains.
+	ruleDomain = "domain"
+	// ruleException exempts the domain including its subdomains from blocking.
+	ruleException = "exception"
+)
+
+// excepted checks whether an exception of the blocklist, or of any of the enabled named blocklists,
+// matches the (normalized) host.
+func (b *BlocklistDialer) excepted(host string) bool {
+	if _, ok := matchingDomain(b.Exceptions, host); ok {
+		return true
+	}
+	for _, list := range b.Lists {
+		if list.Enabled() && list.matchException(host) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// match returns the kind of rule and the entry that matches the (normalized) host, or empty strings
+// if no entry matches. Exceptions take precedence.
+func (b *BlocklistDialer) match(host string) (string, string) {
+	if entry, ok := matchingDomain(b.Exceptions, host); ok {
+		return ruleException, entry
+	}
+	return b.matchBlock(host)
+}
+
+// matchBlock returns the kind of rule and the entry that blocks the (normalized) host, or empty
+// strings if no entry blocks it. Exceptions are not considered.
+func (b *BlocklistDialer) matchBlock(host string) (string, string) {
+	if _, ok := b.List[host]; ok {
+		return ruleHost, host
+	}
+	if entry, ok := matchingDomain(b.Domains, host); ok {
+		return ruleDomain, entry
+	}
+	return "", ""
+}
+
+// matchingDomain returns the host, or otherwise its closest parent domain, if present in the set.
+func matchingDomain(domains map[string]struct{}, host string) (string, bool) {
+	if len(domains) == 0 {
+		return "", false
+	}
+	if net.ParseIP(host) != nil {
+		// IP literals have no parent domains.
+		_, ok := domains[host]
+		return host, ok
+	}
+	for {
+		if _, ok := domains[host]; ok {
+			return host, true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return "", false
+		}
+		host = host[i+1:]
 	}
-	return b.Dialer.Dial(network, addr)
 }
 
 // Load loads a blocklist from provided reader that has content formatted like the operating system
 // 'hosts' files.
 func (b *BlocklistDialer) Load(in io.Reader) error {
-	reader := bufio.NewReader(in)
-	var skipped uint
-	if err := bufio_.ReadStringLinesFunc(reader, '\n', func(line string) error {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			// skip comment lines
-			return nil
-		}
-		parts := strings.Fields(line)
-		if parts[0] != "0.0.0.0" {
-			// for now, only allow resolutions to 0.0.0.0 for purpose of blocking
-			skipped++
-			return nil
-		}
-		set.InsertMany(b.List, parts[1:])
-		return nil
-	}); err != nil {
-		return errors.Context(err, "failed to read hosts content")
+	report, err := b.LoadFormat(in, BlocklistHosts)
+	if err != nil {
+		return err
 	}
-	if skipped > 0 {
-		log.Printf("Skipped %d lines for not using destination address '0.0.0.0'.", skipped)
+	if skipped := report.UnsupportedTotal(); skipped > 0 {
+		log.Printf("Skipped %d lines: %s", skipped, report.String())
 	}
-	log.Println("Total entries in blocklist:", len(b.List))
+	log.Printf("Total entries in blocklist: %d (%d exceptions)", len(b.List)+len(b.Domains), len(b.Exceptions))
 	return nil
 }
@@ -49,6 +49,32 @@ func TestBlocklistDialerLoadHosts(t *testing.T) {
 	}
 }
 
+func TestBlocklistDialerDialsWithPort(t *testing.T) {
+	dialer := TestRecordingDialer{}
+	b := BlocklistDialer{List: make(map[string]struct{}, 0), Dialer: &dialer}
+	b.Dial("tcp", "hello.world:80")
+	b.Dial("tcp", "[2001:db8::1]:443")
+	assert.Equal(t, len(dialer.addrs), 2)
+	assert.Equal(t, dialer.addrs[0], "hello.world:80")
+	assert.Equal(t, dialer.addrs[1], "[2001:db8::1]:443")
+}
+
+func TestBlocklistDialerIPv6(t *testing.T) {
+	hostsFile := []byte("0.0.0.0 2001:db8::1 fe80::1\n0.0.0.0 Hello.World\n")
+	b := BlocklistDialer{List: make(map[string]struct{}, 0), Dialer: &TestNopDialer{}}
+	b.Load(bytes.NewReader(hostsFile))
+	for _, addr := range []string{"[2001:db8::1]:443", "[2001:0db8:0::1]:80", "[fe80::1%eth0]:443", "hello.world:80", "HELLO.world:443"} {
+		if _, err := b.Dial("tcp", addr); err != ErrBlockedHost {
+			t.Errorf("Expected address '%s' to be blocked.", addr)
+		}
+	}
+	for _, addr := range []string{"[2001:db8::2]:443", "[fe80::2%eth0]:443", "[::1]:80"} {
+		if _, err := b.Dial("tcp", addr); err != nil {
+			t.Errorf("Expected address '%s' to be allowed.", addr)
+		}
+	}
+}
+
 func TestLoadBlocklistFromFile(t *testing.T) {
 	dialer := BlocklistDialer{List: make(map[string]struct{}, 0), Dialer: &TestNopDialer{}}
 	loadHostsFile(&dialer, "test/hosts")
@@ -63,6 +89,15 @@ func TestLoadBlocklistFromFile(t *testing.T) {
 	}
 }
 
+type TestRecordingDialer struct {
+	addrs []string
+}
+
+func (d *TestRecordingDialer) Dial(network, addr string) (net.Conn, error) {
+	d.addrs = append(d.addrs, addr)
+	return nil, ErrBlockedHost
+}
+
 type TestNopDialer struct{}
 
 func (*TestNopDialer) Dial(network, addr string) (net.Conn, error) {
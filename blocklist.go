@@ -0,0 +1,348 @@
+package httprelay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	stderrors "errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cobratbq/goutils/std/errors"
+)
+
+// Blocklist is a named blocklist that can be enabled and disabled at runtime. Its entries are
+// replaced atomically when (re)loaded, so a Blocklist is safe for concurrent use.
+type Blocklist struct {
+	// Name identifies the blocklist in logs, metrics and responses.
+	Name string
+	// Source is the filename or HTTP(S) URL the blocklist is loaded from.
+	Source string
+	// Format is the format of the source.
+	Format BlocklistFormat
+	// Sinks are the addresses that indicate a blocked host, nil for DefaultSinks.
+	Sinks []string
+	// SHA256 is the (optional) hex-encoded SHA-256 checksum that the content must match.
+	SHA256 string
+	// MinisignKey is the (optional) base64-encoded minisign public key that the content's signature
+	// must verify against. The signature is loaded from the source with suffix '.minisig'.
+	MinisignKey string
+	// CacheDir is the (optional) directory for keeping the last-known-good copy of content fetched
+	// from a URL, which is used when the URL is unavailable at startup.
+	CacheDir string
+	// Client is the HTTP client for fetching content from a URL. If nil, `http.DefaultClient` is
+	// used, which dials directly. See NewBlocklistClient.
+	Client   *http.Client
+	disabled atomic.Bool
+	// entries holds the loaded entries in compact form.
+	entries atomic.Pointer[blocklistEntries]
+	// reloading serializes reloads and guards the validators of content fetched from a URL.
+	reloading    sync.Mutex
+	etag         string
+	lastModified string
+}
+
+// BlockedError indicates that the host is blocked by a named blocklist. It wraps ErrBlockedHost.
+type BlockedError struct {
+	Host string
+	List string
+}
+
+func (e *BlockedError) Error() string {
+	return ErrBlockedHost.Error() + " by blocklist '" + e.List + "'"
+}
+
+func (e *BlockedError) Unwrap() error {
+	return ErrBlockedHost
+}
+
+// isBlocked checks whether the error indicates that the host is blocked.
+func isBlocked(err error) bool {
+	return stderrors.Is(err, ErrBlockedHost)
+}
+
+// respondBlocked responds with 403 (Forbidden) for a blocked host. If blocked by a named blocklist,
+// the response body names the blocklist.
+func respondBlocked(resp http.ResponseWriter, err error) {
+	var blocked *BlockedError
+	if !stderrors.As(err, &blocked) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	resp.WriteHeader(http.StatusForbidden)
+	io.WriteString(resp, "Host '"+blocked.Host+"' is blocked by blocklist '"+blocked.List+"'.\n")
+}
+
+// ErrDuplicateBlocklist indicates that multiple blocklists have the same name.
+var ErrDuplicateBlocklist = errors.NewStringError("duplicate blocklist name")
+
+// ErrInvalidBlocklistSpec indicates that the specification of a blocklist could not be parsed.
+var ErrInvalidBlocklistSpec = errors.NewStringError("invalid blocklist specification")
+
+// ErrBlocklistVerification indicates that the content of a blocklist does not match its checksum or
+// signature.
+var ErrBlocklistVerification = errors.NewStringError("blocklist verification failed")
+
+// LoadBlocklists loads the blocklist file, or if the path is a directory, every file in the
+// directory, except hidden files. Blocklists are named after their filename without extension.
+func LoadBlocklists(path string, format BlocklistFormat, sinks []string) ([]*Blocklist, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Context(err, "failed to access blocklist "+path)
+	}
+	filenames := []string{path}
+	if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, errors.Context(err, "failed to read blocklist directory "+path)
+		}
+		filenames = filenames[:0]
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && !strings.HasPrefix(entry.Name(), ".") {
+				filenames = append(filenames, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(filenames)
+	}
+	var lists []*Blocklist
+	for _, filename := range filenames {
+		list := Blocklist{Name: blocklistName(filename), Source: filename, Format: format, Sinks: sinks}
+		if err := list.Reload(); err != nil {
+			return nil, err
+		}
+		lists = append(lists, &list)
+	}
+	return lists, nil
+}
+
+// blocklistName derives the name of a blocklist from its filename.
+func blocklistName(filename string) string {
+	if isRemoteSource(filename) {
+		return remoteBlocklistName(filename)
+	}
+	base := filepath.Base(filename)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// Reload loads the blocklist from its source, then replaces the current entries. If loading or
+// verification fails, the current entries remain in use.
+func (l *Blocklist) Reload() error {
+	l.reloading.Lock()
+	defer l.reloading.Unlock()
+	if isRemoteSource(l.Source) {
+		return l.reloadRemote()
+	}
+	if isCompiledBlocklistFile(l.Source) {
+		return l.loadCompiled()
+	}
+	data, err := os.ReadFile(l.Source)
+	if err != nil {
+		return errors.Context(err, "failed to read file "+l.Source)
+	}
+	var signature []byte
+	if l.MinisignKey != "" {
+		if signature, err = os.ReadFile(l.Source + minisignSuffix); err != nil {
+			return errors.Context(err, "failed to read signature of blocklist '"+l.Name+"'")
+		}
+	}
+	return l.load(data, signature)
+}
+
+// load verifies the content, then parses the content and replaces the current entries.
+func (l *Blocklist) load(data, signature []byte) error {
+	if err := l.verify(data, signature); err != nil {
+		return errors.Context(err, "blocklist '"+l.Name+"'")
+	}
+	var builder blocklistEntriesBuilder
+	report, err := loadBlocklist(&builder, bytes.NewReader(data), l.Format, l.Sinks)
+	if err != nil {
+		return errors.Context(err, "failed to load blocklist '"+l.Name+"'")
+	}
+	l.entries.Store(builder.build())
+	logBlocklistReport(l.Name, &report)
+	return nil
+}
+
+// verify verifies the content against the checksum and the minisign signature, if configured.
+func (l *Blocklist) verify(data, signature []byte) error {
+	if l.SHA256 != "" {
+		checksum := sha256.Sum256(data)
+		if !strings.EqualFold(hex.EncodeToString(checksum[:]), l.SHA256) {
+			return errors.Context(ErrBlocklistVerification, "SHA-256 checksum mismatch")
+		}
+	}
+	if l.MinisignKey != "" {
+		key, err := parseMinisignKey(l.MinisignKey)
+		if err != nil {
+			return err
+		}
+		return key.verify(data, signature)
+	}
+	return nil
+}
+
+// Enabled indicates whether the blocklist is enabled. Blocklists are enabled initially.
+func (l *Blocklist) Enabled() bool {
+	return !l.disabled.Load()
+}
+
+// SetEnabled enables or disables the blocklist.
+func (l *Blocklist) SetEnabled(enabled bool) {
+	l.disabled.Store(!enabled)
+}
+
+// Len returns the number of entries, excluding exceptions.
+func (l *Blocklist) Len() int {
+	entries := l.entries.Load()
+	if entries == nil {
+		return 0
+	}
+	return entries.list.Len() + entries.domains.Len()
+}
+
+// match returns the kind of rule and the entry that matches the (normalized) host, regardless of
+// whether the blocklist is enabled.
+func (l *Blocklist) match(host string) (string, string) {
+	entries := l.entries.Load()
+	if entries == nil {
+		return "", ""
+	}
+	return entries.match(host)
+}
+
+// matchBlock returns the kind of rule and the entry that blocks the (normalized) host, disregarding
+// exceptions and whether the blocklist is enabled.
+func (l *Blocklist) matchBlock(host string) (string, string) {
+	entries := l.entries.Load()
+	if entries == nil {
+		return "", ""
+	}
+	return entries.matchBlock(host)
+}
+
+// matchException returns the exception entry that matches the (normalized) host, regardless of
+// whether the blocklist is enabled, or the empty string if none matches.
+func (l *Blocklist) matchException(host string) string {
+	entries := l.entries.Load()
+	if entries == nil {
+		return ""
+	}
+	return entries.matchException(host)
+}
+
+// BlocklistRegistry loads and keeps the named blocklists. Each specification is loaded once, such
+// that listeners using the same specification share blocklists. Names are unique among all
+// blocklists.
+type BlocklistRegistry struct {
+	// Format is the format of the blocklists that are loaded.
+	Format BlocklistFormat
+	// Sinks are the addresses that indicate a blocked host, nil for DefaultSinks.
+	Sinks []string
+	// CacheDir is the (optional) directory for keeping the last-known-good copy of blocklists
+	// fetched from URLs.
+	CacheDir string
+	// Client is the HTTP client for fetching blocklists from URLs. If nil, `http.DefaultClient` is
+	// used, which dials directly. See NewBlocklistClient.
+	Client *http.Client
+	lists  []*Blocklist
+	bySpec map[string][]*Blocklist
+}
+
+// Load loads the blocklists according to the specification, or returns the blocklists loaded
+// previously for the specification. The specification is formatted as
+// `<file|directory|URL>[,option=value]...` with options `name=<name>`, `sha256=<checksum>` and
+// `minisign=<public key>`. Options are not supported for directories. Blocklists with a URL are
+// named after the last path segment without extension, unless named explicitly.
+func (r *BlocklistRegistry) Load(spec string) ([]*Blocklist, error) {
+	if lists, ok := r.bySpec[spec]; ok {
+		return lists, nil
+	}
+	list, err := parseBlocklistSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	var lists []*Blocklist
+	if isRemoteSource(list.Source) || list.Name != "" || list.SHA256 != "" || list.MinisignKey != "" {
+		if list.Name == "" {
+			list.Name = blocklistName(list.Source)
+		}
+		list.Format, list.Sinks, list.CacheDir, list.Client = r.Format, r.Sinks, r.CacheDir, r.Client
+		if err := list.Reload(); err != nil {
+			return nil, err
+		}
+		lists = []*Blocklist{list}
+	} else if lists, err = LoadBlocklists(list.Source, r.Format, r.Sinks); err != nil {
+		return nil, err
+	}
+	for _, list := range lists {
+		if r.Lookup(list.Name) != nil {
+			return nil, errors.Context(ErrDuplicateBlocklist, "'"+list.Name+"' in "+list.Source)
+		}
+		r.lists = append(r.lists, list)
+	}
+	if r.bySpec == nil {
+		r.bySpec = make(map[string][]*Blocklist)
+	}
+	r.bySpec[spec] = lists
+	return lists, nil
+}
+
+// parseBlocklistSpec parses the specification of a blocklist into an unloaded Blocklist.
+func parseBlocklistSpec(spec string) (*Blocklist, error) {
+	parts := strings.Split(spec, ",")
+	list := Blocklist{Source: strings.TrimSpace(parts[0])}
+	if list.Source == "" {
+		return nil, errors.Context(ErrInvalidBlocklistSpec, "missing source")
+	}
+	for _, part := range parts[1:] {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found || value == "" {
+			return nil, errors.Context(ErrInvalidBlocklistSpec, "expected option=value, got '"+part+"'")
+		}
+		switch key {
+		case "name":
+			list.Name = value
+		case "sha256":
+			if checksum, err := hex.DecodeString(value); err != nil || len(checksum) != sha256.Size {
+				return nil, errors.Context(ErrInvalidBlocklistSpec, "invalid SHA-256 checksum '"+value+"'")
+			}
+			list.SHA256 = value
+		case "minisign":
+			if _, err := parseMinisignKey(value); err != nil {
+				return nil, err
+			}
+			list.MinisignKey = value
+		default:
+			return nil, errors.Context(ErrInvalidBlocklistSpec, "unknown option '"+key+"'")
+		}
+	}
+	return &list, nil
+}
+
+// Lookup looks up the blocklist by name. Returns nil if not found, or if the registry is nil.
+func (r *BlocklistRegistry) Lookup(name string) *Blocklist {
+	if r == nil {
+		return nil
+	}
+	for _, list := range r.lists {
+		if list.Name == name {
+			return list
+		}
+	}
+	return nil
+}
+
+// Lists returns all blocklists, in order of loading.
+func (r *BlocklistRegistry) Lists() []*Blocklist {
+	if r == nil {
+		return nil
+	}
+	return r.lists
+}
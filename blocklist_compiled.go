@@ -0,0 +1,447 @@
+package httprelay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unsafe"
+
+	"github.com/cobratbq/goutils/std/errors"
+	io_ "github.com/cobratbq/goutils/std/io"
+)
+
+// Compiled blocklists contain the entries of one or more blocklists in compact form, ready for use
+// without parsing. All values are little-endian and all sections are aligned to 8 bytes, such that
+// the file can be memory-mapped and used in place. The file is laid out as follows:
+//
+//	header (32 bytes):
+//	  magic "HRBL", version uint32, sources length uint32, sources CRC-32C uint32,
+//	  tables CRC-32C uint32, source count uint32, format uint32, reserved uint32
+//	sources section (padded):
+//	  per source: SHA-256 checksum [32]byte, size uint64, modification time int64 (Unix
+//	  nanoseconds), path length uint32, reserved uint32, path, padding
+//	  sinks length uint32, reserved uint32, sinks (comma-separated), padding
+//	tables section:
+//	  per table (list, domains, exceptions): count uint32, data length uint32,
+//	  Bloom filter words uint32, reserved uint32
+//	  per table: offsets [count+1]uint32, padding, data, padding, Bloom filter [words]uint64
+//
+// The header and sources section are the same for every version, such that the sources of a
+// compiled blocklist of a different version can be parsed instead, with the format and sinks used
+// for compiling.
+
+// compiledMagic identifies a compiled blocklist.
+const compiledMagic = "HRBL"
+
+// compiledVersion is the version of the format of the tables section.
+const compiledVersion = 1
+
+// compiledHeaderSize is the size of the header of a compiled blocklist.
+const compiledHeaderSize = 32
+
+// compiledTableHeaderSize is the size of the header of each table.
+const compiledTableHeaderSize = 16
+
+// ErrInvalidCompiledBlocklist indicates that a compiled blocklist is corrupt or of an unsupported
+// version.
+var ErrInvalidCompiledBlocklist = errors.NewStringError("invalid compiled blocklist")
+
+// ErrStaleCompiledBlocklist indicates that the sources of a compiled blocklist changed since
+// compiling.
+var ErrStaleCompiledBlocklist = errors.NewStringError("compiled blocklist is stale")
+
+// crc32c is the table for CRC-32C (Castagnoli) checksums.
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// nativeLittleEndian indicates whether the host is little-endian, such that tables can be used in
+// place.
+var nativeLittleEndian = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// compiledSourceHeaderSize is the size of the fixed-size part of each source.
+const compiledSourceHeaderSize = sha256.Size + 24
+
+// compiledSource is a source of a compiled blocklist. Size and modification time allow detecting an
+// unchanged source without computing its checksum.
+type compiledSource struct {
+	checksum [sha256.Size]byte
+	size     int64
+	modTime  int64
+	path     string
+}
+
+// CompileBlocklists compiles the blocklist files, formatted according to the format, into a single
+// compiled blocklist. Sinks are the addresses that indicate blocked hosts, nil for DefaultSinks.
+// The format and sinks are recorded, such that the sources are parsed the same if needed. Returns
+// the report of loading the sources.
+func CompileBlocklists(output string, sources []string, format BlocklistFormat, sinks []string) (BlocklistReport, error) {
+	if sinks == nil {
+		sinks = DefaultSinks
+	}
+	report := BlocklistReport{Format: format, Unsupported: make(map[string]int)}
+	var builder blocklistEntriesBuilder
+	var compiledSources []compiledSource
+	for _, source := range sources {
+		path, err := filepath.Abs(source)
+		if err != nil {
+			return report, errors.Context(err, "failed to determine path of "+source)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return report, errors.Context(err, "failed to inspect file "+source)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return report, errors.Context(err, "failed to read file "+source)
+		}
+		if isCompiledBlocklist(data) {
+			return report, errors.Context(ErrInvalidBlocklistSpec, "cannot compile compiled blocklist "+source)
+		}
+		loaded, err := loadBlocklist(&builder, bytes.NewReader(data), format, sinks)
+		if err != nil {
+			return report, errors.Context(err, "failed to load blocklist "+source)
+		}
+		logBlocklistReport(source, &loaded)
+		report.Blocked += loaded.Blocked
+		report.Exceptions += loaded.Exceptions
+		for reason, count := range loaded.Unsupported {
+			report.Unsupported[reason] += count
+		}
+		compiledSources = append(compiledSources, compiledSource{checksum: sha256.Sum256(data),
+			size: info.Size(), modTime: info.ModTime().UnixNano(), path: path})
+	}
+	compiled := encodeCompiledBlocklist(compiledSources, format, sinks, builder.build())
+	if err := writeFileAtomic(output, compiled); err != nil {
+		return report, errors.Context(err, "failed to write compiled blocklist "+output)
+	}
+	return report, nil
+}
+
+// isCompiledBlocklist checks whether the content starts like a compiled blocklist.
+func isCompiledBlocklist(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(compiledMagic))
+}
+
+// isCompiledBlocklistFile checks whether the file is a compiled blocklist.
+func isCompiledBlocklistFile(filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer io_.CloseLogged(file, "failed to close blocklist file")
+	magic := make([]byte, len(compiledMagic))
+	_, err = io.ReadFull(file, magic)
+	return err == nil && isCompiledBlocklist(magic)
+}
+
+// encodeCompiledBlocklist encodes the sources, the format and sinks used for parsing them, and the
+// entries as compiled blocklist.
+func encodeCompiledBlocklist(sources []compiledSource, format BlocklistFormat, sinks []string, entries *blocklistEntries) []byte {
+	var sourcesSection []byte
+	for _, source := range sources {
+		sourcesSection = append(sourcesSection, source.checksum[:]...)
+		sourcesSection = binary.LittleEndian.AppendUint64(sourcesSection, uint64(source.size))
+		sourcesSection = binary.LittleEndian.AppendUint64(sourcesSection, uint64(source.modTime))
+		sourcesSection = binary.LittleEndian.AppendUint32(sourcesSection, uint32(len(source.path)))
+		sourcesSection = binary.LittleEndian.AppendUint32(sourcesSection, 0)
+		sourcesSection = appendPadded(sourcesSection, []byte(source.path))
+	}
+	joinedSinks := strings.Join(sinks, ",")
+	sourcesSection = binary.LittleEndian.AppendUint32(sourcesSection, uint32(len(joinedSinks)))
+	sourcesSection = binary.LittleEndian.AppendUint32(sourcesSection, 0)
+	sourcesSection = appendPadded(sourcesSection, []byte(joinedSinks))
+	tables := []*domainTable{&entries.list, &entries.domains, &entries.exceptions}
+	var tablesSection []byte
+	for _, table := range tables {
+		tablesSection = binary.LittleEndian.AppendUint32(tablesSection, uint32(table.Len()))
+		tablesSection = binary.LittleEndian.AppendUint32(tablesSection, uint32(len(table.data)))
+		tablesSection = binary.LittleEndian.AppendUint32(tablesSection, uint32(len(table.bloom)))
+		tablesSection = binary.LittleEndian.AppendUint32(tablesSection, 0)
+	}
+	for _, table := range tables {
+		offsets := table.offsets
+		if len(offsets) == 0 {
+			offsets = []uint32{0}
+		}
+		var encoded []byte
+		for _, offset := range offsets {
+			encoded = binary.LittleEndian.AppendUint32(encoded, offset)
+		}
+		tablesSection = appendPadded(tablesSection, encoded)
+		tablesSection = appendPadded(tablesSection, table.data)
+		for _, word := range table.bloom {
+			tablesSection = binary.LittleEndian.AppendUint64(tablesSection, word)
+		}
+	}
+	compiled := make([]byte, 0, compiledHeaderSize+len(sourcesSection)+len(tablesSection))
+	compiled = append(compiled, compiledMagic...)
+	compiled = binary.LittleEndian.AppendUint32(compiled, compiledVersion)
+	compiled = binary.LittleEndian.AppendUint32(compiled, uint32(len(sourcesSection)))
+	compiled = binary.LittleEndian.AppendUint32(compiled, crc32.Checksum(sourcesSection, crc32c))
+	compiled = binary.LittleEndian.AppendUint32(compiled, crc32.Checksum(tablesSection, crc32c))
+	compiled = binary.LittleEndian.AppendUint32(compiled, uint32(len(sources)))
+	compiled = binary.LittleEndian.AppendUint32(compiled, uint32(format))
+	compiled = append(compiled, make([]byte, compiledHeaderSize-len(compiled))...)
+	compiled = append(compiled, sourcesSection...)
+	return append(compiled, tablesSection...)
+}
+
+// appendPadded appends the data, padded with zeroes to a multiple of 8 bytes.
+func appendPadded(dst, data []byte) []byte {
+	dst = append(dst, data...)
+	return append(dst, make([]byte, padding(len(data)))...)
+}
+
+// padding returns the number of bytes needed to pad the length to a multiple of 8 bytes.
+func padding(length int) int {
+	return (8 - length%8) % 8
+}
+
+// compiledBlocklist is a memory-mapped compiled blocklist.
+type compiledBlocklist struct {
+	mapping []byte
+	version uint32
+	sources []compiledSource
+	// format and sinks are the format and sinks used for parsing the sources.
+	format BlocklistFormat
+	sinks  []string
+	tables []byte
+}
+
+// openCompiledBlocklist maps the compiled blocklist into memory and parses its header and sources.
+// The mapping must be released with unmapFile, unless the tables are in use.
+func openCompiledBlocklist(filename string) (*compiledBlocklist, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Context(err, "failed to open file "+filename)
+	}
+	defer io_.CloseLogged(file, "failed to close compiled blocklist file")
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Context(err, "failed to inspect file "+filename)
+	}
+	if info.Size() < compiledHeaderSize {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "file too small")
+	}
+	if int64(int(info.Size())) != info.Size() {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "file too large")
+	}
+	mapping, err := mapFile(file, int(info.Size()))
+	if err != nil {
+		return nil, errors.Context(err, "failed to map file "+filename)
+	}
+	compiled, err := parseCompiledHeader(mapping)
+	if err != nil {
+		unmapFile(mapping)
+		return nil, err
+	}
+	return compiled, nil
+}
+
+// parseCompiledHeader parses the header and sources section of a compiled blocklist.
+func parseCompiledHeader(mapping []byte) (*compiledBlocklist, error) {
+	if !isCompiledBlocklist(mapping) {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "unknown file format")
+	}
+	compiled := compiledBlocklist{mapping: mapping, version: binary.LittleEndian.Uint32(mapping[4:]),
+		format: BlocklistFormat(binary.LittleEndian.Uint32(mapping[24:]))}
+	sourcesLength := uint64(binary.LittleEndian.Uint32(mapping[8:]))
+	if sourcesLength > uint64(len(mapping)-compiledHeaderSize) {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "truncated sources")
+	}
+	sources := mapping[compiledHeaderSize : compiledHeaderSize+sourcesLength]
+	if crc32.Checksum(sources, crc32c) != binary.LittleEndian.Uint32(mapping[12:]) {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "sources checksum mismatch")
+	}
+	for count := binary.LittleEndian.Uint32(mapping[20:]); count > 0; count-- {
+		if len(sources) < compiledSourceHeaderSize {
+			return nil, errors.Context(ErrInvalidCompiledBlocklist, "truncated sources")
+		}
+		var source compiledSource
+		copy(source.checksum[:], sources)
+		source.size = int64(binary.LittleEndian.Uint64(sources[sha256.Size:]))
+		source.modTime = int64(binary.LittleEndian.Uint64(sources[sha256.Size+8:]))
+		var path []byte
+		var err error
+		if path, sources, err = readPadded(sources, sha256.Size+16); err != nil {
+			return nil, err
+		}
+		source.path = string(path)
+		compiled.sources = append(compiled.sources, source)
+	}
+	sinks, _, err := readPadded(sources, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(sinks) > 0 {
+		compiled.sinks = strings.Split(string(sinks), ",")
+	}
+	compiled.tables = mapping[compiledHeaderSize+sourcesLength:]
+	return &compiled, nil
+}
+
+// readPadded reads the length-prefixed, padded value that starts with its length at the offset.
+// Returns the value and the remainder.
+func readPadded(data []byte, offset int) ([]byte, []byte, error) {
+	if len(data) < offset+8 {
+		return nil, nil, errors.Context(ErrInvalidCompiledBlocklist, "truncated sources")
+	}
+	length := uint64(binary.LittleEndian.Uint32(data[offset:]))
+	data = data[offset+8:]
+	padded := length + uint64(padding(int(length%8)))
+	if padded > uint64(len(data)) {
+		return nil, nil, errors.Context(ErrInvalidCompiledBlocklist, "truncated sources")
+	}
+	return data[:length], data[padded:], nil
+}
+
+// stale checks whether any of the sources changed since compiling. Sources with the recorded size
+// and modification time are assumed unchanged; checksums are only computed otherwise. Sources that
+// are not available are assumed unchanged.
+func (c *compiledBlocklist) stale() (bool, string) {
+	for _, source := range c.sources {
+		info, err := os.Stat(source.path)
+		if err != nil {
+			continue
+		}
+		if info.Size() == source.size && info.ModTime().UnixNano() == source.modTime {
+			continue
+		}
+		data, err := os.ReadFile(source.path)
+		if err != nil {
+			continue
+		}
+		if sha256.Sum256(data) != source.checksum {
+			return true, source.path
+		}
+	}
+	return false, ""
+}
+
+// entries returns the entries of the compiled blocklist, using the mapped tables in place if
+// possible. The mapping is released when the entries are no longer in use.
+func (c *compiledBlocklist) entries() (*blocklistEntries, error) {
+	if c.version != compiledVersion {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "unsupported version")
+	}
+	if crc32.Checksum(c.tables, crc32c) != binary.LittleEndian.Uint32(c.mapping[16:]) {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "tables checksum mismatch")
+	}
+	if len(c.tables) < 3*compiledTableHeaderSize {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "truncated tables")
+	}
+	var entries blocklistEntries
+	remainder := c.tables[3*compiledTableHeaderSize:]
+	for i, table := range []*domainTable{&entries.list, &entries.domains, &entries.exceptions} {
+		header := c.tables[i*compiledTableHeaderSize:]
+		var err error
+		if remainder, err = decodeTable(table, remainder, binary.LittleEndian.Uint32(header),
+			binary.LittleEndian.Uint32(header[4:]), binary.LittleEndian.Uint32(header[8:])); err != nil {
+			return nil, err
+		}
+	}
+	mapping := c.mapping
+	runtime.SetFinalizer(&entries, func(*blocklistEntries) { unmapFile(mapping) })
+	return &entries, nil
+}
+
+// decodeTable decodes a table from the tables section. Returns the remainder of the section.
+func decodeTable(table *domainTable, section []byte, count, dataLength, bloomWords uint32) ([]byte, error) {
+	offsetsLength := (uint64(count) + 1) * 4
+	dataOffset := offsetsLength + uint64(padding(int(offsetsLength%8)))
+	bloomOffset := dataOffset + uint64(dataLength) + uint64(padding(int(dataLength%8)))
+	end := bloomOffset + uint64(bloomWords)*8
+	if end > uint64(len(section)) {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "truncated table")
+	}
+	table.offsets = uint32s(section[:offsetsLength])
+	table.data = section[dataOffset : dataOffset+uint64(dataLength)]
+	if bloomWords > 0 {
+		table.bloom = uint64s(section[bloomOffset:end])
+	}
+	// Verify the offsets, such that lookups cannot exceed the data.
+	previous := uint32(0)
+	for _, offset := range table.offsets {
+		if offset < previous || offset > dataLength {
+			return nil, errors.Context(ErrInvalidCompiledBlocklist, "invalid offsets")
+		}
+		previous = offset
+	}
+	if table.offsets[0] != 0 || previous != dataLength {
+		return nil, errors.Context(ErrInvalidCompiledBlocklist, "invalid offsets")
+	}
+	if count == 0 {
+		table.offsets = nil
+	}
+	return section[end:], nil
+}
+
+// uint32s returns the little-endian encoded values, in place if the host is little-endian and the
+// data is aligned.
+func uint32s(data []byte) []uint32 {
+	if nativeLittleEndian && uintptr(unsafe.Pointer(unsafe.SliceData(data)))%4 == 0 {
+		return unsafe.Slice((*uint32)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/4)
+	}
+	values := make([]uint32, len(data)/4)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return values
+}
+
+// uint64s returns the little-endian encoded values, in place if the host is little-endian and the
+// data is aligned.
+func uint64s(data []byte) []uint64 {
+	if nativeLittleEndian && uintptr(unsafe.Pointer(unsafe.SliceData(data)))%8 == 0 {
+		return unsafe.Slice((*uint64)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/8)
+	}
+	values := make([]uint64, len(data)/8)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	return values
+}
+
+// loadCompiled loads a compiled blocklist. If the compiled blocklist is stale, invalid or of a
+// different version, the sources are parsed instead, with the format and sinks used for compiling.
+func (l *Blocklist) loadCompiled() error {
+	if l.SHA256 != "" || l.MinisignKey != "" {
+		return errors.Context(ErrInvalidBlocklistSpec, "checksums and signatures are not supported for compiled blocklist "+l.Source)
+	}
+	compiled, err := openCompiledBlocklist(l.Source)
+	if err != nil {
+		return errors.Context(err, "failed to load compiled blocklist '"+l.Name+"'")
+	}
+	if stale, source := compiled.stale(); stale {
+		err = errors.Context(ErrStaleCompiledBlocklist, "source changed: "+source)
+	} else if entries, entriesErr := compiled.entries(); entriesErr != nil {
+		err = entriesErr
+	} else {
+		l.entries.Store(entries)
+		log.Printf("Loaded compiled blocklist '%s': %d blocking rules, %d exception rules", l.Name,
+			entries.list.Len()+entries.domains.Len(), entries.exceptions.Len())
+		return nil
+	}
+	unmapFile(compiled.mapping)
+	log.Printf("Parsing sources of compiled blocklist '%s' instead: %v", l.Name, err)
+	var builder blocklistEntriesBuilder
+	for _, source := range compiled.sources {
+		data, err := os.ReadFile(source.path)
+		if err != nil {
+			return errors.Context(err, "failed to read source of compiled blocklist '"+l.Name+"'")
+		}
+		report, err := loadBlocklist(&builder, bytes.NewReader(data), compiled.format, compiled.sinks)
+		if err != nil {
+			return errors.Context(err, "failed to load source of compiled blocklist '"+l.Name+"'")
+		}
+		logBlocklistReport(source.path, &report)
+	}
+	l.entries.Store(builder.build())
+	return nil
+}
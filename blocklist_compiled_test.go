@@ -0,0 +1,182 @@
+package httprelay
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+// testCompileBlocklists compiles a hosts-formatted and an Adblock-formatted blocklist. Returns the
+// directory containing the sources and the filename of the compiled blocklist.
+func testCompileBlocklists(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "hosts.txt"), []byte("0.0.0.0 tracker.example\n0.0.0.0 1.2.3.4\n"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "adblock.txt"), []byte("||ads.example^\n@@||good.ads.example^\n"), 0o600))
+	output := filepath.Join(dir, "compiled.bin")
+	report, err := CompileBlocklists(output, []string{filepath.Join(dir, "hosts.txt"), filepath.Join(dir, "adblock.txt")}, BlocklistAuto, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Blocked, 3)
+	assert.Equal(t, report.Exceptions, 1)
+	return dir, output
+}
+
+func TestCompiledBlocklist(t *testing.T) {
+	_, output := testCompileBlocklists(t)
+	lists, err := LoadBlocklists(output, BlocklistAuto, nil)
+	assert.Nil(t, err)
+	list := lists[0]
+	assert.Equal(t, list.Name, "compiled")
+	assert.Equal(t, list.Len(), 3)
+	assert.Equal(t, testBlocks(list, "tracker.example"), true)
+	assert.Equal(t, testBlocks(list, "www.tracker.example"), false)
+	assert.Equal(t, testBlocks(list, "1.2.3.4"), true)
+	assert.Equal(t, testBlocks(list, "www.ads.example"), true)
+	assert.Equal(t, testBlocks(list, "good.ads.example"), false)
+	assert.Equal(t, testBlocks(list, "example"), false)
+}
+
+func TestCompiledBlocklistStale(t *testing.T) {
+	dir, output := testCompileBlocklists(t)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "hosts.txt"), []byte("0.0.0.0 other.example\n"), 0o600))
+	compiled, err := openCompiledBlocklist(output)
+	assert.Nil(t, err)
+	stale, source := compiled.stale()
+	assert.Equal(t, stale, true)
+	assert.Equal(t, source, filepath.Join(dir, "hosts.txt"))
+	unmapFile(compiled.mapping)
+	list := Blocklist{Name: "compiled", Source: output}
+	assert.Nil(t, list.Reload())
+	assert.Equal(t, testBlocks(&list, "other.example"), true)
+	assert.Equal(t, testBlocks(&list, "tracker.example"), false)
+	assert.Equal(t, testBlocks(&list, "ads.example"), true)
+}
+
+func TestCompiledBlocklistTouchedSource(t *testing.T) {
+	dir, output := testCompileBlocklists(t)
+	later := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "hosts.txt"), later, later))
+	compiled, err := openCompiledBlocklist(output)
+	assert.Nil(t, err)
+	defer unmapFile(compiled.mapping)
+	stale, _ := compiled.stale()
+	assert.Equal(t, stale, false)
+}
+
+func TestCompiledBlocklistFallbackFormat(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "hosts.txt")
+	assert.Nil(t, os.WriteFile(source, []byte("10.0.0.1 tracker.example\n0.0.0.0 ads.example\n"), 0o600))
+	output := filepath.Join(dir, "compiled.bin")
+	_, err := CompileBlocklists(output, []string{source}, BlocklistHosts, []string{"10.0.0.1"})
+	assert.Nil(t, err)
+	original, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	original[len(original)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(output, original, 0o600))
+	// The sources are parsed with the format and sinks used for compiling, not those of the list.
+	list := Blocklist{Name: "compiled", Source: output, Format: BlocklistDomains}
+	assert.Nil(t, list.Reload())
+	assert.Equal(t, testBlocks(&list, "tracker.example"), true)
+	assert.Equal(t, testBlocks(&list, "ads.example"), false)
+}
+
+func TestCompiledBlocklistMissingSources(t *testing.T) {
+	dir, output := testCompileBlocklists(t)
+	assert.Nil(t, os.Remove(filepath.Join(dir, "hosts.txt")))
+	list := Blocklist{Name: "compiled", Source: output}
+	assert.Nil(t, list.Reload())
+	assert.Equal(t, testBlocks(&list, "tracker.example"), true)
+}
+
+func TestCompiledBlocklistFallback(t *testing.T) {
+	_, output := testCompileBlocklists(t)
+	original, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	corrupt := append([]byte{}, original...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	newer := append([]byte{}, original...)
+	binary.LittleEndian.PutUint32(newer[4:], compiledVersion+1)
+	for _, content := range [][]byte{corrupt, newer} {
+		assert.Nil(t, os.WriteFile(output, content, 0o600))
+		compiled, err := openCompiledBlocklist(output)
+		assert.Nil(t, err)
+		_, err = compiled.entries()
+		assert.Equal(t, errors.Is(err, ErrInvalidCompiledBlocklist), true)
+		unmapFile(compiled.mapping)
+		list := Blocklist{Name: "compiled", Source: output}
+		assert.Nil(t, list.Reload())
+		assert.Equal(t, testBlocks(&list, "tracker.example"), true)
+		assert.Equal(t, testBlocks(&list, "good.ads.example"), false)
+	}
+	// Without intact sources section, the compiled blocklist cannot be used at all.
+	corrupt = append([]byte{}, original...)
+	corrupt[compiledHeaderSize] ^= 0xff
+	assert.Nil(t, os.WriteFile(output, corrupt, 0o600))
+	list := Blocklist{Name: "compiled", Source: output}
+	assert.Equal(t, errors.Is(list.Reload(), ErrInvalidCompiledBlocklist), true)
+}
+
+func TestCompileBlocklistsInvalid(t *testing.T) {
+	dir, output := testCompileBlocklists(t)
+	_, err := CompileBlocklists(filepath.Join(dir, "again.bin"), []string{output}, BlocklistAuto, nil)
+	assert.NotNil(t, err)
+	_, err = CompileBlocklists(filepath.Join(dir, "missing.bin"), []string{filepath.Join(dir, "missing.txt")}, BlocklistAuto, nil)
+	assert.NotNil(t, err)
+	list := Blocklist{Name: "compiled", Source: output, SHA256: strings.Repeat("0", 64)}
+	assert.Equal(t, errors.Is(list.Reload(), ErrInvalidBlocklistSpec), true)
+}
+
+func TestDecodeUnaligned(t *testing.T) {
+	data := []byte{0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 0, 0, 0, 0}
+	values := uint32s(data[1:9])
+	assert.Equal(t, len(values), 2)
+	assert.Equal(t, values[0], uint32(1))
+	assert.Equal(t, values[1], uint32(2))
+	words := uint64s(data[9:17])
+	assert.Equal(t, words[0], uint64(3))
+}
+
+// benchmarkHostsFile writes a hosts-formatted blocklist with benchmarkEntries entries.
+func benchmarkHostsFile(b *testing.B) string {
+	var content strings.Builder
+	for i := 0; i < benchmarkEntries; i++ {
+		content.WriteString("0.0.0.0 ads" + strconv.Itoa(i) + ".tracker" + strconv.Itoa(i%5000) + ".example.com\n")
+	}
+	filename := filepath.Join(b.TempDir(), "hosts.txt")
+	if err := os.WriteFile(filename, []byte(content.String()), 0o600); err != nil {
+		b.Fatal(err)
+	}
+	return filename
+}
+
+func BenchmarkLoadTextBlocklist(b *testing.B) {
+	list := Blocklist{Name: "hosts", Source: benchmarkHostsFile(b), Format: BlocklistHosts}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := list.Reload(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadCompiledBlocklist(b *testing.B) {
+	source := benchmarkHostsFile(b)
+	output := filepath.Join(filepath.Dir(source), "hosts.bin")
+	if _, err := CompileBlocklists(output, []string{source}, BlocklistHosts, nil); err != nil {
+		b.Fatal(err)
+	}
+	list := Blocklist{Name: "hosts", Source: output}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := list.Reload(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
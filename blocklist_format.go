@@ -0,0 +1,295 @@
+package httprelay
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	bufio_ "github.com/cobratbq/goutils/std/bufio"
+	"github.com/cobratbq/goutils/std/builtin/set"
+	"github.com/cobratbq/goutils/std/errors"
+)
+
+// BlocklistFormat is the format of a blocklist file.
+type BlocklistFormat uint
+
+const (
+	// BlocklistAuto detects the format from the content.
+	BlocklistAuto BlocklistFormat = iota
+	// BlocklistHosts is the format of the operating system's 'hosts' file.
+	BlocklistHosts
+	// BlocklistAdblock is the Adblock Plus filter list syntax, of which the host-level subset is
+	// supported.
+	BlocklistAdblock
+	// BlocklistDomains is a plain list of host names, one per line.
+	BlocklistDomains
+	// BlocklistDnsmasq is the dnsmasq configuration syntax, of which the `address`, `local` and
+	// `server` directives that block domains are supported.
+	BlocklistDnsmasq
+)
+
+// blocklistFormatNames are the names of the blocklist formats.
+var blocklistFormatNames = []string{"auto", "hosts", "adblock", "domains", "dnsmasq"}
+
+// String returns the name of the format.
+func (f BlocklistFormat) String() string {
+	if int(f) < len(blocklistFormatNames) {
+		return blocklistFormatNames[f]
+	}
+	return "unknown"
+}
+
+// ErrUnknownBlocklistFormat indicates that the blocklist format is not known.
+var ErrUnknownBlocklistFormat = errors.NewStringError("unknown blocklist format")
+
+// ParseBlocklistFormat parses the name of a blocklist format: 'auto', 'hosts', 'adblock', 'domains'
+// or 'dnsmasq'.
+func ParseBlocklistFormat(name string) (BlocklistFormat, error) {
+	for i, formatName := range blocklistFormatNames {
+		if name == formatName {
+			return BlocklistFormat(i), nil
+		}
+	}
+	return BlocklistAuto, errors.Context(ErrUnknownBlocklistFormat, "'"+name+"'")
+}
+
+// DefaultSinks are the addresses that indicate a blocked host in hosts-formatted and dnsmasq
+// blocklists, by default.
+var DefaultSinks = []string{"0.0.0.0", "127.0.0.1", "::", "::1"}
+
+// localHostNames are the names of the local host and related entries, which hosts-formatted
+// blocklists commonly include for completeness. These are never blocked.
+var localHostNames = set.Create("localhost", "localhost.localdomain", "local", "broadcasthost",
+	"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix", "ip6-allnodes",
+	"ip6-allrouters", "ip6-allhosts", "0.0.0.0")
+
+// BlocklistReport reports the results of loading a blocklist.
+type BlocklistReport struct {
+	// Format is the format of the blocklist, as detected if loaded with BlocklistAuto.
+	Format BlocklistFormat
+	// Blocked is the number of blocking entries loaded.
+	Blocked int
+	// Exceptions is the number of exception rules loaded.
+	Exceptions int
+	// Unsupported counts the entries that were not loaded, by reason.
+	Unsupported map[string]int
+}
+
+// UnsupportedTotal returns the total number of unsupported entries.
+func (r *BlocklistReport) UnsupportedTotal() int {
+	var total int
+	for _, count := range r.Unsupported {
+		total += count
+	}
+	return total
+}
+
+// String returns a human-readable summary of the report.
+func (r *BlocklistReport) String() string {
+	summary := strconv.Itoa(r.Blocked) + " blocking rules, " + strconv.Itoa(r.Exceptions) +
+		" exception rules, " + strconv.Itoa(r.UnsupportedTotal()) + " unsupported rules"
+	if len(r.Unsupported) == 0 {
+		return summary
+	}
+	reasons := make([]string, 0, len(r.Unsupported))
+	for reason := range r.Unsupported {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for i, reason := range reasons {
+		reasons[i] = strconv.Itoa(r.Unsupported[reason]) + " " + reason
+	}
+	return summary + " (" + strings.Join(reasons, ", ") + ")"
+}
+
+// detectionSize is the amount of content inspected to detect the format of a blocklist.
+const detectionSize = 64 << 10
+
+// blocklistTarget receives the entries of a blocklist while parsing.
+type blocklistTarget interface {
+	// addHost adds a (normalized) host that is blocked exactly.
+	addHost(host string)
+	// addDomain adds a (normalized) domain that is blocked including its subdomains.
+	addDomain(domain string)
+	// addException adds a (normalized) domain that is exempted from blocking including its
+	// subdomains.
+	addException(domain string)
+}
+
+// LoadFormat loads a blocklist in the specified format from provided reader. BlocklistAuto detects
+// the format from the first lines of content. Returns a report of the entries loaded.
+func (b *BlocklistDialer) LoadFormat(in io.Reader, format BlocklistFormat) (BlocklistReport, error) {
+	return loadBlocklist(b, in, format, b.Sinks)
+}
+
+// loadBlocklist loads a blocklist in the specified format from provided reader into the target.
+// Sinks are the addresses that indicate blocked hosts, nil for DefaultSinks.
+func loadBlocklist(target blocklistTarget, in io.Reader, format BlocklistFormat, sinks []string) (BlocklistReport, error) {
+	reader := bufio.NewReaderSize(in, detectionSize)
+	if format == BlocklistAuto {
+		format = detectBlocklistFormat(reader)
+	}
+	report := BlocklistReport{Format: format, Unsupported: make(map[string]int)}
+	if sinks == nil {
+		sinks = DefaultSinks
+	}
+	sinkSet := make(map[string]struct{}, len(sinks))
+	for _, sink := range sinks {
+		set.Insert(sinkSet, normalizeHost(sink))
+	}
+	if err := bufio_.ReadStringLinesFunc(reader, '\n', func(line string) error {
+		line = strings.TrimSpace(line)
+		if format != BlocklistAdblock {
+			line = stripComment(line)
+		}
+		if line == "" {
+			return nil
+		}
+		switch format {
+		case BlocklistAdblock:
+			loadAdblockLine(target, &report, line)
+		case BlocklistDomains:
+			loadDomainsLine(target, &report, line)
+		case BlocklistDnsmasq:
+			loadDnsmasqLine(target, &report, line, sinkSet)
+		default:
+			loadHostsLine(target, &report, line, sinkSet)
+		}
+		return nil
+	}); err != nil {
+		return report, errors.Context(err, "failed to read "+format.String()+" content")
+	}
+	return report, nil
+}
+
+// detectBlocklistFormat detects the format from the first lines of buffered content, without
+// consuming content. The first line that is characteristic for a format decides. Defaults to
+// BlocklistHosts.
+func detectBlocklistFormat(reader *bufio.Reader) BlocklistFormat {
+	data, _ := reader.Peek(detectionSize)
+	lines := strings.Split(string(data), "\n")
+	if len(data) == detectionSize {
+		// The last line may be incomplete.
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[Adblock") || strings.HasPrefix(line, "!") ||
+			strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@"):
+			return BlocklistAdblock
+		case strings.HasPrefix(line, "address=/") || strings.HasPrefix(line, "local=/") ||
+			strings.HasPrefix(line, "server=/"):
+			return BlocklistDnsmasq
+		}
+		fields := strings.Fields(stripComment(line))
+		if len(fields) >= 2 && net.ParseIP(trimBrackets(fields[0])) != nil {
+			return BlocklistHosts
+		}
+		if len(fields) == 1 {
+			return BlocklistDomains
+		}
+	}
+	return BlocklistHosts
+}
+
+// stripComment removes a comment starting with '#' at the start of the line or following
+// whitespace, and trailing whitespace.
+func stripComment(line string) string {
+	for i := 0; i < len(line); i++ {
+		if line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+// loadHostsLine loads a single line formatted like the operating system 'hosts' files. Host names
+// are blocked if the address is a sink.
+func loadHostsLine(target blocklistTarget, report *BlocklistReport, line string, sinks map[string]struct{}) {
+	parts := strings.Fields(line)
+	if _, ok := sinks[normalizeHost(parts[0])]; !ok {
+		report.Unsupported["non-sink address"]++
+		return
+	}
+	for _, host := range parts[1:] {
+		host = normalizeHost(host)
+		if _, ok := localHostNames[host]; ok {
+			report.Unsupported["local host name"]++
+			continue
+		}
+		target.addHost(host)
+		report.Blocked++
+	}
+}
+
+// loadDomainsLine loads a single host name.
+func loadDomainsLine(target blocklistTarget, report *BlocklistReport, line string) {
+	host := normalizeHost(line)
+	if strings.ContainsAny(host, " \t/*") || strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		report.Unsupported["invalid host name"]++
+		return
+	}
+	if _, ok := localHostNames[host]; ok {
+		report.Unsupported["local host name"]++
+		return
+	}
+	target.addHost(host)
+	report.Blocked++
+}
+
+// loadDnsmasqLine loads a single dnsmasq directive. Directives `address=/domain/.../<address>` with
+// a sink, `#` or empty address, as well as `local=/domain/.../` and `server=/domain/.../`, block the
+// domains including their subdomains.
+func loadDnsmasqLine(target blocklistTarget, report *BlocklistReport, line string, sinks map[string]struct{}) {
+	directive, value, _ := strings.Cut(line, "=")
+	if directive != "address" && directive != "local" && directive != "server" {
+		report.Unsupported["directive '"+directive+"'"]++
+		return
+	}
+	parts := strings.Split(value, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		report.Unsupported["invalid directive"]++
+		return
+	}
+	address := parts[len(parts)-1]
+	_, sink := sinks[normalizeHost(address)]
+	if address != "" && (directive != "address" || address != "#" && !sink) {
+		report.Unsupported["non-blocking directive"]++
+		return
+	}
+	for _, domain := range parts[1 : len(parts)-1] {
+		if domain == "" {
+			report.Unsupported["invalid directive"]++
+			continue
+		}
+		target.addDomain(normalizeHost(domain))
+		report.Blocked++
+	}
+}
+
+func (b *BlocklistDialer) addHost(host string) {
+	if b.List == nil {
+		b.List = make(map[string]struct{})
+	}
+	set.Insert(b.List, host)
+}
+
+func (b *BlocklistDialer) addDomain(domain string) {
+	if b.Domains == nil {
+		b.Domains = make(map[string]struct{})
+	}
+	set.Insert(b.Domains, domain)
+}
+
+func (b *BlocklistDialer) addException(domain string) {
+	if b.Exceptions == nil {
+		b.Exceptions = make(map[string]struct{})
+	}
+	set.Insert(b.Exceptions, domain)
+}
@@ -0,0 +1,120 @@
+package httprelay
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestBlocklistDialerLoadHostsSinks(t *testing.T) {
+	hostsFile := `# common preamble
+127.0.0.1 localhost localhost.localdomain
+::1 localhost ip6-localhost ip6-loopback
+255.255.255.255 broadcasthost
+0.0.0.0 0.0.0.0
+127.0.0.1 ads.example # inline comment
+:: tracker.example
+0:0::1 metrics.example	#tab-separated comment
+0.0.0.0 hash#in-name.example
+192.0.2.1 intranet.example
+`
+	b := BlocklistDialer{List: make(map[string]struct{})}
+	report, err := b.LoadFormat(strings.NewReader(hostsFile), BlocklistHosts)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Blocked, 4)
+	assert.Equal(t, report.Unsupported["local host name"], 6)
+	assert.Equal(t, report.Unsupported["non-sink address"], 2)
+	assert.Equal(t, len(b.List), 4)
+	for _, host := range []string{"ads.example", "tracker.example", "metrics.example", "hash#in-name.example"} {
+		assert.KeyPresent(t, b.List, host)
+	}
+	assert.KeyAbsent(t, b.List, "localhost")
+	assert.KeyAbsent(t, b.List, "intranet.example")
+	// Only the configured sinks block hosts.
+	b = BlocklistDialer{List: make(map[string]struct{}), Sinks: []string{"0.0.0.0"}}
+	report, err = b.LoadFormat(strings.NewReader(hostsFile), BlocklistHosts)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Blocked, 1)
+	assert.KeyPresent(t, b.List, "hash#in-name.example")
+}
+
+func TestBlocklistDialerLoadDomains(t *testing.T) {
+	b := BlocklistDialer{List: make(map[string]struct{})}
+	report, err := b.LoadFormat(strings.NewReader("# domains\nAds.example\ntracker.example # trailing\nlocalhost\n*.wildcard.example\n2001:db8::1\nhttp://url.example/\n"), BlocklistDomains)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Blocked, 3)
+	assert.Equal(t, report.Unsupported["local host name"], 1)
+	assert.Equal(t, report.Unsupported["invalid host name"], 2)
+	assert.KeyPresent(t, b.List, "ads.example")
+	assert.KeyPresent(t, b.List, "tracker.example")
+	assert.KeyPresent(t, b.List, "2001:db8::1")
+}
+
+func TestBlocklistDialerLoadDnsmasq(t *testing.T) {
+	dnsmasq := `# dnsmasq blocklist
+address=/ads.example/0.0.0.0
+address=/tracker.example/metrics.example/::
+address=/nxdomain.example/
+address=/null.example/#
+local=/local.example/
+server=/server.example/
+server=/corp.example/192.0.2.53
+address=/redirect.example/192.0.2.1
+cache-size=1000
+address=ads.example
+`
+	b := BlocklistDialer{List: make(map[string]struct{}), Dialer: &TestNopDialer{}}
+	report, err := b.LoadFormat(strings.NewReader(dnsmasq), BlocklistDnsmasq)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Blocked, 7)
+	assert.Equal(t, report.Unsupported["non-blocking directive"], 2)
+	assert.Equal(t, report.Unsupported["directive 'cache-size'"], 1)
+	assert.Equal(t, report.Unsupported["invalid directive"], 1)
+	for _, addr := range []string{"ads.example:80", "www.ads.example:443", "metrics.example:443", "null.example:80", "sub.local.example:80", "server.example:80"} {
+		if _, err := b.Dial("tcp", addr); err != ErrBlockedHost {
+			t.Errorf("Expected address '%s' to be blocked.", addr)
+		}
+	}
+	for _, addr := range []string{"corp.example:80", "redirect.example:80", "example:80"} {
+		if _, err := b.Dial("tcp", addr); err != nil {
+			t.Errorf("Expected address '%s' to be allowed.", addr)
+		}
+	}
+}
+
+func TestDetectBlocklistFormat(t *testing.T) {
+	var tests = []struct {
+		content string
+		format  BlocklistFormat
+	}{
+		{"# hosts\n\n0.0.0.0 ads.example\n", BlocklistHosts},
+		{"::1 localhost\n", BlocklistHosts},
+		{"[Adblock Plus 2.0]\n||ads.example^\n", BlocklistAdblock},
+		{"! comment\n", BlocklistAdblock},
+		{"# header\n||ads.example^\n", BlocklistAdblock},
+		{"# dnsmasq\naddress=/ads.example/0.0.0.0\n", BlocklistDnsmasq},
+		{"ads.example\ntracker.example\n", BlocklistDomains},
+		{"ads.example # comment\n", BlocklistDomains},
+		{"", BlocklistHosts},
+	}
+	for _, test := range tests {
+		assert.Equal(t, detectBlocklistFormat(bufio.NewReader(strings.NewReader(test.content))), test.format)
+	}
+	b := BlocklistDialer{List: make(map[string]struct{})}
+	report, err := b.LoadFormat(strings.NewReader("ads.example\n"), BlocklistAuto)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Format, BlocklistDomains)
+	assert.KeyPresent(t, b.List, "ads.example")
+}
+
+func TestParseBlocklistFormat(t *testing.T) {
+	for _, name := range []string{"auto", "hosts", "adblock", "domains", "dnsmasq"} {
+		format, err := ParseBlocklistFormat(name)
+		assert.Nil(t, err)
+		assert.Equal(t, format.String(), name)
+	}
+	_, err := ParseBlocklistFormat("unknown")
+	assert.NotNil(t, err)
+}
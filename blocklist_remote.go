@@ -0,0 +1,283 @@
+package httprelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cobratbq/goutils/std/errors"
+	io_ "github.com/cobratbq/goutils/std/io"
+	"golang.org/x/net/proxy"
+)
+
+// blocklistFetchTimeout is the timeout for fetching a blocklist and its signature.
+const blocklistFetchTimeout = 5 * time.Minute
+
+// maxBlocklistSize is the maximum size of a blocklist fetched from a URL.
+const maxBlocklistSize = 256 << 20
+
+// maxSignatureSize is the maximum size of a signature fetched from a URL.
+const maxSignatureSize = 64 << 10
+
+// ErrBlocklistUnavailable indicates that a blocklist could not be fetched from its URL.
+var ErrBlocklistUnavailable = errors.NewStringError("blocklist unavailable")
+
+// NewBlocklistClient creates an HTTP client for fetching blocklists that dials through the dialer,
+// such as the SOCKS5 proxy of the relay. Host names are passed to the dialer unresolved, and
+// environment proxy settings are ignored.
+func NewBlocklistClient(dialer proxy.Dialer) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, dialer, network, addr)
+		},
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 30 * time.Second,
+	}}
+}
+
+// isRemoteSource checks whether the source of a blocklist is an HTTP(S) URL.
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// remoteBlocklistName derives the name of a blocklist from its URL: the last path segment without
+// extension, or the host name if the path is empty.
+func remoteBlocklistName(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return source
+	}
+	base := path.Base(u.Path)
+	if base == "/" || base == "." {
+		return u.Hostname()
+	}
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// blocklistCopy is a copy of a blocklist fetched from a URL, including its validators.
+type blocklistCopy struct {
+	data         []byte
+	signature    []byte
+	etag         string
+	lastModified string
+}
+
+// reloadRemote fetches the blocklist from its URL using a conditional request. On the initial load,
+// the last-known-good copy in the cache directory provides the validators, and is used if the URL
+// is unavailable. Successfully loaded content is stored as last-known-good copy.
+func (l *Blocklist) reloadRemote() error {
+	etag, lastModified := l.etag, l.lastModified
+	var cached *blocklistCopy
+	if l.entries.Load() == nil {
+		if cached = l.readCache(); cached != nil {
+			etag, lastModified = cached.etag, cached.lastModified
+		}
+	}
+	fetched, err := l.fetch(etag, lastModified)
+	switch {
+	case err != nil:
+	case fetched == nil && cached != nil:
+		// Not modified: the cached copy is up-to-date.
+		fetched = cached
+	case fetched == nil && l.entries.Load() != nil:
+		// Not modified: the current entries are up-to-date.
+		return nil
+	case fetched == nil:
+		err = errors.Context(ErrBlocklistUnavailable, l.Source+": not modified, but no copy available")
+	}
+	if err == nil {
+		if err = l.load(fetched.data, fetched.signature); err == nil {
+			l.etag, l.lastModified = fetched.etag, fetched.lastModified
+			if fetched != cached {
+				l.writeCache(fetched)
+			}
+			return nil
+		}
+	}
+	if cached == nil || fetched == cached {
+		return err
+	}
+	log.Printf("Failed to update blocklist '%s', using cached copy: %v", l.Name, err)
+	if err := l.load(cached.data, cached.signature); err != nil {
+		return err
+	}
+	l.etag, l.lastModified = cached.etag, cached.lastModified
+	return nil
+}
+
+// fetch fetches the blocklist and, if a minisign key is configured, its signature. Returns nil
+// without error if the blocklist is not modified according to the validators.
+func (l *Blocklist) fetch(etag, lastModified string) (*blocklistCopy, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), blocklistFetchTimeout)
+	defer cancel()
+	header := make(http.Header)
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		header.Set("If-Modified-Since", lastModified)
+	}
+	resp, data, err := l.get(ctx, l.Source, header, maxBlocklistSize)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	fetched := blocklistCopy{data: data, etag: resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified")}
+	if l.MinisignKey != "" {
+		signatureURL, err := url.Parse(l.Source)
+		if err != nil {
+			return nil, errors.Context(err, "invalid blocklist URL")
+		}
+		signatureURL.Path += minisignSuffix
+		signatureURL.RawPath = ""
+		if _, fetched.signature, err = l.get(ctx, signatureURL.String(), nil, maxSignatureSize); err != nil {
+			return nil, err
+		}
+	}
+	return &fetched, nil
+}
+
+// get performs a GET request and reads the response body, if the response is successful. Status
+// 304 (Not Modified) is considered successful and has no body.
+func (l *Blocklist) get(ctx context.Context, uri string, header http.Header, limit int64) (*http.Response, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, nil, errors.Context(err, "failed to create request for "+uri)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	client := l.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, errors.Context(err, "failed to fetch "+uri)
+	}
+	defer io_.CloseLogged(resp.Body, "failed to close blocklist response body")
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return resp, nil, nil
+	default:
+		return nil, nil, errors.Context(ErrBlocklistUnavailable, uri+": "+resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, nil, errors.Context(err, "failed to read "+uri)
+	}
+	if int64(len(data)) > limit {
+		return nil, nil, errors.Context(ErrBlocklistUnavailable, uri+": content exceeds size limit")
+	}
+	return resp, data, nil
+}
+
+// cacheBase returns the base filename for the cached copy, which is unique per URL.
+func (l *Blocklist) cacheBase() string {
+	checksum := sha256.Sum256([]byte(l.Source))
+	return filepath.Join(l.CacheDir, l.Name+"-"+hex.EncodeToString(checksum[:8]))
+}
+
+// readCache reads the last-known-good copy from the cache directory. Returns nil if no cache
+// directory is configured or no complete copy is available.
+func (l *Blocklist) readCache() *blocklistCopy {
+	if l.CacheDir == "" {
+		return nil
+	}
+	base := l.cacheBase()
+	data, err := os.ReadFile(base)
+	if err != nil {
+		return nil
+	}
+	cached := blocklistCopy{data: data}
+	if l.MinisignKey != "" {
+		if cached.signature, err = os.ReadFile(base + minisignSuffix); err != nil {
+			return nil
+		}
+	}
+	if meta, err := os.ReadFile(base + ".meta"); err == nil {
+		for _, line := range strings.Split(string(meta), "\n") {
+			name, value, _ := strings.Cut(line, ": ")
+			switch name {
+			case "ETag":
+				cached.etag = value
+			case "Last-Modified":
+				cached.lastModified = value
+			}
+		}
+	}
+	return &cached
+}
+
+// writeCache stores the copy as last-known-good copy in the cache directory. Failures are logged,
+// as the cache is merely a fallback.
+func (l *Blocklist) writeCache(fetched *blocklistCopy) {
+	if l.CacheDir == "" {
+		return
+	}
+	base := l.cacheBase()
+	var meta bytes.Buffer
+	if fetched.etag != "" {
+		meta.WriteString("ETag: " + fetched.etag + "\n")
+	}
+	if fetched.lastModified != "" {
+		meta.WriteString("Last-Modified: " + fetched.lastModified + "\n")
+	}
+	err := writeFileAtomic(base, fetched.data)
+	if err == nil && fetched.signature != nil {
+		err = writeFileAtomic(base+minisignSuffix, fetched.signature)
+	}
+	if err == nil {
+		err = writeFileAtomic(base+".meta", meta.Bytes())
+	}
+	if err != nil {
+		log.Printf("Failed to cache blocklist '%s': %v", l.Name, err)
+	}
+}
+
+// writeFileAtomic writes the data to a temporary file, then renames it to the filename.
+func writeFileAtomic(filename string, data []byte) error {
+	temp := filename + ".tmp"
+	if err := os.WriteFile(temp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(temp, filename)
+}
+
+// Refresh reloads the blocklists fetched from URLs. Failures are logged and leave the current
+// entries of the blocklist in use.
+func (r *BlocklistRegistry) Refresh() {
+	for _, list := range r.Lists() {
+		if !isRemoteSource(list.Source) {
+			continue
+		}
+		if err := list.Reload(); err != nil {
+			log.Printf("Failed to refresh blocklist '%s': %v", list.Name, err)
+		}
+	}
+}
+
+// RefreshEvery refreshes the blocklists fetched from URLs at the interval. RefreshEvery does not
+// return.
+func (r *BlocklistRegistry) RefreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.Refresh()
+	}
+}
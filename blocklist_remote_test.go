@@ -0,0 +1,171 @@
+package httprelay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+// testBlocklistServer serves the content of a blocklist with an ETag, and its signature. It counts
+// the full responses and the responses 304 (Not Modified).
+type testBlocklistServer struct {
+	*httptest.Server
+	content     atomic.Pointer[string]
+	signature   atomic.Pointer[[]byte]
+	unavailable atomic.Bool
+	full        atomic.Int32
+	notModified atomic.Int32
+}
+
+func newTestBlocklistServer(content string) *testBlocklistServer {
+	server := new(testBlocklistServer)
+	server.content.Store(&content)
+	server.Server = httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if server.unavailable.Load() {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if strings.HasSuffix(req.URL.Path, minisignSuffix) {
+			resp.Write(*server.signature.Load())
+			return
+		}
+		content := *server.content.Load()
+		checksum := sha256.Sum256([]byte(content))
+		etag := `"` + hex.EncodeToString(checksum[:8]) + `"`
+		resp.Header().Set("ETag", etag)
+		if req.Header.Get("If-None-Match") == etag {
+			server.notModified.Add(1)
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		server.full.Add(1)
+		resp.Write([]byte(content))
+	}))
+	return server
+}
+
+func TestBlocklistRemote(t *testing.T) {
+	server := newTestBlocklistServer("0.0.0.0 ads.example\n")
+	defer server.Close()
+	registry := BlocklistRegistry{Format: BlocklistAuto}
+	lists, err := registry.Load(server.URL + "/lists/ads.txt")
+	assert.Nil(t, err)
+	list := lists[0]
+	assert.Equal(t, list.Name, "ads")
+	assert.Equal(t, testBlocks(list, "ads.example"), true)
+	assert.Equal(t, server.full.Load(), int32(1))
+	registry.Refresh()
+	assert.Equal(t, server.notModified.Load(), int32(1))
+	assert.Equal(t, server.full.Load(), int32(1))
+	updated := "0.0.0.0 tracker.example\n"
+	server.content.Store(&updated)
+	registry.Refresh()
+	assert.Equal(t, server.full.Load(), int32(2))
+	assert.Equal(t, testBlocks(list, "ads.example"), false)
+	assert.Equal(t, testBlocks(list, "tracker.example"), true)
+}
+
+func TestBlocklistRemoteClient(t *testing.T) {
+	server := newTestBlocklistServer("0.0.0.0 ads.example\n")
+	defer server.Close()
+	// The host name of the URL does not resolve locally, so it must reach the dialer unresolved.
+	list := Blocklist{Name: "ads", Source: "http://blocklists.invalid/ads.txt",
+		Client: NewBlocklistClient(&TestRedirectDialer{addr: server.Listener.Addr().String()})}
+	assert.Nil(t, list.Reload())
+	assert.Equal(t, server.full.Load(), int32(1))
+	list.Client = NewBlocklistClient(&NopDialer{})
+	assert.Equal(t, errors.Is(list.Reload(), ErrBlockedHost), true)
+}
+
+func TestBlocklistRemoteFailedRefreshKeepsEntries(t *testing.T) {
+	server := newTestBlocklistServer("0.0.0.0 ads.example\n")
+	defer server.Close()
+	list := Blocklist{Name: "ads", Source: server.URL + "/ads.txt"}
+	assert.Nil(t, list.Reload())
+	server.unavailable.Store(true)
+	err := list.Reload()
+	assert.Equal(t, errors.Is(err, ErrBlocklistUnavailable), true)
+	assert.Equal(t, testBlocks(&list, "ads.example"), true)
+	server.unavailable.Store(false)
+	empty := ""
+	server.content.Store(&empty)
+	list.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	err = list.Reload()
+	assert.Equal(t, errors.Is(err, ErrBlocklistVerification), true)
+	assert.Equal(t, testBlocks(&list, "ads.example"), true)
+}
+
+func TestBlocklistRemoteCachedCopy(t *testing.T) {
+	cacheDir := t.TempDir()
+	server := newTestBlocklistServer("0.0.0.0 ads.example\n")
+	defer server.Close()
+	first := Blocklist{Name: "ads", Source: server.URL + "/ads.txt", CacheDir: cacheDir}
+	assert.Nil(t, first.Reload())
+	// Restarting uses the cached copy's validators.
+	second := Blocklist{Name: "ads", Source: server.URL + "/ads.txt", CacheDir: cacheDir}
+	assert.Nil(t, second.Reload())
+	assert.Equal(t, server.notModified.Load(), int32(1))
+	assert.Equal(t, testBlocks(&second, "ads.example"), true)
+	// Starting while the URL is unavailable uses the cached copy.
+	server.unavailable.Store(true)
+	offline := Blocklist{Name: "ads", Source: server.URL + "/ads.txt", CacheDir: cacheDir}
+	assert.Nil(t, offline.Reload())
+	assert.Equal(t, testBlocks(&offline, "ads.example"), true)
+	// Without a cached copy, starting while the URL is unavailable fails.
+	uncached := Blocklist{Name: "ads", Source: server.URL + "/ads.txt", CacheDir: t.TempDir()}
+	assert.NotNil(t, uncached.Reload())
+	assert.Equal(t, uncached.Len(), 0)
+}
+
+func TestBlocklistRemoteChecksum(t *testing.T) {
+	content := "0.0.0.0 ads.example\n"
+	server := newTestBlocklistServer(content)
+	defer server.Close()
+	checksum := sha256.Sum256([]byte(content))
+	registry := BlocklistRegistry{Format: BlocklistAuto}
+	_, err := registry.Load(server.URL + "/ads.txt,sha256=" + strings.ToUpper(hex.EncodeToString(checksum[:])))
+	assert.Nil(t, err)
+	_, err = registry.Load(server.URL + "/other.txt,name=other,sha256=" + hex.EncodeToString(make([]byte, sha256.Size)))
+	assert.Equal(t, errors.Is(err, ErrBlocklistVerification), true)
+	assert.Nil(t, registry.Lookup("other"))
+}
+
+func TestBlocklistRemoteMinisign(t *testing.T) {
+	content := "0.0.0.0 ads.example\n"
+	server := newTestBlocklistServer(content)
+	defer server.Close()
+	encodedKey, sign := testMinisign(t)
+	signature := sign([]byte(content), true)
+	server.signature.Store(&signature)
+	list := Blocklist{Name: "ads", Source: server.URL + "/ads.txt", MinisignKey: encodedKey}
+	assert.Nil(t, list.Reload())
+	assert.Equal(t, testBlocks(&list, "ads.example"), true)
+	updated := "0.0.0.0 tracker.example\n"
+	server.content.Store(&updated)
+	err := list.Reload()
+	assert.Equal(t, errors.Is(err, ErrBlocklistVerification), true)
+	assert.Equal(t, testBlocks(&list, "ads.example"), true)
+	assert.Equal(t, testBlocks(&list, "tracker.example"), false)
+}
+
+func TestParseBlocklistSpec(t *testing.T) {
+	encodedKey, _ := testMinisign(t)
+	list, err := parseBlocklistSpec("https://example.com/hosts,name=steven,minisign=" + encodedKey)
+	assert.Nil(t, err)
+	assert.Equal(t, list.Source, "https://example.com/hosts")
+	assert.Equal(t, list.Name, "steven")
+	assert.Equal(t, list.MinisignKey, encodedKey)
+	for _, spec := range []string{"", ",name=ads", "ads.txt,name", "ads.txt,sha256=abc", "ads.txt,minisign=abc", "ads.txt,unknown=1"} {
+		_, err := parseBlocklistSpec(spec)
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, blocklistName("https://example.com/lists/ads.txt?format=hosts"), "ads")
+	assert.Equal(t, blocklistName("https://example.com/"), "example.com")
+}
@@ -0,0 +1,214 @@
+package httprelay
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// BlocklistStats counts the hosts blocked by BlocklistDialers, per entry, per blocklist and per
+// client. Counting is lock-free, such that a single instance can be shared among all dialers. A nil
+// instance does not count anything.
+type BlocklistStats struct {
+	// entries counts the hits per entry, as *hitCounter by blocklist name. The unnamed blocklist of
+	// the BlocklistDialer itself has the empty name.
+	entries sync.Map
+	lists   hitCounter
+	clients hitCounter
+}
+
+// count counts a host blocked by the entry of the named blocklist, on behalf of the client carried
+// by the context.
+func (s *BlocklistStats) count(ctx context.Context, list, entry string) {
+	if s == nil {
+		return
+	}
+	counter, ok := s.entries.Load(list)
+	if !ok {
+		counter, _ = s.entries.LoadOrStore(list, new(hitCounter))
+	}
+	counter.(*hitCounter).add(entry)
+	s.lists.add(list)
+	s.clients.addLimited(clientName(ctx), maxClientStats, otherClients)
+}
+
+// maxClientStats is the maximum number of distinct clients that are counted individually. Hits of
+// further clients are counted as otherClients.
+const maxClientStats = 4096
+
+// otherClients is the key of the hits of clients beyond maxClientStats.
+const otherClients = "other"
+
+// Hits returns the number of hosts blocked by the entry of the named blocklist.
+func (s *BlocklistStats) Hits(list, entry string) uint64 {
+	if s == nil {
+		return 0
+	}
+	if counter, ok := s.entries.Load(list); ok {
+		return counter.(*hitCounter).get(entry)
+	}
+	return 0
+}
+
+// topEntries returns the n entries with the most hits across all blocklists, or all entries if n is
+// not positive.
+func (s *BlocklistStats) topEntries(n int) []entryHits {
+	if s == nil {
+		return nil
+	}
+	var entries []entryHits
+	s.entries.Range(func(list, counter any) bool {
+		for _, count := range counter.(*hitCounter).top(0) {
+			entries = append(entries, entryHits{list: list.(string), entry: count.key, hits: count.hits})
+		}
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].hits != entries[j].hits {
+			return entries[i].hits > entries[j].hits
+		}
+		if entries[i].list != entries[j].list {
+			return entries[i].list < entries[j].list
+		}
+		return entries[i].entry < entries[j].entry
+	})
+	if n > 0 && n < len(entries) {
+		entries = entries[:n]
+	}
+	return entries
+}
+
+// entryHits is the number of hits of an entry of a blocklist.
+type entryHits struct {
+	list  string
+	entry string
+	hits  uint64
+}
+
+// clientName identifies the client carried by the context for statistics: the IP address of the
+// client, or "-" if the client is unknown. The user name is not included, as it is not verified.
+func clientName(ctx context.Context) string {
+	client, ok := ClientFromContext(ctx)
+	if !ok || client.Addr == "" {
+		return "-"
+	}
+	if host, _, err := net.SplitHostPort(client.Addr); err == nil {
+		return host
+	}
+	return client.Addr
+}
+
+// hitCounter counts hits per key. Counters are created once per key and incremented atomically,
+// such that counting does not lock.
+type hitCounter struct {
+	counts sync.Map
+	// keys is the number of distinct keys.
+	keys atomic.Int64
+}
+
+// add counts a hit for the key.
+func (c *hitCounter) add(key string) {
+	c.counter(key).Add(1)
+}
+
+// addLimited counts a hit for the key, or for the other key if the limit of distinct keys is
+// reached. Concurrent additions may exceed the limit slightly.
+func (c *hitCounter) addLimited(key string, limit int64, other string) {
+	if _, ok := c.counts.Load(key); !ok && c.keys.Load() >= limit {
+		key = other
+	}
+	c.counter(key).Add(1)
+}
+
+// counter returns the counter for the key, created if absent.
+func (c *hitCounter) counter(key string) *atomic.Uint64 {
+	counter, ok := c.counts.Load(key)
+	if !ok {
+		var loaded bool
+		if counter, loaded = c.counts.LoadOrStore(key, new(atomic.Uint64)); !loaded {
+			c.keys.Add(1)
+		}
+	}
+	return counter.(*atomic.Uint64)
+}
+
+// get returns the number of hits for the key.
+func (c *hitCounter) get(key string) uint64 {
+	if counter, ok := c.counts.Load(key); ok {
+		return counter.(*atomic.Uint64).Load()
+	}
+	return 0
+}
+
+// top returns the n keys with the most hits in descending order of hits, or all keys if n is not
+// positive. Keys with equal hits are ordered by key.
+func (c *hitCounter) top(n int) []hitCount {
+	var counts []hitCount
+	c.counts.Range(func(key, counter any) bool {
+		counts = append(counts, hitCount{key: key.(string), hits: counter.(*atomic.Uint64).Load()})
+		return true
+	})
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].hits != counts[j].hits {
+			return counts[i].hits > counts[j].hits
+		}
+		return counts[i].key < counts[j].key
+	})
+	if n > 0 && n < len(counts) {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// hitCount is the number of hits for a key.
+type hitCount struct {
+	key  string
+	hits uint64
+}
+
+// blocklistMatch is the entry of a named blocklist that matches a host.
+type blocklistMatch struct {
+	list *Blocklist
+	// rule is the kind of rule: ruleHost, ruleDomain or ruleException.
+	rule  string
+	entry string
+}
+
+// blocks checks whether the match blocks the host.
+func (m *blocklistMatch) blocks() bool {
+	return m.list.Enabled() && (m.rule == ruleHost || m.rule == ruleDomain)
+}
+
+// reason explains why the entry matches the (normalized) host.
+func (m *blocklistMatch) reason(host string) string {
+	var reason string
+	switch {
+	case m.rule == ruleHost:
+		reason = "exact match of blocked host '" + m.entry + "'"
+	case m.rule == ruleDomain && m.entry == host:
+		reason = "blocked domain '" + m.entry + "'"
+	case m.rule == ruleDomain:
+		reason = "subdomain of blocked domain '" + m.entry + "'"
+	default:
+		reason = "exempted by exception for domain '" + m.entry + "'"
+	}
+	if !m.list.Enabled() {
+		reason += ", but blocklist is disabled"
+	}
+	return reason
+}
+
+// explainLists returns, for each of the named blocklists in order, the entry that matches the host,
+// if any. The host is normalized first and returned as well.
+func explainLists(host string, lists []*Blocklist) (string, []blocklistMatch) {
+	host = normalizeHost(hostname(host))
+	var matches []blocklistMatch
+	for _, list := range lists {
+		if rule, entry := list.match(host); rule != "" {
+			matches = append(matches, blocklistMatch{list: list, rule: rule, entry: entry})
+		}
+	}
+	return host, matches
+}
@@ -0,0 +1,189 @@
+package httprelay
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/cobratbq/goutils/std/builtin/set"
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestHitCounter(t *testing.T) {
+	var counter hitCounter
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				counter.add("common")
+				counter.add("key" + strconv.Itoa(i%2))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, counter.get("common"), uint64(800))
+	assert.Equal(t, counter.get("missing"), uint64(0))
+	top := counter.top(2)
+	assert.Equal(t, len(top), 2)
+	assert.Equal(t, top[0], hitCount{key: "common", hits: 800})
+	assert.Equal(t, top[1], hitCount{key: "key0", hits: 400})
+	assert.Equal(t, len(counter.top(0)), 3)
+}
+
+func TestHitCounterLimited(t *testing.T) {
+	var counter hitCounter
+	for i := 0; i < 5; i++ {
+		counter.addLimited("client"+strconv.Itoa(i), 3, "other")
+	}
+	counter.addLimited("client0", 3, "other")
+	assert.Equal(t, counter.get("client0"), uint64(2))
+	assert.Equal(t, counter.get("client3"), uint64(0))
+	assert.Equal(t, counter.get("other"), uint64(2))
+	// The clients within the limit, and the other clients.
+	assert.Equal(t, len(counter.top(0)), 4)
+}
+
+func TestClientName(t *testing.T) {
+	assert.Equal(t, clientName(context.Background()), "-")
+	assert.Equal(t, clientName(WithClient(context.Background(), ClientInfo{Addr: "192.0.2.1:5000"})), "192.0.2.1")
+	assert.Equal(t, clientName(WithClient(context.Background(), ClientInfo{Addr: "[::1]:5000", User: "alice"})), "::1")
+	assert.Equal(t, clientName(WithClient(context.Background(), ClientInfo{Addr: "pipe"})), "pipe")
+}
+
+func TestBlocklistDialerStats(t *testing.T) {
+	lists, err := LoadBlocklists(testBlocklistDir(t), BlocklistAuto, nil)
+	assert.Nil(t, err)
+	stats := new(BlocklistStats)
+	dialer := BlocklistDialer{List: set.Create("local.example"), Lists: lists, Stats: stats, Dialer: &TestNopDialer{}}
+	alice := WithClient(context.Background(), ClientInfo{Addr: "192.0.2.1:5000"})
+	bob := WithClient(context.Background(), ClientInfo{Addr: "192.0.2.2:5000"})
+	for _, addr := range []string{"www.ads.example:443", "ads.example:80", "tracker.example:443", "local.example:80"} {
+		_, err = dialer.DialContext(alice, "tcp", addr)
+		assert.NotNil(t, err)
+	}
+	_, err = dialer.DialContext(bob, "tcp", "banner.ads.example:443")
+	assert.NotNil(t, err)
+	_, err = dialer.DialContext(bob, "tcp", "example.com:443")
+	assert.Nil(t, err)
+	assert.Equal(t, stats.Hits("ads", "ads.example"), uint64(3))
+	assert.Equal(t, stats.Hits("trackers", "tracker.example"), uint64(1))
+	assert.Equal(t, stats.Hits("", "local.example"), uint64(1))
+	assert.Equal(t, stats.lists.get("ads"), uint64(3))
+	assert.Equal(t, stats.clients.get("192.0.2.1"), uint64(4))
+	assert.Equal(t, stats.clients.get("192.0.2.2"), uint64(1))
+	top := stats.topEntries(2)
+	assert.Equal(t, len(top), 2)
+	assert.Equal(t, top[0], entryHits{list: "ads", entry: "ads.example", hits: 3})
+	assert.Equal(t, top[1], entryHits{list: "", entry: "local.example", hits: 1})
+	var nilStats *BlocklistStats
+	nilStats.count(alice, "ads", "ads.example")
+	assert.Equal(t, nilStats.Hits("ads", "ads.example"), uint64(0))
+}
+
+func TestBlocklistMatch(t *testing.T) {
+	dialer := BlocklistDialer{List: set.Create("tracker.example"), Domains: set.Create("ads.example"), Exceptions: set.Create("good.ads.example")}
+	entries := compactEntries(&dialer)
+	for _, host := range []string{"ads.example", "www.ads.example", "www.good.ads.example", "tracker.example", "www.tracker.example", "example"} {
+		rule, entry := dialer.match(host)
+		compactRule, compactEntry := entries.match(host)
+		assert.Equal(t, compactRule, rule)
+		assert.Equal(t, compactEntry, entry)
+	}
+	rule, entry := entries.match("cdn.www.ads.example")
+	assert.Equal(t, rule, ruleDomain)
+	assert.Equal(t, entry, "ads.example")
+	rule, entry = entries.match("www.good.ads.example")
+	assert.Equal(t, rule, ruleException)
+	assert.Equal(t, entry, "good.ads.example")
+	rule, _ = entries.match("www.tracker.example")
+	assert.Equal(t, rule, "")
+}
+
+func TestAdminHandlerBlocked(t *testing.T) {
+	lists, err := LoadBlocklists(testBlocklistDir(t), BlocklistAuto, nil)
+	assert.Nil(t, err)
+	stats := new(BlocklistStats)
+	dialer := BlocklistDialer{Lists: lists, Stats: stats, Dialer: &TestNopDialer{}}
+	client := WithClient(context.Background(), ClientInfo{Addr: "192.0.2.1:5000", User: "alice"})
+	for _, addr := range []string{"ads.example:443", "www.ads.example:443", "tracker.example:443"} {
+		_, err = dialer.DialContext(client, "tcp", addr)
+		assert.NotNil(t, err)
+	}
+	admin := AdminHandler{Metrics: new(Metrics), Stats: stats}
+	recorder := testServe(&admin, http.MethodGet, "/blocked", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), `{"top":[{"list":"ads","entry":"ads.example","hits":2},{"list":"trackers","entry":"tracker.example","hits":1}],"blocklists":{"ads":2,"trackers":1},"clients":{"192.0.2.1":3}}`)
+	recorder = testServe(&admin, http.MethodGet, "/blocked?top=1", nil)
+	assert.Equal(t, recorder.Body.String(), `{"top":[{"list":"ads","entry":"ads.example","hits":2}],"blocklists":{"ads":2,"trackers":1},"clients":{"192.0.2.1":3}}`)
+	recorder = testServe(&admin, http.MethodGet, "/blocked?top=0", nil)
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+	recorder = testServe(&admin, http.MethodPost, "/blocked", nil)
+	assert.Equal(t, recorder.Code, http.StatusMethodNotAllowed)
+	recorder = testServe(&AdminHandler{Metrics: new(Metrics)}, http.MethodGet, "/blocked", nil)
+	assert.Equal(t, recorder.Code, http.StatusNotFound)
+}
+
+func TestAdminHandlerLookup(t *testing.T) {
+	dir := testBlocklistDir(t)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "allow.txt"), []byte("@@||good.ads.example^\n||tracker.example^\n"), 0o600))
+	registry := BlocklistRegistry{Format: BlocklistAuto}
+	_, err := registry.Load(dir)
+	assert.Nil(t, err)
+	admin := AdminHandler{Metrics: new(Metrics), Blocklists: &registry}
+	recorder := testServe(&admin, http.MethodGet, "/lookup?host=WWW.Ads.Example:443", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), `{"host":"www.ads.example","blocked":true,"list":"ads","matches":[{"list":"ads","enabled":true,"rule":"domain","entry":"ads.example","blocks":true,"reason":"subdomain of blocked domain 'ads.example'"}]}`)
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=good.ads.example", nil)
+	assert.Equal(t, recorder.Body.String(), `{"host":"good.ads.example","blocked":false,"list":null,"matches":[{"list":"ads","enabled":true,"rule":"domain","entry":"ads.example","blocks":true,"reason":"subdomain of blocked domain 'ads.example'"},{"list":"allow","enabled":true,"rule":"exception","entry":"good.ads.example","blocks":false,"reason":"exempted by exception for domain 'good.ads.example'"}]}`)
+	registry.Lookup("trackers").SetEnabled(false)
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=tracker.example", nil)
+	assert.Equal(t, recorder.Body.String(), `{"host":"tracker.example","blocked":true,"list":"allow","matches":[{"list":"allow","enabled":true,"rule":"domain","entry":"tracker.example","blocks":true,"reason":"blocked domain 'tracker.example'"},{"list":"trackers","enabled":false,"rule":"host","entry":"tracker.example","blocks":false,"reason":"exact match of blocked host 'tracker.example', but blocklist is disabled"}]}`)
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=example.com", nil)
+	assert.Equal(t, recorder.Body.String(), `{"host":"example.com","blocked":false,"list":null,"matches":[]}`)
+	recorder = testServe(&admin, http.MethodGet, "/lookup", nil)
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+	// Hosts are supplied by the client, so any host must produce valid JSON.
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=%01%FF%22%5Cx.example", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, json.Valid(recorder.Body.Bytes()), true)
+}
+
+func TestAdminHandlerLookupListener(t *testing.T) {
+	registry := BlocklistRegistry{Format: BlocklistAuto}
+	_, err := registry.Load(testBlocklistDir(t))
+	assert.Nil(t, err)
+	stats := new(BlocklistStats)
+	ads := []*Blocklist{registry.Lookup("ads")}
+	restricted := WrapPerHostBlocking(&BlocklistDialer{List: map[string]struct{}{"unnamed.example": {}},
+		Lists: ads, Stats: stats, Dialer: &NopDialer{}}, false, "blocked.example")
+	all := &BlocklistDialer{Lists: registry.Lists(), Stats: stats, Dialer: &NopDialer{}}
+	admin := AdminHandler{Metrics: new(Metrics), Blocklists: &registry, Listeners: []AdminListener{
+		{Address: ":8080", Dialer: restricted, Blocklists: ads},
+		{Address: ":8081", Dialer: all, Blocklists: registry.Lists()},
+	}}
+	recorder := testServe(&admin, http.MethodGet, "/lookup?host=tracker.example", nil)
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=tracker.example&listener=:9999", nil)
+	assert.Equal(t, recorder.Code, http.StatusNotFound)
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=tracker.example&listener=:8080", nil)
+	assert.Equal(t, recorder.Body.String(), `{"listener":":8080","host":"tracker.example","blocked":false,"list":null,"matches":[]}`)
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=tracker.example&listener=:8081", nil)
+	assert.Equal(t, recorder.Body.String(), `{"listener":":8081","host":"tracker.example","blocked":true,"list":"trackers","matches":[{"list":"trackers","enabled":true,"rule":"host","entry":"tracker.example","blocks":true,"reason":"exact match of blocked host 'tracker.example'"}]}`)
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=www.ads.example&listener=:8080", nil)
+	assert.Equal(t, recorder.Body.String(), `{"listener":":8080","host":"www.ads.example","blocked":true,"list":"ads","matches":[{"list":"ads","enabled":true,"rule":"domain","entry":"ads.example","blocks":true,"reason":"subdomain of blocked domain 'ads.example'"}]}`)
+	// Address rules and the unnamed blocklist block without a named blocklist.
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=blocked.example&listener=:8080", nil)
+	assert.Equal(t, recorder.Body.String(), `{"listener":":8080","host":"blocked.example","blocked":true,"list":null,"matches":[]}`)
+	recorder = testServe(&admin, http.MethodGet, "/lookup?host=unnamed.example&listener=:8080", nil)
+	assert.Equal(t, recorder.Body.String(), `{"listener":":8080","host":"unnamed.example","blocked":true,"list":null,"matches":[]}`)
+	// Lookups are not counted as blocked hosts.
+	assert.Equal(t, stats.Hits("ads", "ads.example"), uint64(0))
+	assert.Equal(t, stats.Hits("", "unnamed.example"), uint64(0))
+}
@@ -0,0 +1,140 @@
+package httprelay
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+// testBlocklistDir creates a directory with blocklists 'ads' and 'trackers', and a hidden file.
+func testBlocklistDir(t *testing.T) string {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ads.txt"), []byte("||ads.example^\n"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "trackers.hosts"), []byte("0.0.0.0 tracker.example\n"), 0o600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, ".hidden"), []byte("0.0.0.0 hidden.example\n"), 0o600))
+	return dir
+}
+
+// testBlocks checks whether the blocklist, if enabled, blocks the (normalized) host.
+func testBlocks(list *Blocklist, host string) bool {
+	rule, entry := list.match(host)
+	match := blocklistMatch{list: list, rule: rule, entry: entry}
+	return match.blocks()
+}
+
+func TestLoadBlocklistsDirectory(t *testing.T) {
+	lists, err := LoadBlocklists(testBlocklistDir(t), BlocklistAuto, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, len(lists), 2)
+	assert.Equal(t, lists[0].Name, "ads")
+	assert.Equal(t, lists[0].Len(), 1)
+	assert.Equal(t, lists[1].Name, "trackers")
+	assert.Equal(t, lists[1].Len(), 1)
+	assert.Equal(t, testBlocks(lists[0], "www.ads.example"), true)
+	assert.Equal(t, testBlocks(lists[1], "hidden.example"), false)
+}
+
+func TestLoadBlocklistsMissing(t *testing.T) {
+	_, err := LoadBlocklists(filepath.Join(t.TempDir(), "missing.txt"), BlocklistAuto, nil)
+	assert.NotNil(t, err)
+}
+
+func TestBlocklistReloadKeepsEntriesOnFailure(t *testing.T) {
+	dir := testBlocklistDir(t)
+	lists, err := LoadBlocklists(filepath.Join(dir, "ads.txt"), BlocklistAuto, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(filepath.Join(dir, "ads.txt")))
+	assert.NotNil(t, lists[0].Reload())
+	assert.Equal(t, testBlocks(lists[0], "ads.example"), true)
+}
+
+func TestBlocklistRegistry(t *testing.T) {
+	dir := testBlocklistDir(t)
+	registry := BlocklistRegistry{Format: BlocklistAuto}
+	lists, err := registry.Load(dir)
+	assert.Nil(t, err)
+	again, err := registry.Load(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, again[0], lists[0])
+	assert.Equal(t, len(registry.Lists()), 2)
+	assert.Equal(t, registry.Lookup("trackers"), lists[1])
+	assert.Nil(t, registry.Lookup("unknown"))
+	_, err = registry.Load(filepath.Join(dir, "ads.txt"))
+	assert.Equal(t, errors.Is(err, ErrDuplicateBlocklist), true)
+	var nilRegistry *BlocklistRegistry
+	assert.Nil(t, nilRegistry.Lookup("ads"))
+}
+
+func TestBlocklistDialerNamedLists(t *testing.T) {
+	lists, err := LoadBlocklists(testBlocklistDir(t), BlocklistAuto, nil)
+	assert.Nil(t, err)
+	dialer := BlocklistDialer{Lists: lists, Dialer: &TestNopDialer{}}
+	_, err = dialer.Dial("tcp", "tracker.example:443")
+	var blocked *BlockedError
+	assert.Equal(t, errors.As(err, &blocked), true)
+	assert.Equal(t, blocked.List, "trackers")
+	assert.Equal(t, blocked.Host, "tracker.example")
+	assert.Equal(t, errors.Is(err, ErrBlockedHost), true)
+	lists[1].SetEnabled(false)
+	assert.Equal(t, lists[1].Enabled(), false)
+	_, err = dialer.Dial("tcp", "tracker.example:443")
+	assert.Nil(t, err)
+	_, err = dialer.Dial("tcp", "ads.example:443")
+	assert.NotNil(t, err)
+}
+
+func TestBlocklistDialerExceptionAcrossLists(t *testing.T) {
+	dir := testBlocklistDir(t)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "allow.txt"), []byte("@@||good.ads.example^\n"), 0o600))
+	lists, err := LoadBlocklists(dir, BlocklistAuto, nil)
+	assert.Nil(t, err)
+	dialer := BlocklistDialer{Lists: lists, Dialer: &TestNopDialer{}}
+	// The exception of the allowlist exempts the host from the block of another list.
+	_, err = dialer.Dial("tcp", "www.good.ads.example:443")
+	assert.Nil(t, err)
+	_, err = dialer.Dial("tcp", "www.ads.example:443")
+	assert.NotNil(t, err)
+	// Exceptions of disabled blocklists do not apply.
+	lists[1].SetEnabled(false)
+	_, err = dialer.Dial("tcp", "www.good.ads.example:443")
+	assert.NotNil(t, err)
+}
+
+func TestProxyHandlerBlockedByNamedList(t *testing.T) {
+	lists, err := LoadBlocklists(testBlocklistDir(t), BlocklistAuto, nil)
+	assert.Nil(t, err)
+	metrics := new(Metrics)
+	handler := HTTPProxyHandler{Dialer: &BlocklistDialer{Lists: lists, Dialer: &TestNopDialer{}}, Metrics: metrics}
+	recorder := testServe(&handler, http.MethodGet, "http://ads.example/banner.png", nil)
+	assert.Equal(t, recorder.Code, http.StatusForbidden)
+	assert.Equal(t, recorder.Body.String(), "Host 'ads.example' is blocked by blocklist 'ads'.\n")
+	assert.Equal(t, metrics.Blocked.Load(), uint64(1))
+	assert.Equal(t, metrics.BlockedBy("ads"), uint64(1))
+	assert.Equal(t, metrics.BlockedBy("trackers"), uint64(0))
+	assert.Equal(t, metrics.String(), `{"requests":1,"tunnels":0,"blocked":1,"errors":0,"blocklists":{"ads":1}}`)
+}
+
+func TestAdminHandlerBlocklists(t *testing.T) {
+	registry := BlocklistRegistry{Format: BlocklistAuto}
+	_, err := registry.Load(testBlocklistDir(t))
+	assert.Nil(t, err)
+	admin := AdminHandler{Metrics: new(Metrics), Blocklists: &registry}
+	recorder := testServe(&admin, http.MethodGet, "/blocklists", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), `[{"name":"ads","enabled":true,"entries":1},{"name":"trackers","enabled":true,"entries":1}]`)
+	recorder = testServe(&admin, http.MethodGet, "/blocklists/ads?enabled=false", nil)
+	assert.Equal(t, recorder.Code, http.StatusMethodNotAllowed)
+	recorder = testServe(&admin, http.MethodPost, "/blocklists/ads?enabled=maybe", nil)
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+	recorder = testServe(&admin, http.MethodPost, "/blocklists/unknown?enabled=false", nil)
+	assert.Equal(t, recorder.Code, http.StatusNotFound)
+	recorder = testServe(&admin, http.MethodPost, "/blocklists/ads?enabled=false", nil)
+	assert.Equal(t, recorder.Code, http.StatusNoContent)
+	assert.Equal(t, registry.Lookup("ads").Enabled(), false)
+	recorder = testServe(&admin, http.MethodGet, "/blocklists", nil)
+	assert.Equal(t, recorder.Body.String(), `[{"name":"ads","enabled":false,"entries":1},{"name":"trackers","enabled":true,"entries":1}]`)
+}
@@ -0,0 +1,414 @@
+package httprelay
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cobratbq/goutils/std/errors"
+	"github.com/cobratbq/goutils/std/log"
+)
+
+// xCacheHeader is the header that reports how the cache served the response.
+const xCacheHeader = "X-Cache"
+
+// Values of the X-Cache header.
+const (
+	cacheHit         = "HIT"
+	cacheMiss        = "MISS"
+	cacheRevalidated = "REVALIDATED"
+)
+
+// defaultMaxCacheEntrySize is the default maximum size of a response body to be stored.
+const defaultMaxCacheEntrySize = 16 << 20
+
+// maxHeuristicFreshness limits the heuristic freshness lifetime derived from Last-Modified.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// heuristicallyCacheable are the status codes that are cacheable without explicit freshness
+// information (RFC 9110, section 15.1).
+var heuristicallyCacheable = map[int]struct{}{
+	http.StatusOK:                   {},
+	http.StatusNonAuthoritativeInfo: {},
+	http.StatusNoContent:            {},
+	http.StatusMultipleChoices:      {},
+	http.StatusMovedPermanently:     {},
+	http.StatusPermanentRedirect:    {},
+	http.StatusNotFound:             {},
+	http.StatusMethodNotAllowed:     {},
+	http.StatusGone:                 {},
+	http.StatusRequestURITooLong:    {},
+	http.StatusNotImplemented:       {},
+}
+
+// Cache is a shared HTTP cache (RFC 9111) for responses to GET requests. Responses are stored if
+// permitted by their Cache-Control directives and if either explicit or heuristic freshness or a
+// validator (ETag, Last-Modified) is available. Fresh responses are served from the cache, stale
+// responses are validated with the origin server using conditional requests. At most one variant
+// per URI is stored: a response for a request that does not match the stored Vary-nominated
+// request headers replaces the stored response.
+//
+// Responses that set cookies are not stored, as a precaution against sharing session state.
+type Cache struct {
+	Store CacheStore
+	// MaxEntrySize is the maximum size of a response body to be stored.
+	MaxEntrySize int64
+	now          func() time.Time
+}
+
+// NewCache creates a cache that stores responses in the store.
+func NewCache(store CacheStore) *Cache {
+	return &Cache{Store: store, MaxEntrySize: defaultMaxCacheEntrySize, now: time.Now}
+}
+
+// cachedResponse is a stored response, including the request and response times needed for age
+// calculation (RFC 9111, section 4.2.3).
+type cachedResponse struct {
+	Status     int
+	ProtoMajor int
+	ProtoMinor int
+	Header     http.Header
+	Body       []byte
+	// Vary holds the values of the request headers nominated by the Vary header.
+	Vary         http.Header
+	RequestTime  time.Time
+	ResponseTime time.Time
+}
+
+// cacheKey determines the key for the target URI.
+func cacheKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.RequestURI()
+}
+
+// Purge removes the stored response for the URI.
+func (c *Cache) Purge(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return errors.Context(err, "invalid URL")
+	}
+	return c.Store.Delete(cacheKey(u))
+}
+
+// PurgeAll removes all stored responses.
+func (c *Cache) PurgeAll() error {
+	return c.Store.Clear()
+}
+
+// lookup looks up the stored response for the request. Returns nil if absent or if the request does
+// not match the stored response's Vary-nominated request headers.
+func (c *Cache) lookup(req *http.Request) *cachedResponse {
+	if req.Method != http.MethodGet {
+		return nil
+	}
+	data, ok := c.Store.Get(cacheKey(req.URL))
+	if !ok {
+		return nil
+	}
+	var entry cachedResponse
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entry); err != nil {
+		log.Warnln("Failed to decode cached response:", err.Error())
+		return nil
+	}
+	for name, values := range entry.Vary {
+		if strings.Join(req.Header.Values(name), ",") != strings.Join(values, ",") {
+			return nil
+		}
+	}
+	return &entry
+}
+
+// servable checks whether the stored response may be served without validation, given the
+// request's Cache-Control directives (RFC 9111, section 4).
+func (c *Cache) servable(entry *cachedResponse, header http.Header) bool {
+	requestCC := parseCacheControl(header)
+	responseCC := parseCacheControl(entry.Header)
+	if _, ok := requestCC["no-cache"]; ok || (len(requestCC) == 0 && header.Get("Pragma") == "no-cache") {
+		return false
+	}
+	if _, ok := responseCC["no-cache"]; ok {
+		return false
+	}
+	age := c.age(entry)
+	lifetime := freshnessLifetime(entry)
+	if maxAge, ok := directiveSeconds(requestCC, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := directiveSeconds(requestCC, "min-fresh"); ok {
+		age += minFresh
+	}
+	if lifetime > age {
+		return true
+	}
+	// Serving stale responses is permitted only if the client accepts it, and the origin server
+	// does not prohibit it.
+	_, mustRevalidate := responseCC["must-revalidate"]
+	_, proxyRevalidate := responseCC["proxy-revalidate"]
+	_, sMaxAge := responseCC["s-maxage"]
+	maxStale, ok := requestCC["max-stale"]
+	if !ok || mustRevalidate || proxyRevalidate || sMaxAge {
+		return false
+	}
+	if maxStale == "" {
+		return true
+	}
+	stale, ok := directiveSeconds(requestCC, "max-stale")
+	return ok && age-lifetime <= stale
+}
+
+// age calculates the current age of the stored response (RFC 9111, section 4.2.3).
+func (c *Cache) age(entry *cachedResponse) time.Duration {
+	date := parseHTTPDate(entry.Header.Get("Date"), entry.ResponseTime)
+	apparentAge := max(0, entry.ResponseTime.Sub(date))
+	ageValue, _ := strconv.ParseInt(entry.Header.Get("Age"), 10, 64)
+	correctedAge := time.Duration(max(0, ageValue))*time.Second + entry.ResponseTime.Sub(entry.RequestTime)
+	return max(apparentAge, correctedAge) + c.now().Sub(entry.ResponseTime)
+}
+
+// freshnessLifetime determines the freshness lifetime of the stored response, from explicit
+// expiration or heuristically from Last-Modified (RFC 9111, section 4.2.1 and 4.2.2).
+func freshnessLifetime(entry *cachedResponse) time.Duration {
+	cc := parseCacheControl(entry.Header)
+	if sMaxAge, ok := directiveSeconds(cc, "s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := directiveSeconds(cc, "max-age"); ok {
+		return maxAge
+	}
+	date := parseHTTPDate(entry.Header.Get("Date"), entry.ResponseTime)
+	if expires := entry.Header.Get("Expires"); expires != "" {
+		// Invalid dates, e.g. "0", represent a time in the past.
+		return max(0, parseHTTPDate(expires, time.Time{}).Sub(date))
+	}
+	if _, ok := heuristicallyCacheable[entry.Status]; !ok {
+		return 0
+	}
+	if lastModified := parseHTTPDate(entry.Header.Get("Last-Modified"), time.Time{}); !lastModified.IsZero() {
+		return min(max(0, date.Sub(lastModified)/10), maxHeuristicFreshness)
+	}
+	return 0
+}
+
+// cacheable checks whether the response to the request may be stored (RFC 9111, section 3).
+// Intercepted indicates that the request was decrypted from an intercepted TLS tunnel.
+func (c *Cache) cacheable(req *http.Request, resp *http.Response, intercepted bool) bool {
+	if req.Method != http.MethodGet || resp.StatusCode == http.StatusPartialContent ||
+		resp.StatusCode < 200 || resp.StatusCode == http.StatusNotModified {
+		return false
+	}
+	requestCC := parseCacheControl(req.Header)
+	responseCC := parseCacheControl(resp.Header)
+	if _, ok := requestCC["no-store"]; ok {
+		return false
+	}
+	for _, directive := range []string{"no-store", "private"} {
+		if _, ok := responseCC[directive]; ok {
+			return false
+		}
+	}
+	if resp.Header.Get("Vary") == "*" || len(resp.Header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	_, public := responseCC["public"]
+	_, sMaxAge := responseCC["s-maxage"]
+	_, mustRevalidate := responseCC["must-revalidate"]
+	if req.Header.Get("Authorization") != "" && !public && !sMaxAge && !mustRevalidate {
+		return false
+	}
+	// The cache is shared, whereas responses to requests with cookies, and responses that were
+	// protected by TLS, are likely personalized.
+	if (intercepted || req.Header.Get("Cookie") != "") && !public && !sMaxAge {
+		return false
+	}
+	if resp.ContentLength > c.MaxEntrySize {
+		return false
+	}
+	entry := cachedResponse{Status: resp.StatusCode, Header: resp.Header, ResponseTime: c.now()}
+	return freshnessLifetime(&entry) > 0 || resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != ""
+}
+
+// store stores the response to the request with its (complete) body. The header must not contain
+// hop-by-hop headers.
+func (c *Cache) store(req *http.Request, resp *http.Response, header http.Header, body []byte, requestTime, responseTime time.Time) {
+	entry := cachedResponse{
+		Status:       resp.StatusCode,
+		ProtoMajor:   resp.ProtoMajor,
+		ProtoMinor:   resp.ProtoMinor,
+		Header:       header,
+		Body:         body,
+		Vary:         http.Header{},
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	for _, field := range header.Values("Vary") {
+		for _, name := range strings.Split(field, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				entry.Vary[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+			}
+		}
+	}
+	c.put(cacheKey(req.URL), &entry)
+}
+
+// put encodes and stores the entry.
+func (c *Cache) put(key string, entry *cachedResponse) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(entry); err != nil {
+		log.Warnln("Failed to encode response for cache:", err.Error())
+		return
+	}
+	if err := c.Store.Put(key, buffer.Bytes()); err != nil {
+		log.Warnln("Failed to store response in cache:", err.Error())
+	}
+}
+
+// revalidated updates the stored response with the header fields of the 304 (Not Modified)
+// response to a validation request (RFC 9111, section 4.3.4).
+func (c *Cache) revalidated(req *http.Request, entry *cachedResponse, resp *http.Response, requestTime, responseTime time.Time) *cachedResponse {
+	header := http.Header{}
+	copyHeaders(header, resp.Header)
+	for name, values := range header {
+		if name != "Content-Length" {
+			entry.Header[name] = values
+		}
+	}
+	entry.RequestTime = requestTime
+	entry.ResponseTime = responseTime
+	c.put(cacheKey(req.URL), entry)
+	return entry
+}
+
+// addValidators turns the request into a conditional request for validating the stored response.
+// The client's own preconditions are removed, as these are evaluated against the stored response
+// afterwards. Returns false if the stored response does not have validators.
+func addValidators(header http.Header, entry *cachedResponse) bool {
+	etag := entry.Header.Get("ETag")
+	lastModified := entry.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	header.Del("If-None-Match")
+	header.Del("If-Modified-Since")
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		header.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+// invalidate removes stored responses for the target URI and the URIs in the Location and
+// Content-Location headers (on the same host) after a successful unsafe request (RFC 9111,
+// section 4.4).
+func (c *Cache) invalidate(req *http.Request, resp *http.Response) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return
+	}
+	keys := []string{cacheKey(req.URL)}
+	for _, name := range []string{"Location", "Content-Location"} {
+		if location, err := req.URL.Parse(resp.Header.Get(name)); err == nil && resp.Header.Get(name) != "" &&
+			strings.EqualFold(location.Host, req.URL.Host) {
+			keys = append(keys, cacheKey(location))
+		}
+	}
+	for _, key := range keys {
+		if err := c.Store.Delete(key); err != nil {
+			log.Warnln("Failed to invalidate cached response:", err.Error())
+		}
+	}
+}
+
+// notModified evaluates the client's If-None-Match and If-Modified-Since preconditions against the
+// stored response (RFC 9110, section 13.1).
+func notModified(header http.Header, entry *cachedResponse) bool {
+	if ifNoneMatch := header.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(entry.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince := parseHTTPDate(header.Get("If-Modified-Since"), time.Time{})
+	lastModified := parseHTTPDate(entry.Header.Get("Last-Modified"), time.Time{})
+	return entry.Status == http.StatusOK && !ifModifiedSince.IsZero() && !lastModified.IsZero() &&
+		!lastModified.After(ifModifiedSince)
+}
+
+// onlyIfCached checks whether the client requests only a stored response.
+func onlyIfCached(header http.Header) bool {
+	_, ok := parseCacheControl(header)["only-if-cached"]
+	return ok
+}
+
+// parseCacheControl parses the Cache-Control directives into a map of lower-case directive names to
+// (unquoted) values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, field := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(field, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(value, "\"")
+		}
+	}
+	return directives
+}
+
+// directiveSeconds returns the value of a directive as duration in seconds.
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(min(seconds, int64(1<<31))) * time.Second, true
+}
+
+// parseHTTPDate parses an HTTP date, or returns the fallback if absent or invalid.
+func parseHTTPDate(value string, fallback time.Time) time.Time {
+	if value == "" {
+		return fallback
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return fallback
+	}
+	return date
+}
+
+// limitedBuffer buffers written data up to the limit. Writes beyond the limit are accepted but not
+// buffered, such that the buffer can be used with `io.MultiWriter` without disrupting the other
+// writers.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int64
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.exceeded || int64(b.Len()+len(p)) > b.limit {
+		b.exceeded = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
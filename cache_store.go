@@ -0,0 +1,274 @@
+package httprelay
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cobratbq/goutils/std/errors"
+)
+
+// CacheStore stores encoded responses by key. Implementations are safe for concurrent use and
+// bound the total size of stored values by evicting the least recently used values.
+type CacheStore interface {
+	// Get returns the value for the key, if present.
+	Get(key string) ([]byte, bool)
+	// Put stores the value for the key, replacing any previous value.
+	Put(key string, value []byte) error
+	// Delete removes the value for the key, if present.
+	Delete(key string) error
+	// Clear removes all values.
+	Clear() error
+}
+
+// lruIndex tracks the sizes and order of use of keys. It is not safe for concurrent use.
+type lruIndex struct {
+	maxSize int64
+	size    int64
+	order   *list.List
+	items   map[string]*list.Element
+}
+
+type lruItem struct {
+	key  string
+	size int64
+}
+
+func newLRUIndex(maxSize int64) *lruIndex {
+	return &lruIndex{maxSize: maxSize, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// touch marks the key as most recently used. Returns the item of the key, or nil if the key is not
+// present.
+func (l *lruIndex) touch(key string) *lruItem {
+	element, ok := l.items[key]
+	if !ok {
+		return nil
+	}
+	l.order.MoveToFront(element)
+	return element.Value.(*lruItem)
+}
+
+// add adds the key as most recently used, then evicts least recently used keys until the total
+// size is within bounds. Returns the evicted keys, which may include the added key itself if it
+// exceeds the bound on its own.
+func (l *lruIndex) add(key string, size int64) []string {
+	l.remove(key)
+	l.items[key] = l.order.PushFront(&lruItem{key: key, size: size})
+	l.size += size
+	var evicted []string
+	for l.size > l.maxSize {
+		item := l.order.Back().Value.(*lruItem)
+		l.remove(item.key)
+		evicted = append(evicted, item.key)
+	}
+	return evicted
+}
+
+// remove removes the key. Returns false if the key is not present.
+func (l *lruIndex) remove(key string) bool {
+	element, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.order.Remove(element)
+	delete(l.items, key)
+	l.size -= element.Value.(*lruItem).size
+	return true
+}
+
+// removeItem removes the key of the item, only if the key still refers to the item, i.e. the key
+// was not removed and added again since. Returns false otherwise.
+func (l *lruIndex) removeItem(item *lruItem) bool {
+	if element, ok := l.items[item.key]; !ok || element.Value != item {
+		return false
+	}
+	return l.remove(item.key)
+}
+
+// MemoryStore stores values in memory.
+type MemoryStore struct {
+	lock   sync.Mutex
+	index  *lruIndex
+	values map[string][]byte
+}
+
+// NewMemoryStore creates an in-memory store bounded to maxSize bytes.
+func NewMemoryStore(maxSize int64) *MemoryStore {
+	return &MemoryStore{index: newLRUIndex(maxSize), values: make(map[string][]byte)}
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.index.touch(key) == nil {
+		return nil, false
+	}
+	return s.values[key], true
+}
+
+func (s *MemoryStore) Put(key string, value []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values[key] = value
+	for _, evicted := range s.index.add(key, int64(len(value))) {
+		delete(s.values, evicted)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.index.remove(key)
+	delete(s.values, key)
+	return nil
+}
+
+func (s *MemoryStore) Clear() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.index = newLRUIndex(s.index.maxSize)
+	s.values = make(map[string][]byte)
+	return nil
+}
+
+// cacheFileSuffix is the file name suffix of values stored by DiskStore.
+const cacheFileSuffix = ".cache"
+
+// cacheTempInfix marks the temporary files of DiskStore, which are renamed once fully written.
+const cacheTempInfix = ".tmp"
+
+// DiskStore stores values as files in a directory. File names are derived from the keys by
+// hashing. Values stored previously are loaded into the index on creation, in order of their
+// modification time.
+//
+// Files are read and written outside of the lock, which only guards the index, such that slow disk
+// access does not stall other requests. Files are replaced atomically by renaming, therefore reads
+// never observe partially written values. Concurrent changes to the same key may leave the index
+// referring to a removed file, which is removed from the index once reading it fails.
+type DiskStore struct {
+	lock  sync.Mutex
+	dir   string
+	index *lruIndex
+}
+
+// NewDiskStore creates a store in the directory, bounded to maxSize bytes. The directory is
+// created if it does not exist. Temporary files left behind by an interrupted Put are removed.
+func NewDiskStore(dir string, maxSize int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Context(err, "failed to create cache directory")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Context(err, "failed to read cache directory")
+	}
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if strings.Contains(entry.Name(), cacheTempInfix) {
+			// Temporary files remain after a crash during Put and are not accounted for.
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), cacheFileSuffix) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() {
+			files = append(files, info)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	store := DiskStore{dir: dir, index: newLRUIndex(maxSize)}
+	for _, file := range files {
+		for _, evicted := range store.index.add(strings.TrimSuffix(file.Name(), cacheFileSuffix), file.Size()) {
+			os.Remove(store.path(evicted))
+		}
+	}
+	return &store, nil
+}
+
+// name derives the (index) name of the file for the key.
+func (s *DiskStore) name(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *DiskStore) path(name string) string {
+	return filepath.Join(s.dir, name+cacheFileSuffix)
+}
+
+func (s *DiskStore) Get(key string) ([]byte, bool) {
+	name := s.name(key)
+	s.lock.Lock()
+	item := s.index.touch(name)
+	s.lock.Unlock()
+	if item == nil {
+		return nil, false
+	}
+	value, err := os.ReadFile(s.path(name))
+	if err != nil {
+		s.lock.Lock()
+		s.index.removeItem(item)
+		s.lock.Unlock()
+		return nil, false
+	}
+	return value, true
+}
+
+func (s *DiskStore) Put(key string, value []byte) error {
+	name := s.name(key)
+	temp, err := os.CreateTemp(s.dir, name+cacheTempInfix+"*")
+	if err != nil {
+		return errors.Context(err, "failed to create cache file")
+	}
+	_, err = temp.Write(value)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), s.path(name))
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return errors.Context(err, "failed to write cache file")
+	}
+	s.lock.Lock()
+	evicted := s.index.add(name, int64(len(value)))
+	s.lock.Unlock()
+	for _, name := range evicted {
+		if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+			return errors.Context(err, "failed to remove evicted cache file")
+		}
+	}
+	return nil
+}
+
+func (s *DiskStore) Delete(key string) error {
+	name := s.name(key)
+	s.lock.Lock()
+	s.index.remove(name)
+	s.lock.Unlock()
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return errors.Context(err, "failed to remove cache file")
+	}
+	return nil
+}
+
+func (s *DiskStore) Clear() error {
+	s.lock.Lock()
+	index := s.index
+	s.index = newLRUIndex(index.maxSize)
+	s.lock.Unlock()
+	var err error
+	for name := range index.items {
+		if removeErr := os.Remove(s.path(name)); removeErr != nil && !os.IsNotExist(removeErr) && err == nil {
+			err = errors.Context(removeErr, "failed to remove cache file")
+		}
+	}
+	return err
+}
@@ -0,0 +1,124 @@
+package httprelay
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestMemoryStoreEviction(t *testing.T) {
+	store := NewMemoryStore(10)
+	assert.Nil(t, store.Put("a", []byte("aaaa")))
+	assert.Nil(t, store.Put("b", []byte("bbbb")))
+	// Using "a" makes "b" the least recently used value.
+	_, ok := store.Get("a")
+	assert.Equal(t, ok, true)
+	assert.Nil(t, store.Put("c", []byte("cccc")))
+	_, ok = store.Get("b")
+	assert.Equal(t, ok, false)
+	value, ok := store.Get("a")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, string(value), "aaaa")
+	// Values exceeding the bound on their own are not stored.
+	assert.Nil(t, store.Put("d", []byte("ddddddddddd")))
+	_, ok = store.Get("d")
+	assert.Equal(t, ok, false)
+	assert.Nil(t, store.Delete("a"))
+	_, ok = store.Get("a")
+	assert.Equal(t, ok, false)
+	assert.Nil(t, store.Clear())
+	_, ok = store.Get("c")
+	assert.Equal(t, ok, false)
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(dir, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Put("http://example.com/a", []byte("aaaa")))
+	assert.Nil(t, store.Put("http://example.com/b", []byte("bbbb")))
+	value, ok := store.Get("http://example.com/a")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, string(value), "aaaa")
+	assert.Nil(t, store.Put("http://example.com/c", []byte("cccc")))
+	_, ok = store.Get("http://example.com/b")
+	assert.Equal(t, ok, false)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 2)
+	// Stored values survive recreating the store.
+	store, err = NewDiskStore(dir, 10)
+	assert.Nil(t, err)
+	value, ok = store.Get("http://example.com/c")
+	assert.Equal(t, ok, true)
+	assert.Equal(t, string(value), "cccc")
+	assert.Nil(t, store.Delete("http://example.com/c"))
+	_, ok = store.Get("http://example.com/c")
+	assert.Equal(t, ok, false)
+	assert.Nil(t, store.Clear())
+	entries, err = os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestDiskStoreReloadEvicts(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(dir, 100)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Put("a", []byte("aaaa")))
+	assert.Nil(t, store.Put("b", []byte("bbbb")))
+	store, err = NewDiskStore(dir, 6)
+	assert.Nil(t, err)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 1)
+}
+
+func TestDiskStoreRemovesTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(dir, 100)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Put("a", []byte("aaaa")))
+	temp, err := os.CreateTemp(dir, store.name("b")+cacheTempInfix+"*")
+	assert.Nil(t, err)
+	assert.Nil(t, temp.Close())
+	_, err = NewDiskStore(dir, 100)
+	assert.Nil(t, err)
+	_, err = os.Stat(temp.Name())
+	assert.Equal(t, os.IsNotExist(err), true)
+	_, err = os.Stat(store.path(store.name("a")))
+	assert.Nil(t, err)
+}
+
+func TestDiskStoreConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(dir, 64)
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := strconv.Itoa((i + j) % 5)
+				assert.Nil(t, store.Put(key, []byte(strings.Repeat(key, 8))))
+				// Values are never observed partially written.
+				if value, ok := store.Get(key); ok {
+					assert.Equal(t, string(value), strings.Repeat(key, 8))
+				}
+				if j%10 == 0 {
+					assert.Nil(t, store.Delete(key))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Nil(t, store.Clear())
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, len(entries), 0)
+}
@@ -0,0 +1,343 @@
+package httprelay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	date := now.Format(http.TimeFormat)
+	var tests = []struct {
+		status   int
+		header   http.Header
+		lifetime time.Duration
+	}{
+		{200, http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 120 * time.Second},
+		{200, http.Header{"Cache-Control": {"public, max-age=60"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 60 * time.Second},
+		{200, http.Header{"Date": {date}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{200, http.Header{"Date": {date}, "Expires": {"0"}}, 0},
+		{200, http.Header{"Date": {date}, "Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{200, http.Header{"Date": {date}, "Last-Modified": {now.Add(-1000 * time.Hour).Format(http.TimeFormat)}}, maxHeuristicFreshness},
+		{302, http.Header{"Date": {date}, "Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}, 0},
+		{200, http.Header{"Cache-Control": {"max-age=invalid"}}, 0},
+	}
+	for _, test := range tests {
+		entry := cachedResponse{Status: test.status, Header: test.header, ResponseTime: now}
+		assert.Equal(t, freshnessLifetime(&entry), test.lifetime)
+	}
+}
+
+func TestCacheAge(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	cache := NewCache(NewMemoryStore(1 << 20))
+	cache.now = func() time.Time { return now }
+	entry := cachedResponse{
+		Header:       http.Header{"Date": {now.Add(-30 * time.Second).Format(http.TimeFormat)}, "Age": {"5"}},
+		RequestTime:  now.Add(-21 * time.Second),
+		ResponseTime: now.Add(-20 * time.Second),
+	}
+	// apparent age (10s) exceeds corrected age (5s + 1s), resident for 20s
+	assert.Equal(t, cache.age(&entry), 30*time.Second)
+	entry.Header.Set("Age", "100")
+	assert.Equal(t, cache.age(&entry), 121*time.Second)
+}
+
+func TestCacheServable(t *testing.T) {
+	now := time.Now()
+	cache := NewCache(NewMemoryStore(1 << 20))
+	cache.now = func() time.Time { return now }
+	entry := func(cacheControl string, age time.Duration) *cachedResponse {
+		return &cachedResponse{Status: 200, Header: http.Header{"Cache-Control": {cacheControl}},
+			RequestTime: now.Add(-age), ResponseTime: now.Add(-age)}
+	}
+	request := func(cacheControl string) http.Header {
+		if cacheControl == "" {
+			return http.Header{}
+		}
+		return http.Header{"Cache-Control": {cacheControl}}
+	}
+	assert.Equal(t, cache.servable(entry("max-age=60", 30*time.Second), request("")), true)
+	assert.Equal(t, cache.servable(entry("max-age=60", 90*time.Second), request("")), false)
+	assert.Equal(t, cache.servable(entry("max-age=60, no-cache", 0), request("")), false)
+	assert.Equal(t, cache.servable(entry("max-age=60", 0), request("no-cache")), false)
+	assert.Equal(t, cache.servable(entry("max-age=60", 0), http.Header{"Pragma": {"no-cache"}}), false)
+	assert.Equal(t, cache.servable(entry("max-age=60", 30*time.Second), request("max-age=10")), false)
+	assert.Equal(t, cache.servable(entry("max-age=60", 30*time.Second), request("min-fresh=40")), false)
+	assert.Equal(t, cache.servable(entry("max-age=60", 90*time.Second), request("max-stale")), true)
+	assert.Equal(t, cache.servable(entry("max-age=60", 90*time.Second), request("max-stale=60")), true)
+	assert.Equal(t, cache.servable(entry("max-age=60", 90*time.Second), request("max-stale=10")), false)
+	assert.Equal(t, cache.servable(entry("max-age=60, must-revalidate", 90*time.Second), request("max-stale")), false)
+}
+
+func TestCacheCacheable(t *testing.T) {
+	cache := NewCache(NewMemoryStore(1 << 20))
+	var tests = []struct {
+		method      string
+		request     http.Header
+		status      int
+		response    http.Header
+		intercepted bool
+		cacheable   bool
+	}{
+		{http.MethodGet, http.Header{}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, true},
+		{http.MethodGet, http.Header{}, 200, http.Header{"Etag": {`"v1"`}}, false, true},
+		{http.MethodGet, http.Header{}, 200, http.Header{}, false, false},
+		{http.MethodPost, http.Header{}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+		{http.MethodGet, http.Header{}, 206, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+		{http.MethodGet, http.Header{}, 200, http.Header{"Cache-Control": {"max-age=60, private"}}, false, false},
+		{http.MethodGet, http.Header{}, 200, http.Header{"Cache-Control": {"no-store"}}, false, false},
+		{http.MethodGet, http.Header{"Cache-Control": {"no-store"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+		{http.MethodGet, http.Header{}, 200, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, false, false},
+		{http.MethodGet, http.Header{}, 200, http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"id=1"}}, false, false},
+		{http.MethodGet, http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+		{http.MethodGet, http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, false, true},
+		{http.MethodGet, http.Header{"Cookie": {"id=1"}}, 200, http.Header{"Last-Modified": {"Mon, 19 Oct 2026 12:00:00 GMT"}}, false, false},
+		{http.MethodGet, http.Header{"Cookie": {"id=1"}}, 200, http.Header{"Cache-Control": {"max-age=60"}}, false, false},
+		{http.MethodGet, http.Header{"Cookie": {"id=1"}}, 200, http.Header{"Cache-Control": {"public, max-age=60"}}, false, true},
+		{http.MethodGet, http.Header{}, 200, http.Header{"Last-Modified": {"Mon, 19 Oct 2026 12:00:00 GMT"}}, true, false},
+		{http.MethodGet, http.Header{}, 200, http.Header{"Cache-Control": {"s-maxage=60"}}, true, true},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest(test.method, "http://example.com/", nil)
+		req.Header = test.request
+		resp := http.Response{StatusCode: test.status, Header: test.response}
+		if cache.cacheable(req, &resp, test.intercepted) != test.cacheable {
+			t.Errorf("Unexpected cacheability for test %d", i)
+		}
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	entry := cachedResponse{Status: 200, Header: http.Header{"Etag": {`W/"v1"`}, "Last-Modified": {lastModified.Format(http.TimeFormat)}}}
+	assert.Equal(t, notModified(http.Header{"If-None-Match": {`"v0", "v1"`}}, &entry), true)
+	assert.Equal(t, notModified(http.Header{"If-None-Match": {`"v2"`}}, &entry), false)
+	assert.Equal(t, notModified(http.Header{"If-None-Match": {"*"}}, &entry), true)
+	assert.Equal(t, notModified(http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, &entry), true)
+	assert.Equal(t, notModified(http.Header{"If-Modified-Since": {lastModified.Add(-time.Second).Format(http.TimeFormat)}}, &entry), false)
+	// If-None-Match takes precedence over If-Modified-Since.
+	assert.Equal(t, notModified(http.Header{"If-None-Match": {`"v2"`}, "If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, &entry), false)
+	assert.Equal(t, notModified(http.Header{}, &entry), false)
+}
+
+func TestProxyHandlerCacheHit(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(resp, "artifact "+strconv.Itoa(int(requests.Add(1))))
+	}))
+	defer origin.Close()
+	cache := NewCache(NewMemoryStore(1 << 20))
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, Cache: cache}
+	recorder := testServe(&handler, http.MethodGet, "http://example.com/pool/main/a.deb", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "artifact 1")
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "MISS")
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/pool/main/a.deb", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "artifact 1")
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "HIT")
+	assert.Equal(t, recorder.Header().Get("Age"), "0")
+	assert.Equal(t, requests.Load(), int32(1))
+	// Clients may demand validation with the origin server.
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/pool/main/a.deb", http.Header{"Cache-Control": {"no-cache"}})
+	assert.Equal(t, recorder.Body.String(), "artifact 2")
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "MISS")
+	// Purged responses are fetched from the origin server.
+	assert.Nil(t, cache.Purge("http://example.com/pool/main/a.deb"))
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/pool/main/a.deb", nil)
+	assert.Equal(t, recorder.Body.String(), "artifact 3")
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "MISS")
+}
+
+func TestProxyHandlerCacheBlocked(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(resp, "artifact")
+	}))
+	defer origin.Close()
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "hosts.txt"), []byte("0.0.0.0 example.com\n"), 0o600))
+	lists, err := LoadBlocklists(dir, BlocklistAuto, nil)
+	assert.Nil(t, err)
+	lists[0].SetEnabled(false)
+	cache := NewCache(NewMemoryStore(1 << 20))
+	origins := &TestRedirectDialer{addr: origin.Listener.Addr().String()}
+	handler := HTTPProxyHandler{Dialer: &BlocklistDialer{Lists: lists, Dialer: origins}, Cache: cache}
+	recorder := testServe(&handler, http.MethodGet, "http://example.com/a.deb", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "MISS")
+	// Another listener that shares the cache, but blocks the host.
+	other := HTTPProxyHandler{Dialer: WrapPerHostBlocking(origins, false, "example.com"), Cache: cache}
+	recorder = testServe(&other, http.MethodGet, "http://example.com/a.deb", nil)
+	assert.Equal(t, recorder.Code, http.StatusForbidden)
+	// The blocklist is enabled at runtime.
+	lists[0].SetEnabled(true)
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/a.deb", nil)
+	assert.Equal(t, recorder.Code, http.StatusForbidden)
+	assert.Equal(t, recorder.Body.String(), "Host 'example.com' is blocked by blocklist 'hosts'.\n")
+	lists[0].SetEnabled(false)
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/a.deb", nil)
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "HIT")
+}
+
+func TestProxyHandlerCacheAge(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(resp, "artifact")
+	}))
+	defer origin.Close()
+	now := time.Now()
+	cache := NewCache(NewMemoryStore(1 << 20))
+	cache.now = func() time.Time { return now }
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, Cache: cache}
+	testServe(&handler, http.MethodGet, "http://example.com/a", nil)
+	now = now.Add(42 * time.Second)
+	recorder := testServe(&handler, http.MethodGet, "http://example.com/a", nil)
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "HIT")
+	assert.Equal(t, recorder.Header().Get("Age"), "42")
+	now = now.Add(20 * time.Second)
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/a", nil)
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "MISS")
+	assert.Equal(t, recorder.Header().Get("Age"), "")
+	// Requests that must be served from the cache fail if there is no (fresh) stored response.
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/b", http.Header{"Cache-Control": {"only-if-cached"}})
+	assert.Equal(t, recorder.Code, http.StatusGatewayTimeout)
+}
+
+func TestProxyHandlerCacheRevalidation(t *testing.T) {
+	var requests, validations atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		resp.Header().Set("Cache-Control", "no-cache")
+		resp.Header().Set("ETag", `"v1"`)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			validations.Add(1)
+			resp.Header().Set("X-Validated", "yes")
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(resp, "artifact")
+	}))
+	defer origin.Close()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, Cache: NewCache(NewMemoryStore(1 << 20))}
+	recorder := testServe(&handler, http.MethodGet, "http://example.com/a", nil)
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "MISS")
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/a", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "artifact")
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "REVALIDATED")
+	assert.Equal(t, recorder.Header().Get("X-Validated"), "yes")
+	// The client's own precondition is evaluated against the stored response.
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/a", http.Header{"If-None-Match": {`"v1"`}})
+	assert.Equal(t, recorder.Code, http.StatusNotModified)
+	assert.Equal(t, recorder.Body.String(), "")
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/a", http.Header{"If-None-Match": {`"v0"`}})
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "artifact")
+	assert.Equal(t, requests.Load(), int32(4))
+	assert.Equal(t, validations.Load(), int32(3))
+}
+
+func TestProxyHandlerCacheVary(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		resp.Header().Set("Cache-Control", "max-age=60")
+		resp.Header().Set("Vary", "Accept-Language")
+		io.WriteString(resp, "language "+req.Header.Get("Accept-Language"))
+	}))
+	defer origin.Close()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, Cache: NewCache(NewMemoryStore(1 << 20))}
+	english := http.Header{"Accept-Language": {"en"}}
+	testServe(&handler, http.MethodGet, "http://example.com/a", english)
+	recorder := testServe(&handler, http.MethodGet, "http://example.com/a", english)
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "HIT")
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/a", http.Header{"Accept-Language": {"nl"}})
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "MISS")
+	assert.Equal(t, recorder.Body.String(), "language nl")
+	assert.Equal(t, requests.Load(), int32(2))
+}
+
+func TestProxyHandlerCacheInvalidation(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		if req.Method == http.MethodPost {
+			resp.Header().Set("Location", "/b")
+			resp.WriteHeader(http.StatusCreated)
+			return
+		}
+		resp.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(resp, "resource")
+	}))
+	defer origin.Close()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, Cache: NewCache(NewMemoryStore(1 << 20))}
+	testServe(&handler, http.MethodGet, "http://example.com/a", nil)
+	testServe(&handler, http.MethodGet, "http://example.com/b", nil)
+	testServe(&handler, http.MethodGet, "http://example.com/c", nil)
+	assert.Equal(t, requests.Load(), int32(3))
+	testServe(&handler, http.MethodPost, "http://example.com/a", nil)
+	assert.Equal(t, testServe(&handler, http.MethodGet, "http://example.com/a", nil).Header().Get("X-Cache"), "MISS")
+	assert.Equal(t, testServe(&handler, http.MethodGet, "http://example.com/b", nil).Header().Get("X-Cache"), "MISS")
+	assert.Equal(t, testServe(&handler, http.MethodGet, "http://example.com/c", nil).Header().Get("X-Cache"), "HIT")
+}
+
+func TestProxyHandlerCacheEntrySizeLimit(t *testing.T) {
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests.Add(1)
+		resp.Header().Set("Cache-Control", "max-age=60")
+		resp.(http.Flusher).Flush()
+		io.WriteString(resp, "a response body that exceeds the limit")
+	}))
+	defer origin.Close()
+	cache := NewCache(NewMemoryStore(1 << 20))
+	cache.MaxEntrySize = 10
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, Cache: cache}
+	recorder := testServe(&handler, http.MethodGet, "http://example.com/a", nil)
+	assert.Equal(t, recorder.Body.String(), "a response body that exceeds the limit")
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/a", nil)
+	assert.Equal(t, recorder.Header().Get("X-Cache"), "MISS")
+	assert.Equal(t, requests.Load(), int32(2))
+}
+
+func TestAdminHandlerCachePurge(t *testing.T) {
+	cache := NewCache(NewMemoryStore(1 << 20))
+	cache.put("http://example.com/a", &cachedResponse{Status: 200})
+	cache.put("http://example.com/b", &cachedResponse{Status: 200})
+	admin := AdminHandler{Metrics: new(Metrics), Cache: cache}
+	recorder := testServe(&admin, http.MethodGet, "/cache/purge", nil)
+	assert.Equal(t, recorder.Code, http.StatusMethodNotAllowed)
+	recorder = testServe(&admin, http.MethodPost, "/cache/purge?url=http%3A%2F%2FExample.com%2Fa", nil)
+	assert.Equal(t, recorder.Code, http.StatusNoContent)
+	_, ok := cache.Store.Get("http://example.com/a")
+	assert.Equal(t, ok, false)
+	_, ok = cache.Store.Get("http://example.com/b")
+	assert.Equal(t, ok, true)
+	recorder = testServe(&admin, http.MethodPost, "/cache/purge", nil)
+	assert.Equal(t, recorder.Code, http.StatusNoContent)
+	_, ok = cache.Store.Get("http://example.com/b")
+	assert.Equal(t, ok, false)
+}
+
+// testServe serves a request with the handler and returns the recorded response.
+func testServe(handler http.Handler, method, uri string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, uri, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
@@ -0,0 +1,146 @@
+package httprelay
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	bufio_ "github.com/cobratbq/goutils/std/bufio"
+	"github.com/cobratbq/goutils/std/errors"
+	io_ "github.com/cobratbq/goutils/std/io"
+	"golang.org/x/net/proxy"
+)
+
+// ClientInfo identifies the client on whose behalf a connection is dialed.
+type ClientInfo struct {
+	// Addr is the (remote) address of the client connection.
+	Addr string
+	// User is the user name of the verified credentials in the Proxy-Authorization header. Empty
+	// if proxy authentication is not required.
+	User string
+}
+
+// clientKey is the context key for the client information.
+type clientKey struct{}
+
+// WithClient returns a context that carries the client information.
+func WithClient(ctx context.Context, client ClientInfo) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns the client information carried by the context, if present.
+func ClientFromContext(ctx context.Context) (ClientInfo, bool) {
+	client, ok := ctx.Value(clientKey{}).(ClientInfo)
+	return client, ok
+}
+
+// withClient returns the request with client information, including the verified user, added to
+// its context.
+func withClient(req *http.Request, user string) *http.Request {
+	client := ClientInfo{Addr: req.RemoteAddr, User: user}
+	return req.WithContext(WithClient(req.Context(), client))
+}
+
+// proxyAuthorization extracts the user name and password from Basic credentials in the
+// Proxy-Authorization header. Returns false if absent or not Basic credentials.
+func proxyAuthorization(header http.Header) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// ProxyCredentials are the credentials that clients must provide in the Proxy-Authorization header,
+// as SHA-256 digest of the password by user name. Nil does not require proxy authentication.
+type ProxyCredentials map[string][sha256.Size]byte
+
+// ErrProxyAuthenticationRequired indicates that the client did not provide valid credentials.
+var ErrProxyAuthenticationRequired = errors.NewStringError("proxy authentication required")
+
+// ErrInvalidProxyCredentials indicates that a line of the credentials file is malformed.
+var ErrInvalidProxyCredentials = errors.NewStringError("invalid proxy credentials")
+
+// LoadProxyCredentialsFile loads proxy credentials from the specified file.
+func LoadProxyCredentialsFile(filename string) (ProxyCredentials, error) {
+	credentialsFile, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Context(err, "failed to open file "+filename)
+	}
+	defer io_.CloseLogged(credentialsFile, "failed to close proxy credentials file")
+	return LoadProxyCredentials(credentialsFile)
+}
+
+// LoadProxyCredentials loads proxy credentials from provided reader, formatted as 'user:password'
+// per line. Empty lines and lines starting with '#' are ignored.
+func LoadProxyCredentials(in io.Reader) (ProxyCredentials, error) {
+	credentials := make(ProxyCredentials)
+	var lineNumber int
+	if err := bufio_.ReadStringLinesFunc(bufio.NewReader(in), '\n', func(line string) error {
+		lineNumber++
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return nil
+		}
+		user, password, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return errors.Context(ErrInvalidProxyCredentials, "line "+strconv.Itoa(lineNumber))
+		}
+		credentials[user] = sha256.Sum256([]byte(password))
+		return nil
+	}); err != nil {
+		return nil, errors.Context(err, "failed to read proxy credentials")
+	}
+	return credentials, nil
+}
+
+// verify returns the user name of the credentials in the Proxy-Authorization header, if valid.
+func (c ProxyCredentials) verify(header http.Header) (string, bool) {
+	user, password, ok := proxyAuthorization(header)
+	if !ok {
+		return "", false
+	}
+	expected, ok := c[user]
+	digest := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare(digest[:], expected[:]) != 1 || !ok {
+		return "", false
+	}
+	return user, true
+}
+
+// authenticate returns the request with client information added to its context, if the client
+// provided valid credentials or credentials are not required. Otherwise, it responds with 407 Proxy
+// Authentication Required and returns ErrProxyAuthenticationRequired.
+func (c ProxyCredentials) authenticate(resp http.ResponseWriter, req *http.Request) (*http.Request, error) {
+	if c == nil {
+		return withClient(req, ""), nil
+	}
+	user, ok := c.verify(req.Header)
+	if !ok {
+		resp.Header().Set("Proxy-Authenticate", `Basic realm="httprelay"`)
+		resp.WriteHeader(http.StatusProxyAuthRequired)
+		return req, ErrProxyAuthenticationRequired
+	}
+	return withClient(req, user), nil
+}
+
+// dialContext dials using the dialer's DialContext if supported, such that the context's values,
+// e.g. the client information, are available to the dialer. Otherwise, it falls back to Dial.
+func dialContext(ctx context.Context, dialer proxy.Dialer, network, addr string) (net.Conn, error) {
+	if contextDialer, ok := dialer.(proxy.ContextDialer); ok {
+		return contextDialer.DialContext(ctx, network, addr)
+	}
+	return dialer.Dial(network, addr)
+}
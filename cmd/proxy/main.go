@@ -1,58 +1,324 @@
 package main
 
 import (
-	"context"
+	"crypto/tls"
+	"expvar"
 	"flag"
+	"net"
 	"net/http"
 	"os"
-	"syscall"
+	"strconv"
+	stdstrings "strings"
+	"time"
 
 	"github.com/cobratbq/goutils/std/log"
-	net_ "github.com/cobratbq/goutils/std/net"
 	"github.com/cobratbq/goutils/std/strings"
 	"github.com/cobratbq/httprelay"
 	"golang.org/x/net/proxy"
 )
 
 func main() {
-	listenAddr := flag.String("listen", ":8080", "Listening address and port for HTTP relay proxy.")
+	if len(os.Args) > 1 && os.Args[1] == "compile" {
+		os.Exit(compile(os.Args[2:]))
+	}
+	listenAddr := flag.String("listen", ":8080", "Listening address and port for HTTP relay proxy, 'unix:<path>' for a Unix domain socket, or 'systemd[:<name>]' for a socket passed in by systemd socket-activation. Empty to disable.")
+	unixMode := flag.String("unix-mode", "0660", "File mode (octal) of the Unix domain socket.")
+	unixOwner := flag.String("unix-owner", "", "Owner of the Unix domain socket, formatted as 'user[:group]'.")
 	blockAddrs := flag.String("block", "", "Comma-separated list of blocked host names, zone names, ip addresses and CIDR addresses.")
 	blockLocal := flag.Bool("block-local", true, "Block known local addresses.")
-	blocklist := flag.String("blocklist", "", "Filename referring to a hosts-formatted blocklist.")
+	allowAddrs := flag.String("allow", "", "Comma-separated list of IP addresses and CIDR ranges of clients that are allowed to connect, formatted like -block. Connections through a Unix domain socket are always allowed, as access is controlled by -unix-mode and -unix-owner. (default: all)")
+	var defaultBlocklists []string
+	flag.Func("blocklist", "Blocklist formatted according to -blocklist-format, as '<file|directory|URL>[,name=<name>][,sha256=<checksum>][,minisign=<public key>]'. Blocklists are named after their filename without extension. May be repeated.", func(path string) error {
+		defaultBlocklists = append(defaultBlocklists, path)
+		return nil
+	})
+	blocklistFormat := flag.String("blocklist-format", "auto", "Format of blocklists: 'auto' (detect), 'hosts', 'adblock' (host-level subset of Adblock Plus filter lists), 'domains' (one per line) or 'dnsmasq'.")
+	blocklistCache := flag.String("blocklist-cache", "", "Directory for keeping the last-known-good copy of blocklists fetched from URLs, used when a URL is unavailable at startup.")
+	blocklistRefresh := flag.Duration("blocklist-refresh", 24*time.Hour, "Interval for refreshing blocklists fetched from URLs. Zero to disable.")
+	blocklistSinks := flag.String("blocklist-sinks", stdstrings.Join(httprelay.DefaultSinks, ","), "Comma-separated list of addresses that indicate blocked hosts in hosts-formatted and dnsmasq blocklists.")
 	tunnel := flag.Bool("tunnel", false, "Tunnel-mode: only allow CONNECT-method to establish raw tunneled connections.")
+	var listeners []httprelay.ListenerConfig
+	flag.Func("listener", "Additional listener, formatted as 'address[;mode=proxy|tunnel][;allow=<addresses>][;upstream=<host:port>][;blocklist=<filename>]...'. An upstream is a SOCKS5 proxy to connect through. May be repeated.", func(spec string) error {
+		config, err := httprelay.ParseListenerConfig(spec)
+		listeners = append(listeners, config)
+		return err
+	})
+	originateTLS := flag.Bool("originate-tls", false, "Originate TLS connections to the origin server for absolute 'https://' request URIs.")
+	caBundle := flag.String("tls-ca-bundle", "", "Filename of PEM-encoded CA certificates to verify origin servers against, instead of the system roots.")
+	interceptCA := flag.String("intercept-ca", "", "Filename of the PEM-encoded CA certificate for intercepting TLS of CONNECT tunnels. Implies -originate-tls. (default: disabled)")
+	interceptKey := flag.String("intercept-key", "", "Filename of the PEM-encoded private key of the CA for intercepting TLS.")
+	interceptBypass := flag.String("intercept-bypass", "", "Comma-separated list of domains, including subdomains, that are tunneled without interception.")
+	viaEnabled := flag.Bool("via", false, "Insert Via headers in forwarded messages and refuse requests that passed through this proxy before.")
+	viaPseudonym := flag.String("via-pseudonym", "", "Pseudonym to use in Via headers instead of the host name.")
+	forwarded := flag.String("forwarded", "preserve", "Treatment of headers identifying the client: 'preserve', 'strip', 'x-forwarded-for' or 'forwarded'.")
+	anonymize := flag.String("anonymize", "", "Anonymizing profile for removing or normalizing identifying request headers: 'minimal', 'standard' or 'strict'. (default: disabled)")
+	headerRulesFile := flag.String("header-rules", "", "Filename referring to rules for rewriting request and response headers.")
+	urlRulesFile := flag.String("url-rules", "", "Filename referring to rules for allowing or blocking requests by URL.")
+	disableTrace := flag.Bool("disable-trace", false, "Refuse TRACE requests, for protection against cross-site tracing.")
+	dnsServer := flag.String("dns", "", "DNS server for resolving host names instead of the system resolver: 'host[:port]', 'udp://host[:port]', 'tcp://host[:port]', 'tls://host[:port]' (DNS-over-TLS) or an 'https://' URL (DNS-over-HTTPS).")
+	dnsHosts := flag.String("dns-hosts", "", "Filename referring to a hosts-formatted file with static host name resolutions, which take precedence over DNS.")
+	dnsCache := flag.Bool("dns-cache", true, "Cache results of the DNS server configured with -dns, honoring time-to-live values.")
+	connectTimeout := flag.Duration("connect-timeout", 0, "Timeout for establishing outgoing connections, e.g. '10s'. (default: no timeout)")
+	keepAlive := flag.Duration("keepalive", 0, "Idle time before, and interval between, TCP keep-alive probes of outgoing connections, e.g. '30s'. (default: disabled)")
+	keepAliveCount := flag.Int("keepalive-count", 0, "Number of unanswered TCP keep-alive probes before dropping the connection. (default: system default)")
+	sourceAddr := flag.String("source-address", "", "Local IP address to use as source address for outgoing connections.")
+	iface := flag.String("interface", "", "Network interface to bind outgoing connections to (Linux only).")
+	cacheSize := flag.Int64("cache-size", 0, "Size in MiB of the shared cache for responses to plain-HTTP GET requests. (default: disabled)")
+	cacheDir := flag.String("cache-dir", "", "Directory for storing cached responses on disk. (default: in memory)")
+	cacheMaxEntry := flag.Int64("cache-max-entry", 16, "Maximum size in MiB of a single cached response.")
+	adminAddr := flag.String("admin", "", "Listening address for the administrative endpoint, which allows clients according to -allow, or only loopback clients if -allow is empty. (default: disabled)")
 	flag.Parse()
-	// Prepare proxy dialer
-	baseDialer := httprelay.DirectDialer()
-	var dialer proxy.Dialer = &baseDialer
-	if *blocklist != "" {
-		log.Infoln("Loading blocklist from file:", *blocklist)
-		var wrapErr error
-		if dialer, wrapErr = httprelay.WrapBlocklistBlocking(dialer, *blocklist); wrapErr != nil {
-			log.Errorln("Failed to load blocklist:", wrapErr.Error())
+	if *listenAddr != "" {
+		listeners = append([]httprelay.ListenerConfig{{Address: *listenAddr, Tunnel: *tunnel, Allow: *allowAddrs}}, listeners...)
+	}
+	if len(listeners) == 0 {
+		log.Errorln("No listeners configured.")
+		os.Exit(1)
+	}
+	mode, modeErr := strconv.ParseUint(*unixMode, 8, 32)
+	if modeErr != nil {
+		log.Errorln("Invalid file mode for Unix domain socket:", modeErr.Error())
+		os.Exit(1)
+	}
+	unixOptions := httprelay.UnixSocketOptions{Mode: os.FileMode(mode), Owner: *unixOwner}
+	format, formatErr := httprelay.ParseBlocklistFormat(*blocklistFormat)
+	if formatErr != nil {
+		log.Errorln("Invalid blocklist format:", formatErr.Error())
+		os.Exit(1)
+	}
+	stats := new(httprelay.BlocklistStats)
+	registry := httprelay.BlocklistRegistry{Format: format, Sinks: stdstrings.Split(*blocklistSinks, ","), CacheDir: *blocklistCache}
+	var interceptor *httprelay.Interceptor
+	if *interceptCA != "" {
+		var interceptErr error
+		if interceptor, interceptErr = httprelay.LoadInterceptor(*interceptCA, *interceptKey); interceptErr != nil {
+			log.Errorln("Failed to configure TLS interception:", interceptErr.Error())
 			os.Exit(1)
 		}
+		if *interceptBypass != "" {
+			interceptor.Bypass = stdstrings.Split(*interceptBypass, ",")
+		}
+		log.Warnln("Intercepting TLS of CONNECT tunnels using CA:", interceptor.CA.Subject.String())
 	}
-	if *blockLocal || *blockAddrs != "" {
-		log.Infoln("Blocking local addresses:", *blockLocal, ", custom addresses:",
-			strings.OrDefault(*blockAddrs, "<none>"))
-		dialer = httprelay.WrapPerHostBlocking(dialer, *blockLocal, *blockAddrs)
+	var tlsConfig *tls.Config
+	if *originateTLS || interceptor != nil {
+		var tlsErr error
+		if tlsConfig, tlsErr = httprelay.OriginTLSConfig(*caBundle); tlsErr != nil {
+			log.Errorln("Failed to configure TLS origination:", tlsErr.Error())
+			os.Exit(1)
+		}
 	}
-
-	// Start HTTP proxy server
-	listener, listenErr := net_.ListenWithOptions(context.Background(), "tcp", *listenAddr,
-		map[net_.Option]int{{Level: syscall.SOL_IP, Option: syscall.IP_FREEBIND}: 1})
-	if listenErr != nil {
-		log.Errorln("Failed to open local address for proxy:", listenErr.Error())
+	var via string
+	if *viaEnabled {
+		via = *viaPseudonym
+		if via == "" {
+			var hostErr error
+			if via, hostErr = os.Hostname(); hostErr != nil {
+				log.Errorln("Failed to determine host name for Via header:", hostErr.Error())
+				os.Exit(1)
+			}
+		}
+	}
+	forwardedMode, forwardedErr := httprelay.ParseForwardedMode(*forwarded)
+	if forwardedErr != nil {
+		log.Errorln("Invalid forwarded mode:", forwardedErr.Error())
 		os.Exit(1)
 	}
-	var handler http.Handler
-	if *tunnel {
-		log.Infoln("Tunnel-mode: only CONNECT is allowed.")
-		handler = &httprelay.HTTPConnectHandler{Dialer: dialer, UserAgent: ""}
-	} else {
-		handler = &httprelay.HTTPProxyHandler{Dialer: dialer, UserAgent: ""}
+	var anonymizeProfile *httprelay.AnonymizeProfile
+	if *anonymize != "" {
+		var profileErr error
+		if anonymizeProfile, profileErr = httprelay.LookupAnonymizeProfile(*anonymize); profileErr != nil {
+			log.Errorln("Invalid anonymizing profile:", profileErr.Error())
+			os.Exit(1)
+		}
+		log.Infoln("Anonymizing requests using profile:", anonymizeProfile.Name)
+	}
+	var headerRules *httprelay.HeaderRules
+	if *headerRulesFile != "" {
+		log.Infoln("Loading header rules from file:", *headerRulesFile)
+		var rulesErr error
+		if headerRules, rulesErr = httprelay.LoadHeaderRulesFile(*headerRulesFile); rulesErr != nil {
+			log.Errorln("Failed to load header rules:", rulesErr.Error())
+			os.Exit(1)
+		}
+	}
+	var urlRules *httprelay.URLRules
+	if *urlRulesFile != "" {
+		log.Infoln("Loading URL rules from file:", *urlRulesFile)
+		var rulesErr error
+		if urlRules, rulesErr = httprelay.LoadURLRulesFile(*urlRulesFile); rulesErr != nil {
+			log.Errorln("Failed to load URL rules:", rulesErr.Error())
+			os.Exit(1)
+		}
+	}
+	baseDialer, dialerErr := httprelay.NewDirectDialer(httprelay.DialerOptions{
+		Timeout:        *connectTimeout,
+		KeepAlive:      *keepAlive,
+		KeepAliveCount: *keepAliveCount,
+		LocalAddr:      *sourceAddr,
+		Interface:      *iface,
+	})
+	if dialerErr != nil {
+		log.Errorln("Failed to configure outgoing connections:", dialerErr.Error())
+		os.Exit(1)
+	}
+	var resolver httprelay.Resolver = net.DefaultResolver
+	if *dnsServer != "" {
+		dnsResolver, dnsErr := httprelay.ParseDNSServer(*dnsServer)
+		if dnsErr != nil {
+			log.Errorln("Invalid DNS server:", dnsErr.Error())
+			os.Exit(1)
+		}
+		log.Infoln("Resolving host names using DNS server:", *dnsServer)
+		// DNS queries use the source address, interface and timeout of outgoing connections.
+		dnsResolver.Dialer = baseDialer
+		dnsResolver.Client = httprelay.NewDNSClient(baseDialer)
+		resolver = dnsResolver
+		if *dnsCache {
+			resolver = httprelay.NewCachingResolver(resolver)
+		}
+	}
+	if *dnsHosts != "" {
+		log.Infoln("Loading static host name resolutions from file:", *dnsHosts)
+		var hostsErr error
+		if resolver, hostsErr = httprelay.LoadHostsResolver(resolver, *dnsHosts); hostsErr != nil {
+			log.Errorln("Failed to load static host name resolutions:", hostsErr.Error())
+			os.Exit(1)
+		}
+	}
+	var cache *httprelay.Cache
+	if *cacheSize > 0 {
+		var store httprelay.CacheStore = httprelay.NewMemoryStore(*cacheSize << 20)
+		if *cacheDir != "" {
+			log.Infoln("Caching responses in directory:", *cacheDir)
+			var storeErr error
+			if store, storeErr = httprelay.NewDiskStore(*cacheDir, *cacheSize<<20); storeErr != nil {
+				log.Errorln("Failed to open cache directory:", storeErr.Error())
+				os.Exit(1)
+			}
+		}
+		cache = httprelay.NewCache(store)
+		cache.MaxEntrySize = *cacheMaxEntry << 20
+	}
+	// Blocklists are fetched using the configured resolver, rather than the system resolver.
+	registry.Client = httprelay.NewBlocklistClient(&httprelay.ResolvingDialer{Resolver: resolver, Dialer: baseDialer})
+	metrics := new(httprelay.Metrics)
+	expvar.Publish("httprelay", metrics)
+	failures := make(chan error)
+	var adminListeners []httprelay.AdminListener
+	for _, config := range listeners {
+		blocklists := config.Blocklists
+		if blocklists == nil {
+			blocklists = defaultBlocklists
+		}
+		// Prepare proxy dialer
+		var dialer proxy.Dialer = &httprelay.ResolvingDialer{Resolver: resolver, Dialer: baseDialer}
+		if config.Upstream != "" {
+			var err error
+			if dialer, err = proxy.SOCKS5("tcp", config.Upstream, nil, baseDialer); err != nil {
+				log.Errorln("Failed to create proxy definition:", err.Error())
+				os.Exit(1)
+			}
+		}
+		var lists []*httprelay.Blocklist
+		for _, path := range blocklists {
+			log.Infoln("Loading blocklists from:", path)
+			loaded, loadErr := registry.Load(path)
+			if loadErr != nil {
+				log.Errorln("Failed to load blocklist:", loadErr.Error())
+				os.Exit(1)
+			}
+			lists = append(lists, loaded...)
+		}
+		if len(lists) > 0 {
+			dialer = &httprelay.BlocklistDialer{Lists: lists, Stats: stats, Dialer: dialer}
+		}
+		if *blockLocal || *blockAddrs != "" {
+			log.Infoln("Blocking local addresses:", *blockLocal, ", custom addresses:",
+				strings.OrDefault(*blockAddrs, "<none>"))
+			dialer = httprelay.WrapPerHostBlocking(dialer, *blockLocal, *blockAddrs)
+		}
+		adminListeners = append(adminListeners, httprelay.AdminListener{Address: config.Address, Dialer: dialer, Blocklists: lists})
+
+		// Start HTTP proxy server
+		listener, listenErr := httprelay.Listen(config.Address, unixOptions)
+		if listenErr != nil {
+			log.Errorln("Failed to open local address for proxy:", listenErr.Error())
+			os.Exit(1)
+		}
+		if config.Allow != "" {
+			log.Infoln("Allowing connections on", config.Address, "from:", config.Allow)
+			listener = httprelay.WrapACL(listener, config.Allow)
+		}
+		var handler http.Handler
+		if config.Tunnel {
+			log.Infoln("Tunnel-mode on", config.Address+": only CONNECT is allowed.")
+			handler = &httprelay.HTTPConnectHandler{Dialer: dialer, UserAgent: "", Via: via, Metrics: metrics}
+		} else {
+			handler = &httprelay.HTTPProxyHandler{
+				Dialer:       dialer,
+				UserAgent:    "",
+				TLSConfig:    tlsConfig,
+				Via:          via,
+				Forwarded:    forwardedMode,
+				Anonymize:    anonymizeProfile,
+				HeaderRules:  headerRules,
+				URLRules:     urlRules,
+				DisableTrace: *disableTrace,
+				Cache:        cache,
+				Interceptor:  interceptor,
+				Metrics:      metrics,
+			}
+		}
+		server := http.Server{Handler: handler}
+		log.Infoln("HTTP proxy server started on", config.Address)
+		go func() { failures <- server.Serve(listener) }()
+	}
+	if *blocklistRefresh > 0 {
+		go registry.RefreshEvery(*blocklistRefresh)
+	}
+	if *adminAddr != "" {
+		listener, listenErr := httprelay.Listen(*adminAddr, unixOptions)
+		if listenErr != nil {
+			log.Errorln("Failed to open local address for administrative endpoint:", listenErr.Error())
+			os.Exit(1)
+		}
+		// The administrative endpoint controls blocking, therefore it is never open to all clients.
+		adminAllow := strings.OrDefault(*allowAddrs, httprelay.LoopbackAddresses)
+		log.Infoln("Allowing connections on", *adminAddr, "from:", adminAllow)
+		listener = httprelay.WrapACL(listener, adminAllow)
+		server := http.Server{Handler: &httprelay.AdminHandler{Metrics: metrics, Cache: cache, Blocklists: &registry, Stats: stats, Listeners: adminListeners}}
+		log.Infoln("Administrative endpoint started on", *adminAddr)
+		go func() { failures <- server.Serve(listener) }()
+	}
+	log.Infoln(<-failures)
+}
+
+// compile compiles blocklists into a single compiled blocklist, which loads without parsing.
+func compile(args []string) int {
+	flags := flag.NewFlagSet("compile", flag.ExitOnError)
+	flags.Usage = func() {
+		flags.Output().Write([]byte("Usage: " + os.Args[0] + " compile -o <output> [options] <blocklist>...\n"))
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "", "Filename of the compiled blocklist.")
+	formatName := flags.String("format", "auto", "Format of the blocklists: 'auto' (detect), 'hosts', 'adblock', 'domains' or 'dnsmasq'.")
+	sinks := flags.String("sinks", stdstrings.Join(httprelay.DefaultSinks, ","), "Comma-separated list of addresses that indicate blocked hosts in hosts-formatted and dnsmasq blocklists.")
+	flags.Parse(args)
+	if *output == "" || flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	format, err := httprelay.ParseBlocklistFormat(*formatName)
+	if err != nil {
+		log.Errorln("Invalid blocklist format:", err.Error())
+		return 1
+	}
+	report, err := httprelay.CompileBlocklists(*output, flags.Args(), format, stdstrings.Split(*sinks, ","))
+	if err != nil {
+		log.Errorln("Failed to compile blocklists:", err.Error())
+		return 1
 	}
-	server := http.Server{Handler: handler}
-	log.Infoln("HTTP proxy server started on", *listenAddr)
-	log.Infoln(server.Serve(listener))
+	log.Infoln("Compiled blocklist", *output+":", report.String())
+	return 0
 }
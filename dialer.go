@@ -0,0 +1,68 @@
+package httprelay
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/cobratbq/goutils/std/errors"
+)
+
+// DialerOptions configures the direct dialer.
+type DialerOptions struct {
+	// Timeout is the maximum duration for establishing a connection. Zero means no timeout, other
+	// than the operating system's.
+	Timeout time.Duration
+	// KeepAlive is the idle time before sending TCP keep-alive probes, as well as the interval
+	// between probes. Zero disables keep-alive.
+	KeepAlive time.Duration
+	// KeepAliveCount is the number of unanswered probes before the connection is dropped. Zero
+	// means the operating system's default.
+	KeepAliveCount int
+	// LocalAddr is the local IP address to use as source address. Empty for automatic selection.
+	LocalAddr string
+	// Interface is the name of the network interface to bind to, using SO_BINDTODEVICE. Empty for
+	// any interface. Only supported on Linux.
+	Interface string
+}
+
+// NewDirectDialer creates a dialer for direct connections according to the options. Host names are
+// resolved locally. If the dialer resolves host names itself, it connects to IPv4 and IPv6
+// addresses according to RFC 6555 ("Happy Eyeballs"). ResolvingDialer connects according to RFC
+// 8305 instead.
+func NewDirectDialer(options DialerOptions) (*net.Dialer, error) {
+	dialer := net.Dialer{Timeout: options.Timeout, KeepAlive: -1}
+	if options.KeepAlive > 0 {
+		dialer.KeepAliveConfig = net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     options.KeepAlive,
+			Interval: options.KeepAlive,
+			Count:    options.KeepAliveCount,
+		}
+	}
+	if options.LocalAddr != "" {
+		ip, err := netip.ParseAddr(trimBrackets(options.LocalAddr))
+		if err != nil {
+			return nil, errors.Context(ErrInvalidAddress, "local address '"+options.LocalAddr+"'")
+		}
+		dialer.LocalAddr = &net.TCPAddr{IP: net.IP(ip.Unmap().AsSlice()), Zone: ip.Zone()}
+	}
+	if options.Interface != "" {
+		if _, err := net.InterfaceByName(options.Interface); err != nil {
+			return nil, errors.Context(err, "unknown interface '"+options.Interface+"'")
+		}
+		control, err := bindToDeviceControl(options.Interface)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Control = control
+	}
+	return &dialer, nil
+}
+
+// ErrInvalidAddress indicates that an address could not be parsed as IP address.
+var ErrInvalidAddress = errors.NewStringError("invalid IP address")
+
+// ErrBindToDeviceUnsupported indicates that binding to a network interface is not supported on
+// this platform.
+var ErrBindToDeviceUnsupported = errors.NewStringError("binding to a network interface is not supported on this platform")
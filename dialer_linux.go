@@ -0,0 +1,17 @@
+package httprelay
+
+import "syscall"
+
+// bindToDeviceControl returns a control function that binds sockets to the network interface
+// using SO_BINDTODEVICE.
+func bindToDeviceControl(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
@@ -0,0 +1,21 @@
+package httprelay
+
+import (
+	"net"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestNewDirectDialerInterface(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	dialer, err := NewDirectDialer(DialerOptions{Interface: "lo"})
+	assert.Nil(t, err)
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Skip("Binding to an interface is not permitted:", err.Error())
+	}
+	conn.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package httprelay
+
+import "syscall"
+
+// bindToDeviceControl fails, as SO_BINDTODEVICE is specific to Linux.
+func bindToDeviceControl(iface string) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, ErrBindToDeviceUnsupported
+}
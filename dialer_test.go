@@ -0,0 +1,43 @@
+package httprelay
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestNewDirectDialer(t *testing.T) {
+	dialer, err := NewDirectDialer(DialerOptions{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second, KeepAliveCount: 3})
+	assert.Nil(t, err)
+	assert.Equal(t, dialer.Timeout, 5*time.Second)
+	assert.Equal(t, dialer.KeepAliveConfig, net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 30 * time.Second, Count: 3})
+	dialer, err = NewDirectDialer(DialerOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, dialer.KeepAlive, time.Duration(-1))
+	assert.Equal(t, dialer.KeepAliveConfig.Enable, false)
+}
+
+func TestNewDirectDialerInvalid(t *testing.T) {
+	_, err := NewDirectDialer(DialerOptions{LocalAddr: "localhost"})
+	assert.Equal(t, errors.Is(err, ErrInvalidAddress), true)
+	_, err = NewDirectDialer(DialerOptions{Interface: "nonexistent0"})
+	assert.NotNil(t, err)
+}
+
+func TestNewDirectDialerLocalAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	dialer, err := NewDirectDialer(DialerOptions{LocalAddr: "127.0.0.1"})
+	assert.Nil(t, err)
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	assert.Nil(t, err)
+	defer accepted.Close()
+	assert.Equal(t, accepted.RemoteAddr().(*net.TCPAddr).IP.String(), "127.0.0.1")
+}
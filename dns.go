@@ -0,0 +1,389 @@
+package httprelay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cobratbq/goutils/std/errors"
+	io_ "github.com/cobratbq/goutils/std/io"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNS protocols supported by DNSResolver.
+const (
+	DNSProtocolUDP   = "udp"
+	DNSProtocolTCP   = "tcp"
+	DNSProtocolTLS   = "tls"
+	DNSProtocolHTTPS = "https"
+)
+
+// defaultDNSTimeout is the timeout for a lookup in case the context does not have a deadline.
+const defaultDNSTimeout = 5 * time.Second
+
+// maxDNSMessageSize is the maximum size of a DNS message.
+const maxDNSMessageSize = 65535
+
+// DNSResolver resolves host names by querying a specific DNS server for A and AAAA records. The
+// DNS server must provide recursive resolution.
+type DNSResolver struct {
+	// Protocol is one of "udp", "tcp", "tls" (DNS-over-TLS, RFC 7858) or "https" (DNS-over-HTTPS,
+	// RFC 8484). Truncated responses over UDP are retried over TCP.
+	Protocol string
+	// Server is the address (host:port) of the DNS server, or the URL of the DNS-over-HTTPS
+	// endpoint. The host name of the server itself is resolved by the system resolver.
+	Server string
+	// TLSConfig is the configuration for DNS-over-TLS. If nil, the server's host is verified
+	// against the system roots.
+	TLSConfig *tls.Config
+	// Dialer (optional) connects to the DNS server, such as a dialer created by NewDirectDialer. For
+	// DNS-over-HTTPS, Client must be created with NewDNSClient on the same dialer instead.
+	Dialer *net.Dialer
+	// Client is the HTTP client for DNS-over-HTTPS. If nil, a client created by NewDNSClient on a
+	// default dialer is used.
+	Client *http.Client
+}
+
+// NewDNSClient creates an HTTP client for DNS-over-HTTPS that connects using the dialer. The client
+// never uses a proxy, not even one configured in the environment.
+func NewDNSClient(dialer *net.Dialer) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext:         dialer.DialContext,
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}}
+}
+
+// defaultDNSClient is the client for DNS-over-HTTPS if DNSResolver.Client is nil.
+var defaultDNSClient = NewDNSClient(new(net.Dialer))
+
+// ParseDNSServer parses the specification of a DNS server: `udp://host[:port]`,
+// `tcp://host[:port]`, `tls://host[:port]` or an `https://` URL of a DNS-over-HTTPS endpoint. A
+// bare `host[:port]` is queried over UDP. Default ports are 53 and 853 for DNS-over-TLS.
+func ParseDNSServer(spec string) (*DNSResolver, error) {
+	if !strings.Contains(spec, "://") {
+		return &DNSResolver{Protocol: DNSProtocolUDP, Server: fullHost(spec, "53")}, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, errors.Context(ErrInvalidDNSServer, err.Error())
+	}
+	if u.Host == "" {
+		return nil, errors.Context(ErrInvalidDNSServer, "missing host in '"+spec+"'")
+	}
+	switch u.Scheme {
+	case DNSProtocolUDP, DNSProtocolTCP:
+		return &DNSResolver{Protocol: u.Scheme, Server: fullHost(u.Host, "53")}, nil
+	case DNSProtocolTLS:
+		return &DNSResolver{Protocol: u.Scheme, Server: fullHost(u.Host, "853")}, nil
+	case DNSProtocolHTTPS:
+		return &DNSResolver{Protocol: u.Scheme, Server: spec}, nil
+	default:
+		return nil, errors.Context(ErrInvalidDNSServer, "unsupported protocol '"+u.Scheme+"'")
+	}
+}
+
+// ErrInvalidDNSServer indicates that the specification of a DNS server is invalid.
+var ErrInvalidDNSServer = errors.NewStringError("invalid DNS server")
+
+// ErrInvalidDNSResponse indicates that the DNS server's response is invalid or does not match the
+// query.
+var ErrInvalidDNSResponse = errors.NewStringError("invalid DNS response")
+
+// LookupIPAddr looks up the IP addresses of the host.
+func (r *DNSResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+// LookupIPAddrTTL looks up the IP addresses of the host, and reports for how long the result may
+// be cached. For non-existent hosts, the TTL is derived from the SOA record (RFC 2308), if
+// provided.
+func (r *DNSResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDNSTimeout)
+		defer cancel()
+	}
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: r.Server}
+	}
+	// Query A and AAAA records concurrently, such that a lookup takes a single round-trip.
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	results := make([]dnsResult, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = r.query(ctx, name, qtype)
+		}()
+	}
+	wg.Wait()
+	var addrs []net.IPAddr
+	var ttl, negativeTTL uint32 = math.MaxUint32, math.MaxUint32
+	var lastErr error
+	for i, result := range results {
+		if errs[i] != nil {
+			lastErr = errs[i]
+		} else if len(result.addrs) > 0 {
+			addrs = append(addrs, result.addrs...)
+			ttl = min(ttl, result.ttl)
+		} else {
+			negativeTTL = min(negativeTTL, result.ttl)
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, time.Duration(ttl) * time.Second, nil
+	}
+	if lastErr != nil {
+		return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: host, Server: r.Server, IsTemporary: true}
+	}
+	return nil, time.Duration(negativeTTL) * time.Second,
+		&net.DNSError{Err: "no such host", Name: host, Server: r.Server, IsNotFound: true}
+}
+
+// dnsResult is the result of a single query. An empty result is a negative answer, with the TTL
+// for negative caching.
+type dnsResult struct {
+	addrs []net.IPAddr
+	ttl   uint32
+}
+
+// query queries the DNS server for records of the type.
+func (r *DNSResolver) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (dnsResult, error) {
+	var id uint16
+	if r.Protocol != DNSProtocolHTTPS {
+		// DNS-over-HTTPS uses ID 0 for cache-friendliness (RFC 8484, section 4.1).
+		var random [2]byte
+		if _, err := rand.Read(random[:]); err != nil {
+			return dnsResult{}, err
+		}
+		id = binary.BigEndian.Uint16(random[:])
+	}
+	question := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return dnsResult{}, err
+	}
+	var response []byte
+	switch r.Protocol {
+	case DNSProtocolUDP:
+		response, err = r.exchangeUDP(ctx, packed, id)
+		if err == nil && isTruncated(response) {
+			response, err = r.exchangeStream(ctx, packed, false)
+		}
+	case DNSProtocolTCP:
+		response, err = r.exchangeStream(ctx, packed, false)
+	case DNSProtocolTLS:
+		response, err = r.exchangeStream(ctx, packed, true)
+	case DNSProtocolHTTPS:
+		response, err = r.exchangeHTTPS(ctx, packed)
+	default:
+		err = errors.Context(ErrInvalidDNSServer, "unsupported protocol '"+r.Protocol+"'")
+	}
+	if err != nil {
+		return dnsResult{}, err
+	}
+	return parseDNSResponse(response, id, question)
+}
+
+// isTruncated checks whether the response has the truncated-flag set.
+func isTruncated(response []byte) bool {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	return err == nil && header.Truncated
+}
+
+// dialer returns the dialer for connecting to the DNS server over the network. A local address is
+// converted to the address type of the network, as the dialer refuses mismatched types.
+func (r *DNSResolver) dialer(network string) *net.Dialer {
+	if r.Dialer == nil {
+		return new(net.Dialer)
+	}
+	dialer := *r.Dialer
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); ok && network == "udp" {
+		dialer.LocalAddr = &net.UDPAddr{IP: local.IP, Zone: local.Zone}
+	}
+	return &dialer
+}
+
+// exchangeUDP sends the query over UDP and waits for the response with matching ID. Responses with
+// other IDs are ignored.
+func (r *DNSResolver) exchangeUDP(ctx context.Context, query []byte, id uint16) ([]byte, error) {
+	conn, err := r.dialer("udp").DialContext(ctx, "udp", r.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer io_.CloseLogged(conn, "Failed to close DNS connection: %+v")
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, maxDNSMessageSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		if n >= 2 && binary.BigEndian.Uint16(buffer) == id {
+			return buffer[:n], nil
+		}
+	}
+}
+
+// exchangeStream sends the query over TCP, or TLS if secure, using two-octet length-prefixed
+// messages.
+func (r *DNSResolver) exchangeStream(ctx context.Context, query []byte, secure bool) ([]byte, error) {
+	conn, err := r.dialer("tcp").DialContext(ctx, "tcp", r.Server)
+	if err != nil {
+		return nil, err
+	}
+	if secure {
+		config := r.TLSConfig
+		if config == nil {
+			config = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName = hostname(r.Server)
+		}
+		conn = tls.Client(conn, config)
+	}
+	defer io_.CloseLogged(conn, "Failed to close DNS connection: %+v")
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	message := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := conn.Write(append(message, query...)); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// exchangeHTTPS sends the query as a DNS-over-HTTPS POST request.
+func (r *DNSResolver) exchangeHTTPS(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.Server, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	client := r.Client
+	if client == nil {
+		client = defaultDNSClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer io_.CloseLogged(resp.Body, "Failed to close DNS-over-HTTPS response body: %+v")
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Context(ErrInvalidDNSResponse, "DNS-over-HTTPS status "+resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+}
+
+// parseDNSResponse parses the response to the query, extracting the addresses of answers of the
+// queried type. The TTL is the minimum TTL of all answers, including CNAME records, or for negative
+// answers, the negative caching TTL derived from the SOA record.
+func parseDNSResponse(response []byte, id uint16, question dnsmessage.Question) (dnsResult, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return dnsResult{}, errors.Context(ErrInvalidDNSResponse, err.Error())
+	}
+	if !header.Response || header.ID != id {
+		return dnsResult{}, errors.Context(ErrInvalidDNSResponse, "response does not match query")
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return dnsResult{}, errors.Context(ErrInvalidDNSResponse, err.Error())
+	}
+	if len(questions) != 1 || questions[0].Type != question.Type ||
+		!strings.EqualFold(questions[0].Name.String(), question.Name.String()) {
+		return dnsResult{}, errors.Context(ErrInvalidDNSResponse, "response does not match question")
+	}
+	if header.RCode != dnsmessage.RCodeSuccess && header.RCode != dnsmessage.RCodeNameError {
+		return dnsResult{}, errors.Context(ErrInvalidDNSResponse, "response code "+header.RCode.String())
+	}
+	var result dnsResult
+	result.ttl = math.MaxUint32
+	for {
+		answer, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return dnsResult{}, errors.Context(ErrInvalidDNSResponse, err.Error())
+		}
+		result.ttl = min(result.ttl, answer.TTL)
+		switch {
+		case answer.Type == dnsmessage.TypeA && question.Type == dnsmessage.TypeA:
+			resource, err := parser.AResource()
+			if err != nil {
+				return dnsResult{}, errors.Context(ErrInvalidDNSResponse, err.Error())
+			}
+			result.addrs = append(result.addrs, net.IPAddr{IP: net.IP(resource.A[:])})
+		case answer.Type == dnsmessage.TypeAAAA && question.Type == dnsmessage.TypeAAAA:
+			resource, err := parser.AAAAResource()
+			if err != nil {
+				return dnsResult{}, errors.Context(ErrInvalidDNSResponse, err.Error())
+			}
+			result.addrs = append(result.addrs, net.IPAddr{IP: net.IP(resource.AAAA[:])})
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return dnsResult{}, errors.Context(ErrInvalidDNSResponse, err.Error())
+			}
+		}
+	}
+	if len(result.addrs) > 0 {
+		return result, nil
+	}
+	// Negative answer: TTL from the SOA record in the authority section, or 0 if absent.
+	result.ttl = 0
+	for {
+		authority, err := parser.AuthorityHeader()
+		if err != nil {
+			break
+		}
+		if authority.Type != dnsmessage.TypeSOA {
+			if parser.SkipAuthority() != nil {
+				break
+			}
+			continue
+		}
+		soa, err := parser.SOAResource()
+		if err != nil {
+			break
+		}
+		result.ttl = min(authority.TTL, soa.MinTTL)
+		break
+	}
+	return result, nil
+}
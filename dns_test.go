@@ -0,0 +1,319 @@
+package httprelay
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestParseDNSServer(t *testing.T) {
+	for spec, expected := range map[string]DNSResolver{
+		"9.9.9.9":                                {Protocol: "udp", Server: "9.9.9.9:53"},
+		"[2620:fe::fe]:5353":                     {Protocol: "udp", Server: "[2620:fe::fe]:5353"},
+		"tcp://9.9.9.9":                          {Protocol: "tcp", Server: "9.9.9.9:53"},
+		"tls://dns.quad9.net":                    {Protocol: "tls", Server: "dns.quad9.net:853"},
+		"https://dns.quad9.net/dns-query":        {Protocol: "https", Server: "https://dns.quad9.net/dns-query"},
+		"https://dns.quad9.net:5443/dns-query?x": {Protocol: "https", Server: "https://dns.quad9.net:5443/dns-query?x"},
+	} {
+		resolver, err := ParseDNSServer(spec)
+		assert.Nil(t, err)
+		assert.Equal(t, *resolver, expected)
+	}
+	for _, spec := range []string{"quic://9.9.9.9", "udp://", "https://"} {
+		_, err := ParseDNSServer(spec)
+		assert.Equal(t, errors.Is(err, ErrInvalidDNSServer), true)
+	}
+}
+
+func TestDNSResolverUDP(t *testing.T) {
+	server := testDNSServer(t)
+	resolver := DNSResolver{Protocol: DNSProtocolUDP, Server: server}
+	addrs, ttl, err := resolver.LookupIPAddrTTL(context.Background(), "www.Example.test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 2)
+	assert.Equal(t, addrs[0].String(), "192.0.2.1")
+	assert.Equal(t, addrs[1].String(), "2001:db8::1")
+	assert.Equal(t, ttl, 60*time.Second)
+}
+
+func TestDNSResolverNotFound(t *testing.T) {
+	server := testDNSServer(t)
+	resolver := DNSResolver{Protocol: DNSProtocolUDP, Server: server}
+	_, ttl, err := resolver.LookupIPAddrTTL(context.Background(), "missing.test")
+	var dnsErr *net.DNSError
+	assert.Equal(t, errors.As(err, &dnsErr), true)
+	assert.Equal(t, dnsErr.IsNotFound, true)
+	assert.Equal(t, ttl, 15*time.Second)
+}
+
+func TestDNSResolverTruncatedRetriesTCP(t *testing.T) {
+	server := testDNSServer(t)
+	resolver := DNSResolver{Protocol: DNSProtocolUDP, Server: server}
+	addrs, err := resolver.LookupIPAddr(context.Background(), "big.test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 1)
+	assert.Equal(t, addrs[0].String(), "192.0.2.99")
+}
+
+func TestDNSResolverTCP(t *testing.T) {
+	server := testDNSServer(t)
+	resolver := DNSResolver{Protocol: DNSProtocolTCP, Server: server}
+	addrs, err := resolver.LookupIPAddr(context.Background(), "www.example.test.")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 2)
+	// The TTL of the CNAME record limits the TTL of the result.
+	addrs, ttl, err := resolver.LookupIPAddrTTL(context.Background(), "alias.test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 2)
+	assert.Equal(t, ttl, 30*time.Second)
+}
+
+func TestDNSResolverTLS(t *testing.T) {
+	// httptest provides a certificate for 127.0.0.1 and a client configuration that trusts it.
+	https := httptest.NewTLSServer(http.NotFoundHandler())
+	defer https.Close()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", https.TLS)
+	assert.Nil(t, err)
+	defer listener.Close()
+	go testDNSServeStream(listener)
+	clientConfig := https.Client().Transport.(*http.Transport).TLSClientConfig
+	resolver := DNSResolver{Protocol: DNSProtocolTLS, Server: listener.Addr().String(), TLSConfig: clientConfig}
+	addrs, err := resolver.LookupIPAddr(context.Background(), "www.example.test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 2)
+	// The server's certificate must be trusted.
+	resolver.TLSConfig = nil
+	_, err = resolver.LookupIPAddr(context.Background(), "www.example.test")
+	assert.NotNil(t, err)
+}
+
+func TestDNSResolverHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/dns-message" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(req.Body)
+		if binary.BigEndian.Uint16(query) != 0 {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp.Header().Set("Content-Type", "application/dns-message")
+		resp.Write(testDNSAnswer(query, false))
+	}))
+	defer server.Close()
+	resolver := DNSResolver{Protocol: DNSProtocolHTTPS, Server: server.URL + "/dns-query", Client: server.Client()}
+	addrs, err := resolver.LookupIPAddr(context.Background(), "www.example.test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 2)
+}
+
+func TestDNSResolverDialer(t *testing.T) {
+	var mutex sync.Mutex
+	dialed := make(map[string]struct{})
+	dialer, err := NewDirectDialer(DialerOptions{LocalAddr: "127.0.0.1"})
+	assert.Nil(t, err)
+	dialer.Control = func(network, address string, c syscall.RawConn) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		dialed[network] = struct{}{}
+		return nil
+	}
+	// Truncated responses over UDP are retried over TCP, so both use the dialer.
+	resolver := DNSResolver{Protocol: DNSProtocolUDP, Server: testDNSServer(t), Dialer: dialer}
+	addrs, err := resolver.LookupIPAddr(context.Background(), "big.test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 1)
+	assert.KeyPresent(t, dialed, "udp4")
+	assert.KeyPresent(t, dialed, "tcp4")
+}
+
+func TestDNSClientIgnoresProxyEnvironment(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "http://127.0.0.1:1")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		query, _ := io.ReadAll(req.Body)
+		resp.Header().Set("Content-Type", "application/dns-message")
+		resp.Write(testDNSAnswer(query, false))
+	}))
+	defer server.Close()
+	client := NewDNSClient(new(net.Dialer))
+	client.Transport.(*http.Transport).TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig
+	resolver := DNSResolver{Protocol: DNSProtocolHTTPS, Server: server.URL + "/dns-query", Client: client}
+	addrs, err := resolver.LookupIPAddr(context.Background(), "www.example.test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 2)
+}
+
+func TestDNSResolverMismatchedResponse(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	go func() {
+		buffer := make([]byte, maxDNSMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			// Answer with the right ID, but for a different question.
+			query := dnsmessage.Message{}
+			query.Unpack(buffer[:n])
+			query.Questions[0].Name = dnsmessage.MustNewName("www.example.test.")
+			packed, _ := query.Pack()
+			conn.WriteTo(testDNSAnswer(packed, true), addr)
+		}
+	}()
+	resolver := DNSResolver{Protocol: DNSProtocolUDP, Server: conn.LocalAddr().String()}
+	_, err = resolver.LookupIPAddr(context.Background(), "other.test")
+	assert.NotNil(t, err)
+}
+
+func TestDNSResolverConcurrentQueries(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	go func() {
+		// Answer only once both queries are received, such that sequential queries time out.
+		type pending struct {
+			query []byte
+			addr  net.Addr
+		}
+		var queries []pending
+		for {
+			buffer := make([]byte, maxDNSMessageSize)
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			queries = append(queries, pending{query: buffer[:n], addr: addr})
+			if len(queries) < 2 {
+				continue
+			}
+			for _, pending := range queries {
+				conn.WriteTo(testDNSAnswer(pending.query, true), pending.addr)
+			}
+			queries = nil
+		}
+	}()
+	resolver := DNSResolver{Protocol: DNSProtocolUDP, Server: conn.LocalAddr().String()}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	addrs, err := resolver.LookupIPAddr(ctx, "www.example.test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 2)
+	assert.Equal(t, addrs[0].String(), "192.0.2.1")
+	assert.Equal(t, addrs[1].String(), "2001:db8::1")
+}
+
+// testDNSServer starts a stub DNS server on the same port for UDP and TCP.
+func testDNSServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	conn, err := net.ListenPacket("udp", listener.Addr().String())
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go testDNSServeStream(listener)
+	go func() {
+		buffer := make([]byte, maxDNSMessageSize)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(testDNSAnswer(buffer[:n], true), addr)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// testDNSServeStream serves DNS queries over the stream-based connections of the listener.
+func testDNSServeStream(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			for {
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				answer := testDNSAnswer(query, false)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...))
+			}
+		}()
+	}
+}
+
+// testDNSAnswer answers queries for the stub zone `test.`:
+//   - www.example.test: A 192.0.2.1 and AAAA 2001:db8::1, TTL 60 and 120 seconds.
+//   - alias.test: CNAME to www.example.test, TTL 30 seconds.
+//   - big.test: A 192.0.2.99, truncated over UDP.
+//   - other names do not exist, with negative TTL 15 seconds.
+func testDNSAnswer(query []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	question := msg.Questions[0]
+	msg.Header.Response = true
+	msg.Header.RecursionAvailable = true
+	name := dnsmessage.MustNewName("www.example.test.")
+	switch {
+	case equalFoldName(question.Name, "www.example.test."), equalFoldName(question.Name, "alias.test."):
+		if equalFoldName(question.Name, "alias.test.") {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: 30},
+				Body:   &dnsmessage.CNAMEResource{CNAME: name}})
+		}
+		if question.Type == dnsmessage.TypeA {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}})
+		} else if question.Type == dnsmessage.TypeAAAA {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: name, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET, TTL: 120},
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}})
+		}
+	case equalFoldName(question.Name, "big.test."):
+		if udp {
+			msg.Header.Truncated = true
+		} else if question.Type == dnsmessage.TypeA {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 99}}})
+		}
+	default:
+		msg.Header.RCode = dnsmessage.RCodeNameError
+		msg.Authorities = append(msg.Authorities, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("test."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body: &dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.test."), MBox: dnsmessage.MustNewName("admin.test."),
+				Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 15}})
+	}
+	packed, _ := msg.Pack()
+	return packed
+}
+
+func equalFoldName(name dnsmessage.Name, expected string) bool {
+	return strings.EqualFold(name.String(), expected)
+}
@@ -0,0 +1,314 @@
+package httprelay
+
+import (
+	"bytes"
+	"net/netip"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// domainTable is a compact, immutable set of host names. Names are stored with their labels
+// reversed, e.g. `com.example.www`, sorted and deduplicated, as a single string table with offsets.
+// Lookups use binary search. Compared to a map with string keys, this avoids the per-entry string
+// headers, allocations and bucket overhead, which matters for lists with millions of entries.
+type domainTable struct {
+	// data contains the concatenated reversed names.
+	data []byte
+	// offsets contains the start offset of each name in data, followed by the length of data.
+	offsets []uint32
+	// bloom is an (optional) prefilter that rejects most absent names without binary search.
+	bloom bloomFilter
+}
+
+// maxHostLength is the maximum length of a host name for which lookups avoid allocation.
+const maxHostLength = 256
+
+// domainTableBuilder collects names for a domainTable. Names are appended, reversed, to a single
+// buffer as they are added, such that building a table does not require a set of strings.
+type domainTableBuilder struct {
+	// data contains the concatenated reversed names, in order of adding.
+	data []byte
+	// names contains the start and end offset of each name in data.
+	names []nameSpan
+}
+
+// nameSpan is the start and end offset of a name in the data of a domainTableBuilder.
+type nameSpan struct {
+	start, end uint32
+}
+
+// add adds the (normalized) name.
+func (b *domainTableBuilder) add(name string) {
+	start := uint32(len(b.data))
+	b.data = appendReversedLabels(b.data, name)
+	b.names = append(b.names, nameSpan{start: start, end: uint32(len(b.data))})
+}
+
+// build sorts and deduplicates the names into a table, optionally with a Bloom filter as
+// prefilter. The builder is emptied.
+func (b *domainTableBuilder) build(bloom bool) domainTable {
+	at := func(span nameSpan) []byte { return b.data[span.start:span.end] }
+	sort.Slice(b.names, func(i, j int) bool { return bytes.Compare(at(b.names[i]), at(b.names[j])) < 0 })
+	var table domainTable
+	if len(b.names) > 0 {
+		table = domainTable{data: make([]byte, 0, len(b.data)), offsets: make([]uint32, 0, len(b.names)+1)}
+	}
+	for i, span := range b.names {
+		if i > 0 && bytes.Equal(at(b.names[i-1]), at(span)) {
+			continue
+		}
+		table.offsets = append(table.offsets, uint32(len(table.data)))
+		table.data = append(table.data, at(span)...)
+	}
+	*b = domainTableBuilder{}
+	if table.offsets == nil {
+		return table
+	}
+	table.offsets = append(table.offsets, uint32(len(table.data)))
+	if bloom {
+		table.bloom = newBloomFilter(table.Len())
+		for i := 0; i < table.Len(); i++ {
+			table.bloom.add(table.at(i))
+		}
+	}
+	return table
+}
+
+// Len returns the number of names.
+func (t *domainTable) Len() int {
+	if len(t.offsets) == 0 {
+		return 0
+	}
+	return len(t.offsets) - 1
+}
+
+// at returns the reversed name at the index.
+func (t *domainTable) at(i int) []byte {
+	return t.data[t.offsets[i]:t.offsets[i+1]]
+}
+
+// name returns the name at the index, in its original form.
+func (t *domainTable) name(i int) string {
+	return string(appendReversedLabels(nil, string(t.at(i))))
+}
+
+// index returns the index of the reversed name, or -1 if absent.
+func (t *domainTable) index(reversed []byte) int {
+	if !t.bloom.mayContain(reversed) {
+		return -1
+	}
+	n := t.Len()
+	i := sort.Search(n, func(i int) bool { return bytes.Compare(t.at(i), reversed) >= 0 })
+	if i < n && bytes.Equal(t.at(i), reversed) {
+		return i
+	}
+	return -1
+}
+
+// matchExactIndex returns the index of the (normalized) host, or -1 if absent.
+func (t *domainTable) matchExactIndex(host string) int {
+	if t.Len() == 0 {
+		return -1
+	}
+	var buffer [maxHostLength]byte
+	return t.index(appendReversedLabels(buffer[:0], host))
+}
+
+// matchDomainIndex returns the index of the (normalized) host, or otherwise of its closest parent
+// domain that is present, or -1 if absent.
+func (t *domainTable) matchDomainIndex(host string) int {
+	if t.Len() == 0 {
+		return -1
+	}
+	var buffer [maxHostLength]byte
+	reversed := appendReversedLabels(buffer[:0], host)
+	if isIPLiteral(host) {
+		// IP literals have no parent domains.
+		return t.index(reversed)
+	}
+	// Parent domains are the prefixes of the reversed name that end at a label boundary.
+	for end := len(reversed); end > 0; end = bytes.LastIndexByte(reversed[:end], '.') {
+		if i := t.index(reversed[:end]); i >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// isIPLiteral checks whether the host is an IP literal. Host names are excluded without parsing, as
+// parsing allocates an error for anything other than an IP literal.
+func isIPLiteral(host string) bool {
+	last := host[strings.LastIndexByte(host, '.')+1:]
+	if !strings.Contains(host, ":") && (last == "" || strings.Trim(last, "0123456789") != "") {
+		return false
+	}
+	_, err := netip.ParseAddr(host)
+	return err == nil
+}
+
+// appendReversedLabels appends the name with its labels in reverse order, e.g. `www.example.com`
+// becomes `com.example.www`.
+func appendReversedLabels(dst []byte, name string) []byte {
+	for {
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			return append(dst, name...)
+		}
+		dst = append(dst, name[i+1:]...)
+		dst = append(dst, '.')
+		name = name[:i]
+	}
+}
+
+// bloomBitsPerEntry is the size of the Bloom filter per entry. With bloomHashes hash functions, the
+// false positive rate is roughly 1%.
+const bloomBitsPerEntry = 10
+
+// bloomHashes is the number of hash functions of the Bloom filter.
+const bloomHashes = 7
+
+// bloomFilter is a Bloom filter using double hashing of the 64-bit FNV-1a hash. A nil filter may
+// contain any value.
+type bloomFilter []uint64
+
+// newBloomFilter creates a Bloom filter sized for the number of entries.
+func newBloomFilter(entries int) bloomFilter {
+	return make(bloomFilter, (entries*bloomBitsPerEntry+63)/64+1)
+}
+
+// bloomHash returns the pair of hashes from which the bit indexes are derived. The 64-bit FNV-1a
+// hash is computed inline, such that lookups do not allocate.
+func bloomHash(value []byte) (uint64, uint64) {
+	sum := uint64(fnvOffset64)
+	for _, b := range value {
+		sum ^= uint64(b)
+		sum *= fnvPrime64
+	}
+	return sum, sum>>32 | sum<<32 | 1
+}
+
+// FNV-1a parameters for 64-bit hashes.
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// add adds the value to the filter.
+func (f bloomFilter) add(value []byte) {
+	h1, h2 := bloomHash(value)
+	bits := uint64(len(f)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % bits
+		f[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// mayContain checks whether the filter may contain the value.
+func (f bloomFilter) mayContain(value []byte) bool {
+	if len(f) == 0 {
+		return true
+	}
+	h1, h2 := bloomHash(value)
+	bits := uint64(len(f)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % bits
+		if f[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// blocklistEntries are the entries of a loaded blocklist in compact form.
+type blocklistEntries struct {
+	list       domainTable
+	domains    domainTable
+	exceptions domainTable
+}
+
+// blocklistEntriesBuilder collects the entries of a blocklist while parsing, directly in the form
+// from which the compact entries are built.
+type blocklistEntriesBuilder struct {
+	list       domainTableBuilder
+	domains    domainTableBuilder
+	exceptions domainTableBuilder
+}
+
+func (b *blocklistEntriesBuilder) addHost(host string) {
+	b.list.add(host)
+}
+
+func (b *blocklistEntriesBuilder) addDomain(domain string) {
+	b.domains.add(domain)
+}
+
+func (b *blocklistEntriesBuilder) addException(domain string) {
+	b.exceptions.add(domain)
+}
+
+// build builds the compact entries. The builder is emptied.
+func (b *blocklistEntriesBuilder) build() *blocklistEntries {
+	return &blocklistEntries{
+		list:       b.list.build(true),
+		domains:    b.domains.build(true),
+		exceptions: b.exceptions.build(false),
+	}
+}
+
+// match returns the kind of rule and the entry that matches the (normalized) host. Equivalent to
+// BlocklistDialer.match.
+func (e *blocklistEntries) match(host string) (string, string) {
+	rule, table, i := e.matchIndex(host)
+	if table == nil {
+		return "", ""
+	}
+	entry := table.name(i)
+	runtime.KeepAlive(e)
+	return rule, entry
+}
+
+// matchBlock returns the kind of rule and the entry that blocks the (normalized) host, disregarding
+// exceptions.
+func (e *blocklistEntries) matchBlock(host string) (string, string) {
+	rule, table, i := e.matchBlockIndex(host)
+	if table == nil {
+		return "", ""
+	}
+	entry := table.name(i)
+	runtime.KeepAlive(e)
+	return rule, entry
+}
+
+// matchException returns the exception entry that matches the (normalized) host, or the empty
+// string if none matches.
+func (e *blocklistEntries) matchException(host string) string {
+	i := e.exceptions.matchDomainIndex(host)
+	if i < 0 {
+		return ""
+	}
+	entry := e.exceptions.name(i)
+	runtime.KeepAlive(e)
+	return entry
+}
+
+// matchIndex returns the kind of rule, and the table and index of the entry, that matches the
+// (normalized) host. Exceptions take precedence.
+func (e *blocklistEntries) matchIndex(host string) (string, *domainTable, int) {
+	if i := e.exceptions.matchDomainIndex(host); i >= 0 {
+		return ruleException, &e.exceptions, i
+	}
+	return e.matchBlockIndex(host)
+}
+
+// matchBlockIndex returns the kind of rule, and the table and index of the entry, that blocks the
+// (normalized) host, disregarding exceptions.
+func (e *blocklistEntries) matchBlockIndex(host string) (string, *domainTable, int) {
+	if i := e.list.matchExactIndex(host); i >= 0 {
+		return ruleHost, &e.list, i
+	}
+	if i := e.domains.matchDomainIndex(host); i >= 0 {
+		return ruleDomain, &e.domains, i
+	}
+	return "", nil, -1
+}
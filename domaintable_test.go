@@ -0,0 +1,188 @@
+package httprelay
+
+import (
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/cobratbq/goutils/std/builtin/set"
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+// newDomainTable creates a table of the names, optionally with a Bloom filter as prefilter.
+func newDomainTable(names map[string]struct{}, bloom bool) domainTable {
+	var builder domainTableBuilder
+	for name := range names {
+		builder.add(name)
+	}
+	return builder.build(bloom)
+}
+
+// compactEntries converts the entry sets of the BlocklistDialer into compact form.
+func compactEntries(b *BlocklistDialer) *blocklistEntries {
+	var builder blocklistEntriesBuilder
+	for host := range b.List {
+		builder.addHost(host)
+	}
+	for domain := range b.Domains {
+		builder.addDomain(domain)
+	}
+	for domain := range b.Exceptions {
+		builder.addException(domain)
+	}
+	return builder.build()
+}
+
+func TestAppendReversedLabels(t *testing.T) {
+	assert.Equal(t, string(appendReversedLabels(nil, "www.example.com")), "com.example.www")
+	assert.Equal(t, string(appendReversedLabels(nil, "localhost")), "localhost")
+	assert.Equal(t, string(appendReversedLabels(nil, "::1")), "::1")
+	assert.Equal(t, string(appendReversedLabels([]byte("x:"), "a.b")), "x:b.a")
+}
+
+func TestIsIPLiteral(t *testing.T) {
+	for _, host := range []string{"1.2.3.4", "::1", "2001:db8::1"} {
+		assert.Equal(t, isIPLiteral(host), true)
+	}
+	for _, host := range []string{"example.com", "1.2.3.4.example", "1.2.3", "localhost", "example."} {
+		assert.Equal(t, isIPLiteral(host), false)
+	}
+}
+
+func TestDomainTable(t *testing.T) {
+	for _, bloom := range []bool{false, true} {
+		table := newDomainTable(set.Create("example.com", "ads.example.org", "1.2.3.4", "::1", "com.example"), bloom)
+		assert.Equal(t, table.Len(), 5)
+		assert.Equal(t, table.matchExactIndex("example.com") >= 0, true)
+		assert.Equal(t, table.matchExactIndex("www.example.com") >= 0, false)
+		assert.Equal(t, table.matchExactIndex("com.example") >= 0, true)
+		assert.Equal(t, table.matchExactIndex("example.org") >= 0, false)
+		assert.Equal(t, table.matchDomainIndex("www.example.com") >= 0, true)
+		assert.Equal(t, table.matchDomainIndex("notexample.com") >= 0, false)
+		assert.Equal(t, table.matchDomainIndex("tracker.ads.example.org") >= 0, true)
+		assert.Equal(t, table.matchDomainIndex("example.org") >= 0, false)
+		assert.Equal(t, table.matchDomainIndex("1.2.3.4") >= 0, true)
+		assert.Equal(t, table.matchDomainIndex("1.2.3.5") >= 0, false)
+		assert.Equal(t, table.matchDomainIndex("::1") >= 0, true)
+	}
+	var empty domainTable
+	assert.Equal(t, empty.Len(), 0)
+	assert.Equal(t, empty.matchDomainIndex("example.com") >= 0, false)
+	empty = newDomainTable(nil, true)
+	assert.Equal(t, empty.matchExactIndex("example.com") >= 0, false)
+}
+
+func TestDomainTableBuilderDeduplicates(t *testing.T) {
+	var builder domainTableBuilder
+	for _, name := range []string{"www.example.com", "example.com", "www.example.com", "a.example", "example.com"} {
+		builder.add(name)
+	}
+	table := builder.build(true)
+	assert.Equal(t, table.Len(), 3)
+	assert.Equal(t, table.name(0), "example.com")
+	assert.Equal(t, table.name(1), "www.example.com")
+	assert.Equal(t, table.name(2), "a.example")
+	assert.Equal(t, len(builder.names), 0)
+}
+
+func TestBloomFilter(t *testing.T) {
+	const entries = 10000
+	filter := newBloomFilter(entries)
+	for i := 0; i < entries; i++ {
+		filter.add([]byte("host" + strconv.Itoa(i) + ".example"))
+	}
+	var falsePositives int
+	for i := 0; i < entries; i++ {
+		assert.Equal(t, filter.mayContain([]byte("host"+strconv.Itoa(i)+".example")), true)
+		if filter.mayContain([]byte("other" + strconv.Itoa(i) + ".example")) {
+			falsePositives++
+		}
+	}
+	if falsePositives > entries/20 {
+		t.Errorf("Unexpectedly many false positives: %d", falsePositives)
+	}
+}
+
+func TestBlocklistEntriesMatchBlocklistDialer(t *testing.T) {
+	dialer := BlocklistDialer{List: make(map[string]struct{})}
+	dialer.addDomain("ads.example")
+	set.Insert(dialer.List, "tracker.example")
+	dialer.Exceptions = set.Create("good.ads.example")
+	entries := compactEntries(&dialer)
+	for _, host := range []string{"ads.example", "www.ads.example", "good.ads.example", "www.good.ads.example", "tracker.example", "www.tracker.example", "example"} {
+		rule, entry := dialer.match(host)
+		compactRule, compactEntry := entries.match(host)
+		assert.Equal(t, compactRule, rule)
+		assert.Equal(t, compactEntry, entry)
+	}
+}
+
+// benchmarkEntries is the number of entries in the benchmarked blocklists, the order of magnitude
+// of large lists such as EnergizedPro.
+const benchmarkEntries = 500000
+
+// benchmarkNames generates host names resembling blocklist entries.
+func benchmarkNames() map[string]struct{} {
+	names := make(map[string]struct{}, benchmarkEntries)
+	for i := 0; i < benchmarkEntries; i++ {
+		set.Insert(names, "ads"+strconv.Itoa(i)+".tracker"+strconv.Itoa(i%5000)+".example.com")
+	}
+	return names
+}
+
+// benchmarkHosts are looked up alternately: a present entry, a subdomain of a present entry and an
+// absent entry.
+var benchmarkHosts = []string{"ads4242.tracker4242.example.com", "www.ads77.tracker77.example.com", "www.example.org"}
+
+// heapInUse returns the heap in use after garbage collection.
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapInuse
+}
+
+func BenchmarkBlocklistMapMemory(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+		names := benchmarkNames()
+		b.ReportMetric(float64(heapInUse()-before)/benchmarkEntries, "bytes/entry")
+		runtime.KeepAlive(names)
+	}
+}
+
+func BenchmarkDomainTableMemory(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		before := heapInUse()
+		table := newDomainTable(benchmarkNames(), true)
+		b.ReportMetric(float64(heapInUse()-before)/benchmarkEntries, "bytes/entry")
+		runtime.KeepAlive(table)
+	}
+}
+
+func BenchmarkBlocklistMapLookup(b *testing.B) {
+	names := benchmarkNames()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matchingDomain(names, benchmarkHosts[i%len(benchmarkHosts)])
+	}
+}
+
+func BenchmarkDomainTableLookup(b *testing.B) {
+	table := newDomainTable(benchmarkNames(), false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.matchDomainIndex(benchmarkHosts[i%len(benchmarkHosts)])
+	}
+}
+
+func BenchmarkDomainTableBloomLookup(b *testing.B) {
+	table := newDomainTable(benchmarkNames(), true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		table.matchDomainIndex(benchmarkHosts[i%len(benchmarkHosts)])
+	}
+}
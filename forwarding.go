@@ -0,0 +1,118 @@
+package httprelay
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cobratbq/goutils/std/errors"
+)
+
+// viaHeader is the 'Via' header, which lists the intermediaries that a message passed through.
+const viaHeader = "Via"
+
+// appendVia appends an entry for this proxy to the Via header, according to RFC 9110, section
+// 7.6.3. The protocol name is omitted, as it is always HTTP.
+func appendVia(header http.Header, protoMajor, protoMinor int, receivedBy string) {
+	header.Add(viaHeader, strconv.Itoa(protoMajor)+"."+strconv.Itoa(protoMinor)+" "+receivedBy)
+}
+
+// viaContains checks whether any Via entry lists receivedBy as intermediary, which indicates that
+// the message passed through this proxy before.
+func viaContains(header http.Header, receivedBy string) bool {
+	for _, value := range header.Values(viaHeader) {
+		for _, entry := range strings.Split(value, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], receivedBy) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ErrLoopDetected indicates that a request was received that already passed through this proxy.
+var ErrLoopDetected = errors.NewStringError("loop detected: request already passed through this proxy")
+
+// ForwardedMode determines the treatment of the headers identifying the client to the origin
+// server: `Forwarded` (RFC 7239) and the de-facto standard `X-Forwarded-*` headers.
+type ForwardedMode uint
+
+const (
+	// ForwardedPreserve forwards the headers as received from the client.
+	ForwardedPreserve ForwardedMode = iota
+	// ForwardedStrip removes the headers such that the client is not identified.
+	ForwardedStrip
+	// ForwardedXFF appends the client address to the X-Forwarded-For header.
+	ForwardedXFF
+	// ForwardedRFC7239 appends an element for the client to the Forwarded header.
+	ForwardedRFC7239
+)
+
+// ParseForwardedMode parses the name of a forwarded mode: "preserve", "strip", "x-forwarded-for"
+// or "forwarded".
+func ParseForwardedMode(name string) (ForwardedMode, error) {
+	switch name {
+	case "preserve":
+		return ForwardedPreserve, nil
+	case "strip":
+		return ForwardedStrip, nil
+	case "x-forwarded-for":
+		return ForwardedXFF, nil
+	case "forwarded":
+		return ForwardedRFC7239, nil
+	default:
+		return ForwardedPreserve, errors.Context(ErrUnknownForwardedMode, "'"+name+"'")
+	}
+}
+
+// ErrUnknownForwardedMode indicates that the name of the forwarded mode is not known.
+var ErrUnknownForwardedMode = errors.NewStringError("unknown forwarded mode")
+
+// forwardedHeaders are the headers that identify the client and the original request.
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+// applyForwarded updates the headers of the request to the origin server according to mode.
+func applyForwarded(header http.Header, mode ForwardedMode, req *http.Request) {
+	switch mode {
+	case ForwardedStrip:
+		for _, name := range forwardedHeaders {
+			header.Del(name)
+		}
+	case ForwardedXFF:
+		if client := clientIP(req); client != nil {
+			appendToHeader(header, "X-Forwarded-For", client.String())
+		} else {
+			appendToHeader(header, "X-Forwarded-For", "unknown")
+		}
+	case ForwardedRFC7239:
+		node := "unknown"
+		if client := clientIP(req); client != nil && client.To4() != nil {
+			node = client.String()
+		} else if client != nil {
+			node = `"[` + client.String() + `]"`
+		}
+		proto := "http"
+		if req.TLS != nil {
+			proto = "https"
+		}
+		appendToHeader(header, "Forwarded", "for="+node+";proto="+proto)
+	}
+}
+
+// appendToHeader appends an element to a comma-separated list header, such that it ends up as a
+// single header line.
+func appendToHeader(header http.Header, name, element string) {
+	if values := header.Values(name); len(values) > 0 {
+		header.Set(name, strings.Join(values, ", ")+", "+element)
+	} else {
+		header.Set(name, element)
+	}
+}
+
+// clientIP returns the IP address of the client, or nil if the client is not connected over IP,
+// e.g. through a Unix domain socket.
+func clientIP(req *http.Request) net.IP {
+	return net.ParseIP(hostname(req.RemoteAddr))
+}
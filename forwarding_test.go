@@ -0,0 +1,100 @@
+package httprelay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestAppendVia(t *testing.T) {
+	header := http.Header{}
+	appendVia(header, 1, 1, "relay")
+	assert.Equal(t, header.Get("Via"), "1.1 relay")
+	appendVia(header, 1, 0, "other")
+	assert.Equal(t, len(header.Values("Via")), 2)
+	assert.Equal(t, header.Values("Via")[1], "1.0 other")
+}
+
+func TestViaContains(t *testing.T) {
+	header := http.Header{}
+	assert.Equal(t, viaContains(header, "relay"), false)
+	header.Add("Via", "1.0 fred, 1.1 p.example.net (Apache/1.1)")
+	assert.Equal(t, viaContains(header, "relay"), false)
+	assert.Equal(t, viaContains(header, "p.example.net"), true)
+	assert.Equal(t, viaContains(header, "FRED"), true)
+	header.Add("Via", "HTTP/1.1 Relay")
+	assert.Equal(t, viaContains(header, "relay"), true)
+}
+
+func TestParseForwardedMode(t *testing.T) {
+	var tests = map[string]ForwardedMode{
+		"preserve":        ForwardedPreserve,
+		"strip":           ForwardedStrip,
+		"x-forwarded-for": ForwardedXFF,
+		"forwarded":       ForwardedRFC7239,
+	}
+	for name, expected := range tests {
+		mode, err := ParseForwardedMode(name)
+		assert.Nil(t, err)
+		assert.Equal(t, mode, expected)
+	}
+	if _, err := ParseForwardedMode("bogus"); err == nil {
+		t.Fatal("Expected error for unknown mode.")
+	}
+}
+
+func TestApplyForwardedStrip(t *testing.T) {
+	header := http.Header{}
+	header.Set("Forwarded", "for=192.0.2.43")
+	header.Set("X-Forwarded-For", "192.0.2.43")
+	header.Set("X-Forwarded-Host", "example.com")
+	header.Set("X-Forwarded-Proto", "https")
+	header.Set("X-Real-IP", "192.0.2.43")
+	header.Set("Accept", "*/*")
+	applyForwarded(header, ForwardedStrip, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, len(header), 1)
+	assert.KeyPresent(t, header, "Accept")
+}
+
+func TestApplyForwardedXFF(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.60:12345"
+	header := http.Header{}
+	applyForwarded(header, ForwardedXFF, req)
+	assert.Equal(t, header.Get("X-Forwarded-For"), "192.0.2.60")
+	header = http.Header{}
+	header.Add("X-Forwarded-For", "198.51.100.17")
+	header.Add("X-Forwarded-For", "203.0.113.1")
+	req.RemoteAddr = "[2001:db8::1]:12345"
+	applyForwarded(header, ForwardedXFF, req)
+	assert.Equal(t, len(header.Values("X-Forwarded-For")), 1)
+	assert.Equal(t, header.Get("X-Forwarded-For"), "198.51.100.17, 203.0.113.1, 2001:db8::1")
+	header = http.Header{}
+	req.RemoteAddr = "@"
+	applyForwarded(header, ForwardedXFF, req)
+	assert.Equal(t, header.Get("X-Forwarded-For"), "unknown")
+}
+
+func TestApplyForwardedRFC7239(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.60:12345"
+	header := http.Header{}
+	applyForwarded(header, ForwardedRFC7239, req)
+	assert.Equal(t, header.Get("Forwarded"), "for=192.0.2.60;proto=http")
+	req.RemoteAddr = "[2001:db8:cafe::17]:4711"
+	applyForwarded(header, ForwardedRFC7239, req)
+	assert.Equal(t, header.Get("Forwarded"), `for=192.0.2.60;proto=http, for="[2001:db8:cafe::17]";proto=http`)
+	header = http.Header{}
+	req.RemoteAddr = ""
+	applyForwarded(header, ForwardedRFC7239, req)
+	assert.Equal(t, header.Get("Forwarded"), "for=unknown;proto=http")
+}
+
+func TestApplyForwardedPreserve(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Forwarded-For", "192.0.2.43")
+	applyForwarded(header, ForwardedPreserve, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert.Equal(t, header.Get("X-Forwarded-For"), "192.0.2.43")
+}
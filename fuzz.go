@@ -11,6 +11,6 @@ func Fuzz(data []byte) int {
 	if len(bad) == 0 {
 		return 1
 	}
-	fullHost(val)
+	fullHost(val, "80")
 	return 0
 }
@@ -6,5 +6,8 @@ toolchain go1.23.10
 
 require (
 	github.com/cobratbq/goutils v0.0.0-20250625015942-3ae7eff2ceb8
+	golang.org/x/crypto v0.39.0
 	golang.org/x/net v0.41.0
 )
+
+require golang.org/x/sys v0.33.0 // indirect
@@ -0,0 +1,316 @@
+package httprelay
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	stderrors "errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cobratbq/goutils/std/errors"
+	io_ "github.com/cobratbq/goutils/std/io"
+	"github.com/cobratbq/goutils/std/log"
+	http_ "github.com/cobratbq/goutils/std/net/http"
+)
+
+// ErrNotCA indicates that the certificate is not a certificate authority that can sign certificates.
+var ErrNotCA = errors.NewStringError("certificate is not a CA certificate")
+
+// leafValidity is the validity period of minted leaf certificates.
+const leafValidity = 7 * 24 * time.Hour
+
+// interceptSniffTimeout is the time to wait for the client to start sending in an intercepted
+// tunnel. If the client does not send, the protocol is assumed to be one where the server sends
+// first, and the tunnel is spliced instead of intercepted.
+const interceptSniffTimeout = 2 * time.Second
+
+// interceptHandshakeTimeout is the timeout for the TLS handshake with the client.
+const interceptHandshakeTimeout = 30 * time.Second
+
+// tlsRecordTypeHandshake is the first byte of a TLS ClientHello, i.e. a TLS handshake record.
+const tlsRecordTypeHandshake = 0x16
+
+// defaultInterceptCapacity is the maximum number of minted certificates that are cached.
+const defaultInterceptCapacity = 1024
+
+// Interceptor terminates TLS of tunneled connections, such that the tunneled requests can be
+// processed like plain proxied requests. Leaf certificates for the requested hosts are minted on
+// the fly, signed by the CA. Clients must trust the CA for interception to succeed.
+type Interceptor struct {
+	// CA is the certificate authority that signs the minted leaf certificates.
+	CA *x509.Certificate
+	// Key is the private key of the CA.
+	Key crypto.Signer
+	// Bypass lists the domains, including their subdomains, that are tunneled as-is instead of
+	// intercepted, e.g. for applications that pin certificates.
+	Bypass  []string
+	lock    sync.Mutex
+	leafKey crypto.Signer
+	index   *lruIndex
+	certs   map[string]*tls.Certificate
+	now     func() time.Time
+}
+
+// NewInterceptor creates an interceptor that mints certificates signed by the CA.
+func NewInterceptor(ca *x509.Certificate, key crypto.Signer) (*Interceptor, error) {
+	if !ca.IsCA || ca.KeyUsage != 0 && ca.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, errors.Context(ErrNotCA, "'"+ca.Subject.String()+"'")
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Context(err, "failed to generate key for leaf certificates")
+	}
+	return &Interceptor{CA: ca, Key: key, leafKey: leafKey, index: newLRUIndex(defaultInterceptCapacity),
+		certs: make(map[string]*tls.Certificate), now: time.Now}, nil
+}
+
+// LoadInterceptor creates an interceptor with the CA certificate and private key loaded from
+// PEM-encoded files.
+func LoadInterceptor(certFile, keyFile string) (*Interceptor, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Context(err, "failed to load CA certificate and key")
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, errors.Context(err, "failed to parse CA certificate")
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.Context(ErrNotCA, "unsupported private key")
+	}
+	return NewInterceptor(ca, key)
+}
+
+// bypassed checks whether the host, or any of its parent domains, is on the bypass list.
+func (i *Interceptor) bypassed(host string) bool {
+	host = normalizeHost(hostname(host))
+	for _, domain := range i.Bypass {
+		domain = strings.TrimPrefix(normalizeHost(strings.TrimSpace(domain)), ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate returns the certificate for the host, minting a new one if none is cached or if the
+// cached certificate passed half of its validity period.
+func (i *Interceptor) certificate(host string) (*tls.Certificate, error) {
+	host = normalizeHost(host)
+	now := i.now()
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if cert, ok := i.certs[host]; ok && now.Before(cert.Leaf.NotAfter.Add(-leafValidity/2)) {
+		i.index.touch(host)
+		return cert, nil
+	}
+	cert, err := i.mint(host, now)
+	if err != nil {
+		return nil, err
+	}
+	i.certs[host] = cert
+	for _, evicted := range i.index.add(host, 1) {
+		delete(i.certs, evicted)
+	}
+	return cert, nil
+}
+
+// mint creates a leaf certificate for the host, signed by the CA. The validity period does not
+// exceed that of the CA.
+func (i *Interceptor) mint(host string, now time.Time) (*tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Context(err, "failed to generate serial number")
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(i.CA.NotAfter) {
+		template.NotAfter = i.CA.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, i.CA, i.leafKey.Public(), i.Key)
+	if err != nil {
+		return nil, errors.Context(err, "failed to create certificate for '"+host+"'")
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Context(err, "failed to parse certificate for '"+host+"'")
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, i.CA.Raw}, PrivateKey: i.leafKey, Leaf: leaf}, nil
+}
+
+// processIntercept establishes the tunnel with the client, then terminates TLS using a minted
+// certificate and serves the tunneled requests as plain proxied requests for absolute `https://`
+// URIs. Consequently, these requests are re-originated through the dialer, using TLSConfig. Tunnels
+// that do not start with a TLS ClientHello, e.g. SSH, are spliced to the destination as-is.
+func (h *HTTPProxyHandler) processIntercept(resp http.ResponseWriter, req *http.Request) error {
+	defer io_.CloseLoggedWithIgnores(req.Body, "Error while closing request body: %+v", io.ErrClosedPipe)
+	log.Infoln(req.Proto, req.Method, req.URL.Host, "(intercepted)")
+	authority := req.Host
+	if host, port, err := net.SplitHostPort(authority); err == nil && port == "443" {
+		authority = host
+		if strings.IndexByte(host, ':') > -1 {
+			authority = "[" + host + "]"
+		}
+	}
+	// Check blocking before a certificate for the destination is presented to the client.
+	if err := checkHost(req.Context(), h.Dialer, req.Host, true); isBlocked(err) {
+		respondBlocked(resp, err)
+		return err
+	}
+	clientInput, clientConn, err := http_.HijackConnection(resp)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	established := "HTTP/1.1 200 Connection established\r\n"
+	if h.Via != "" {
+		established += viaHeader + ": " + strconv.Itoa(req.ProtoMajor) + "." + strconv.Itoa(req.ProtoMinor) + " " + h.Via + "\r\n"
+	}
+	if _, err = clientConn.Write([]byte(established + "\r\n")); err != nil {
+		io_.CloseLoggedWithIgnores(clientConn, "Failed to close connection to local client: %+v", io.ErrClosedPipe)
+		return err
+	}
+	config := tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return h.Interceptor.certificate(hello.ServerName)
+			}
+			return h.Interceptor.certificate(hostname(req.Host))
+		},
+	}
+	isTLS, err := sniffTLS(clientConn, clientInput.Reader)
+	if err != nil {
+		io_.CloseLoggedWithIgnores(clientConn, "Failed to close connection to local client: %+v", io.ErrClosedPipe)
+		return errors.Context(err, "failed to read from client for '"+req.Host+"'")
+	}
+	if !isTLS {
+		log.Infoln("Tunneling non-TLS connection to", req.Host, "without interception")
+		return h.spliceIntercepted(req, clientConn, clientInput)
+	}
+	tlsConn := tls.Server(&bufferedConn{Conn: clientConn, reader: clientInput}, &config)
+	handshakeCtx, cancel := context.WithTimeout(req.Context(), interceptHandshakeTimeout)
+	err = tlsConn.HandshakeContext(handshakeCtx)
+	cancel()
+	if err != nil {
+		io_.CloseLoggedWithIgnores(clientConn, "Failed to close connection to local client: %+v", io.ErrClosedPipe)
+		return errors.Context(err, "failed TLS handshake with client for '"+req.Host+"'")
+	}
+	// The server closes the connection once done serving requests.
+	listener := newSingleConnListener(tlsConn)
+	server := http.Server{
+		Handler: http.HandlerFunc(func(resp http.ResponseWriter, inner *http.Request) {
+			// Requests are directed at the tunnel's destination, regardless of their Host header.
+			inner.URL.Scheme = "https"
+			inner.URL.Host = authority
+			inner.RequestURI = inner.URL.String()
+			h.serve(resp, inner)
+		}),
+		BaseContext: func(net.Listener) context.Context { return req.Context() },
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	if err = server.Serve(listener); err != nil && err != net.ErrClosed {
+		return err
+	}
+	return nil
+}
+
+// sniffTLS checks whether the client starts the tunnel with a TLS handshake. A client that does not
+// send anything within interceptSniffTimeout is assumed to wait for the server.
+func sniffTLS(clientConn net.Conn, clientInput *bufio.Reader) (bool, error) {
+	clientConn.SetReadDeadline(time.Now().Add(interceptSniffTimeout))
+	first, err := clientInput.Peek(1)
+	clientConn.SetReadDeadline(time.Time{})
+	if stderrors.Is(err, os.ErrDeadlineExceeded) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return first[0] == tlsRecordTypeHandshake, nil
+}
+
+// spliceIntercepted dials the destination of the established tunnel and splices the connections.
+func (h *HTTPProxyHandler) spliceIntercepted(req *http.Request, clientConn net.Conn, clientInput io.Reader) error {
+	defer io_.CloseLoggedWithIgnores(clientConn, "Failed to close connection to local client: %+v", io.ErrClosedPipe)
+	proxyConn, err := dialContext(req.Context(), h.Dialer, "tcp", req.Host)
+	if err != nil {
+		return errors.Context(err, "failed to connect to host '"+req.Host+"'")
+	}
+	defer io_.CloseLoggedWithIgnores(proxyConn, "Failed to close connection to remote location: %+v", io.ErrClosedPipe)
+	splice(clientConn, clientInput, proxyConn)
+	return nil
+}
+
+// bufferedConn is a connection that reads from the reader, such that data buffered while reading
+// the request is not lost.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// singleConnListener is a listener that accepts the one connection, then blocks until closed.
+type singleConnListener struct {
+	conn   net.Conn
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	listener := singleConnListener{conn: conn, accept: make(chan net.Conn, 1), done: make(chan struct{})}
+	listener.accept <- conn
+	return &listener
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
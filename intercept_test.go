@@ -0,0 +1,202 @@
+package httprelay
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestNewInterceptorRequiresCA(t *testing.T) {
+	ca, key := testCA(t, true)
+	_, err := NewInterceptor(ca, key)
+	assert.Nil(t, err)
+	notCA, key := testCA(t, false)
+	_, err = NewInterceptor(notCA, key)
+	assert.NotNil(t, err)
+}
+
+func TestLoadInterceptor(t *testing.T) {
+	ca, key := testCA(t, true)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	interceptor, err := LoadInterceptor(certFile, keyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, interceptor.CA.Subject.CommonName, "httprelay test CA")
+	_, err = LoadInterceptor(filepath.Join(dir, "missing.pem"), keyFile)
+	assert.NotNil(t, err)
+}
+
+func TestInterceptorCertificate(t *testing.T) {
+	ca, key := testCA(t, true)
+	interceptor, err := NewInterceptor(ca, key)
+	assert.Nil(t, err)
+	now := time.Now()
+	interceptor.now = func() time.Time { return now }
+	cert, err := interceptor.certificate("Example.com")
+	assert.Nil(t, err)
+	assert.Nil(t, cert.Leaf.VerifyHostname("example.com"))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "example.com", CurrentTime: now})
+	assert.Nil(t, err)
+	// Minted certificates are cached until half of their validity period has passed.
+	cached, err := interceptor.certificate("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, cached, cert)
+	now = now.Add(leafValidity / 2)
+	renewed, err := interceptor.certificate("example.com")
+	assert.Nil(t, err)
+	if renewed == cert {
+		t.Error("Expected certificate to be renewed.")
+	}
+	cert, err = interceptor.certificate("192.0.2.1")
+	assert.Nil(t, err)
+	assert.Nil(t, cert.Leaf.VerifyHostname("192.0.2.1"))
+}
+
+func TestInterceptorBypassed(t *testing.T) {
+	interceptor := Interceptor{Bypass: []string{"pinned.example", ".Bank.example"}}
+	assert.Equal(t, interceptor.bypassed("pinned.example:443"), true)
+	assert.Equal(t, interceptor.bypassed("api.pinned.example:443"), true)
+	assert.Equal(t, interceptor.bypassed("www.bank.example:443"), true)
+	assert.Equal(t, interceptor.bypassed("notpinned.example:443"), false)
+	assert.Equal(t, interceptor.bypassed("example.com:443"), false)
+}
+
+func TestProxyHandlerIntercept(t *testing.T) {
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(resp, req.Host+req.URL.Path+" "+req.Header.Get("X-Rewritten"))
+	}))
+	defer origin.Close()
+	ca, key := testCA(t, true)
+	interceptor, err := NewInterceptor(ca, key)
+	assert.Nil(t, err)
+	interceptor.Bypass = []string{"pinned.example.com"}
+	originRoots := x509.NewCertPool()
+	originRoots.AddCert(origin.Certificate())
+	rules, err := LoadHeaderRules(strings.NewReader("[request]\nset X-Rewritten: yes\n"))
+	assert.Nil(t, err)
+	proxyServer := httptest.NewServer(&HTTPProxyHandler{
+		Dialer:      &TestRedirectDialer{addr: origin.Listener.Addr().String()},
+		TLSConfig:   &tls.Config{RootCAs: originRoots},
+		HeaderRules: rules,
+		Interceptor: interceptor,
+		Cache:       NewCache(NewMemoryStore(1 << 20)),
+	})
+	defer proxyServer.Close()
+	proxyURL, _ := url.Parse(proxyServer.URL)
+	clientRoots := x509.NewCertPool()
+	clientRoots.AddCert(ca)
+	client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: clientRoots}}}
+	resp, err := client.Get("https://example.com/intercepted")
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, string(body), "example.com/intercepted yes")
+	assert.Equal(t, resp.TLS.PeerCertificates[0].Issuer.CommonName, "httprelay test CA")
+	// Intercepted responses are not stored in the shared cache, unless explicitly public.
+	resp, err = client.Get("https://example.com/intercepted")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.Header.Get("X-Cache"), "MISS")
+	// Bypassed domains are tunneled, so the client sees the origin's certificate.
+	client = http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: originRoots, ServerName: "example.com"}}}
+	resp, err = client.Get("https://pinned.example.com/tunneled")
+	assert.Nil(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, string(body), "pinned.example.com/tunneled ")
+	assert.Equal(t, resp.TLS.PeerCertificates[0].Equal(origin.Certificate()), true)
+}
+
+func TestProxyHandlerInterceptBlocked(t *testing.T) {
+	ca, key := testCA(t, true)
+	interceptor, err := NewInterceptor(ca, key)
+	assert.Nil(t, err)
+	handler := HTTPProxyHandler{Dialer: WrapPerHostBlocking(&NopDialer{}, false, "blocked.example"), Interceptor: interceptor}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodConnect, "blocked.example:443", nil))
+	assert.Equal(t, recorder.Code, http.StatusForbidden)
+}
+
+func TestProxyHandlerInterceptNonTLS(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer origin.Close()
+	go func() {
+		conn, err := origin.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	ca, key := testCA(t, true)
+	interceptor, err := NewInterceptor(ca, key)
+	assert.Nil(t, err)
+	proxyServer := httptest.NewServer(&HTTPProxyHandler{
+		Dialer:      &TestRedirectDialer{addr: origin.Addr().String()},
+		TLSConfig:   &tls.Config{},
+		Interceptor: interceptor,
+	})
+	defer proxyServer.Close()
+	conn, err := net.Dial("tcp", proxyServer.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT example.com:22 HTTP/1.1\r\nHost: example.com:22\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	// The SSH banner is tunneled to the destination as-is.
+	io.WriteString(conn, "SSH-2.0-test\r\n")
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, line, "SSH-2.0-test\r\n")
+}
+
+// testCA creates a self-signed certificate, which is a CA certificate if requested.
+func testCA(t *testing.T, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httprelay test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key
+}
@@ -0,0 +1,122 @@
+package httprelay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"github.com/cobratbq/goutils/std/errors"
+	"golang.org/x/net/proxy"
+	"golang.org/x/net/publicsuffix"
+)
+
+// IsolationMode determines how connections are separated into isolated streams. Tor isolates
+// circuits by SOCKS5 credentials, therefore distinct credentials result in distinct circuits.
+type IsolationMode uint
+
+const (
+	// IsolationNone uses the same credentials for all connections.
+	IsolationNone IsolationMode = iota
+	// IsolationClient uses distinct credentials per client IP address.
+	IsolationClient
+	// IsolationUser uses distinct credentials per user, as verified by the handler from the
+	// Proxy-Authorization header. Requires proxy credentials (ProxyCredentials) for the handler, as
+	// otherwise user names are not available and all clients share the same credentials.
+	IsolationUser
+	// IsolationDestination uses distinct credentials per destination domain, i.e. the registrable
+	// domain ("eTLD+1") of the destination host, or the IP address itself.
+	IsolationDestination
+)
+
+// ParseIsolationMode parses the name of an isolation mode: "none", "client", "user" or
+// "destination".
+func ParseIsolationMode(name string) (IsolationMode, error) {
+	switch name {
+	case "none":
+		return IsolationNone, nil
+	case "client":
+		return IsolationClient, nil
+	case "user":
+		return IsolationUser, nil
+	case "destination":
+		return IsolationDestination, nil
+	default:
+		return IsolationNone, errors.Context(ErrUnknownIsolationMode, "'"+name+"'")
+	}
+}
+
+// ErrUnknownIsolationMode indicates that the name of the isolation mode is not known.
+var ErrUnknownIsolationMode = errors.NewStringError("unknown isolation mode")
+
+// IsolatingDialer dials through a SOCKS5 proxy using credentials derived from the isolation key of
+// each connection. Credentials are derived using a secret that is generated per dialer, such that
+// credentials do not reveal the isolation key to the SOCKS5 proxy and are not linkable across
+// restarts.
+//
+// IsolatingDialer does not resolve host names: host names are passed on to the SOCKS5 proxy.
+type IsolatingDialer struct {
+	address string
+	mode    IsolationMode
+	forward proxy.Dialer
+	secret  [32]byte
+}
+
+// NewIsolatingDialer creates a dialer for the SOCKS5 proxy at address, which isolates connections
+// according to mode. The forward dialer is used to connect to the SOCKS5 proxy.
+func NewIsolatingDialer(address string, mode IsolationMode, forward proxy.Dialer) (*IsolatingDialer, error) {
+	dialer := IsolatingDialer{address: address, mode: mode, forward: forward}
+	if _, err := rand.Read(dialer.secret[:]); err != nil {
+		return nil, errors.Context(err, "failed to generate secret for isolation credentials")
+	}
+	return &dialer, nil
+}
+
+// Dial dials the address without client information. Isolation modes that depend on the client
+// share credentials for all such connections.
+func (d *IsolatingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials the address through the SOCKS5 proxy, using credentials derived from the
+// isolation key.
+func (d *IsolatingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer, err := proxy.SOCKS5("tcp", d.address, d.credentials(ctx, addr), d.forward)
+	if err != nil {
+		return nil, err
+	}
+	return dialContext(ctx, dialer, network, addr)
+}
+
+// credentials derives the SOCKS5 credentials for the connection.
+func (d *IsolatingDialer) credentials(ctx context.Context, addr string) *proxy.Auth {
+	mac := hmac.New(sha256.New, d.secret[:])
+	mac.Write([]byte{byte(d.mode)})
+	mac.Write([]byte(d.isolationKey(ctx, addr)))
+	credential := hex.EncodeToString(mac.Sum(nil)[:16])
+	return &proxy.Auth{User: credential, Password: credential}
+}
+
+// isolationKey determines the key that identifies the isolated stream for the connection.
+func (d *IsolatingDialer) isolationKey(ctx context.Context, addr string) string {
+	client, _ := ClientFromContext(ctx)
+	switch d.mode {
+	case IsolationClient:
+		return hostname(client.Addr)
+	case IsolationUser:
+		return client.User
+	case IsolationDestination:
+		host := normalizeHost(hostname(addr))
+		if net.ParseIP(host) != nil {
+			return host
+		}
+		if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+			return domain
+		}
+		return host
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,157 @@
+package httprelay
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestParseIsolationMode(t *testing.T) {
+	for name, expected := range map[string]IsolationMode{"none": IsolationNone,
+		"client": IsolationClient, "user": IsolationUser, "destination": IsolationDestination} {
+		mode, err := ParseIsolationMode(name)
+		assert.Nil(t, err)
+		assert.Equal(t, mode, expected)
+	}
+	_, err := ParseIsolationMode("circuit")
+	assert.NotNil(t, err)
+}
+
+func TestIsolatingDialerClient(t *testing.T) {
+	users := testIsolationUsers(t, IsolationClient, []ClientInfo{
+		{Addr: "10.0.0.1:1234"}, {Addr: "10.0.0.1:5678"}, {Addr: "10.0.0.2:1234"}},
+		[]string{"example.com:80", "example.org:80", "example.com:80"})
+	assert.Equal(t, users[0], users[1])
+	if users[0] == users[2] {
+		t.Error("Expected different credentials for different clients.")
+	}
+}
+
+func TestIsolatingDialerUser(t *testing.T) {
+	users := testIsolationUsers(t, IsolationUser, []ClientInfo{
+		{Addr: "10.0.0.1:1234", User: "alice"}, {Addr: "10.0.0.2:1234", User: "alice"},
+		{Addr: "10.0.0.1:1234", User: "bob"}},
+		[]string{"example.com:80", "example.com:80", "example.com:80"})
+	assert.Equal(t, users[0], users[1])
+	if users[0] == users[2] {
+		t.Error("Expected different credentials for different users.")
+	}
+}
+
+func TestIsolatingDialerDestination(t *testing.T) {
+	users := testIsolationUsers(t, IsolationDestination, []ClientInfo{
+		{Addr: "10.0.0.1:1234"}, {Addr: "10.0.0.2:1234"}, {Addr: "10.0.0.1:1234"}},
+		[]string{"www.example.co.uk:443", "static.Example.co.uk:80", "example.com:443"})
+	assert.Equal(t, users[0], users[1])
+	if users[0] == users[2] {
+		t.Error("Expected different credentials for different destinations.")
+	}
+}
+
+func TestIsolatingDialerNone(t *testing.T) {
+	users := testIsolationUsers(t, IsolationNone, []ClientInfo{
+		{Addr: "10.0.0.1:1234", User: "alice"}, {Addr: "10.0.0.2:1234", User: "bob"}},
+		[]string{"example.com:80", "example.org:80"})
+	assert.Equal(t, users[0], users[1])
+}
+
+func TestIsolatingDialerSecretPerDialer(t *testing.T) {
+	first, err := NewIsolatingDialer("localhost:1080", IsolationClient, nil)
+	assert.Nil(t, err)
+	second, err := NewIsolatingDialer("localhost:1080", IsolationClient, nil)
+	assert.Nil(t, err)
+	ctx := WithClient(context.Background(), ClientInfo{Addr: "10.0.0.1:1234"})
+	if first.credentials(ctx, "example.com:80").User == second.credentials(ctx, "example.com:80").User {
+		t.Error("Expected credentials to differ between dialers.")
+	}
+}
+
+// testIsolationUsers dials each address with the corresponding client information through a fake
+// SOCKS5 server, and returns the user names that the server received.
+func testIsolationUsers(t *testing.T, mode IsolationMode, clients []ClientInfo, addrs []string) []string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	users := make(chan string, len(clients))
+	go testSOCKS5Server(listener, users)
+	dialer, err := NewIsolatingDialer(listener.Addr().String(), mode, &net.Dialer{})
+	assert.Nil(t, err)
+	var result []string
+	for i, client := range clients {
+		conn, err := dialer.DialContext(WithClient(context.Background(), client), "tcp", addrs[i])
+		assert.Nil(t, err)
+		conn.Close()
+		result = append(result, <-users)
+	}
+	return result
+}
+
+// testSOCKS5Server accepts connections and performs a minimal SOCKS5 handshake with
+// username/password authentication, reporting the user name and accepting every CONNECT request.
+func testSOCKS5Server(listener net.Listener, users chan<- string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		user, _ := testSOCKS5Handshake(conn)
+		conn.Close()
+		users <- user
+	}
+}
+
+func testSOCKS5Handshake(conn net.Conn) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{5, 2}); err != nil {
+		return "", err
+	}
+	// username/password authentication (RFC 1929)
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return "", err
+	}
+	user := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[0])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{1, 0}); err != nil {
+		return "", err
+	}
+	// connect request
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return "", err
+	}
+	var length int
+	switch request[3] {
+	case 1:
+		length = net.IPv4len
+	case 4:
+		length = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return "", err
+		}
+		length = int(header[0])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, length+2)); err != nil {
+		return "", err
+	}
+	_, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return string(user), err
+}
@@ -0,0 +1,205 @@
+package httprelay
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/cobratbq/goutils/std/errors"
+)
+
+// UnixSocketOptions contains the file options applied to a newly created Unix domain socket.
+type UnixSocketOptions struct {
+	// Mode is the file mode of the socket. Zero leaves the mode as determined by the umask.
+	Mode os.FileMode
+	// Owner is the owner of the socket, formatted as `user[:group]` with either names or numeric
+	// ids. An empty owner leaves ownership unchanged.
+	Owner string
+}
+
+// Listen opens a listener for the specified address. Supported addresses are:
+//   - `host:port` for a TCP listener, with the socket configured to allow binding to non-local
+//     addresses,
+//   - `unix:<path>` for a Unix domain socket, created with the provided socket options,
+//   - `systemd` or `systemd:<name>` for a pre-opened socket passed in by systemd
+//     socket-activation. Without name, the socket-activation must pass exactly one socket.
+func Listen(address string, options UnixSocketOptions) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		return listenUnix(strings.TrimPrefix(address, "unix:"), options)
+	case address == "systemd":
+		return listenSystemd("")
+	case strings.HasPrefix(address, "systemd:"):
+		return listenSystemd(strings.TrimPrefix(address, "systemd:"))
+	default:
+		return listenTCP(address)
+	}
+}
+
+// listenUnix creates a Unix domain socket listener at path. A stale socket left behind by a previous
+// process is removed. Any other file present at path is left untouched.
+func listenUnix(path string, options UnixSocketOptions) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Context(err, "failed to remove stale socket "+path)
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if options.Mode != 0 {
+		if err := os.Chmod(path, options.Mode); err != nil {
+			listener.Close()
+			return nil, errors.Context(err, "failed to set mode of socket "+path)
+		}
+	}
+	if options.Owner != "" {
+		uid, gid, err := lookupOwner(options.Owner)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			listener.Close()
+			return nil, errors.Context(err, "failed to set owner of socket "+path)
+		}
+	}
+	return listener, nil
+}
+
+// lookupOwner resolves an owner specification `user[:group]` into numeric user and group ids. An
+// absent group is reported as -1, leaving the group unchanged.
+func lookupOwner(owner string) (int, int, error) {
+	userName, groupName, _ := strings.Cut(owner, ":")
+	uid, err := strconv.Atoi(userName)
+	if err != nil {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return 0, 0, errors.Context(err, "failed to look up user "+userName)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return 0, 0, errors.Context(err, "unsupported user id for "+userName)
+		}
+	}
+	if groupName == "" {
+		return uid, -1, nil
+	}
+	gid, err := strconv.Atoi(groupName)
+	if err != nil {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, errors.Context(err, "failed to look up group "+groupName)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, errors.Context(err, "unsupported group id for "+groupName)
+		}
+	}
+	return uid, gid, nil
+}
+
+// systemdListenFdsStart is the first file descriptor passed in by systemd socket-activation.
+const systemdListenFdsStart = 3
+
+// listenSystemd acquires a listener from the sockets passed in through systemd socket-activation,
+// i.e. according to environment variables `LISTEN_PID`, `LISTEN_FDS` and `LISTEN_FDNAMES`.
+func listenSystemd(name string) (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, ErrNoSocketActivation
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, ErrNoSocketActivation
+	}
+	var index int
+	if name == "" {
+		if count != 1 {
+			return nil, errors.Context(ErrNoSocketActivation, "expected exactly one socket, got "+strconv.Itoa(count)+", specify socket name")
+		}
+	} else {
+		index = slices.Index(strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"), name)
+		if index < 0 || index >= count {
+			return nil, errors.Context(ErrNoSocketActivation, "no socket named '"+name+"'")
+		}
+	}
+	fd := systemdListenFdsStart + index
+	syscall.CloseOnExec(fd)
+	file := os.NewFile(uintptr(fd), "systemd:"+name)
+	listener, err := net.FileListener(file)
+	// net.FileListener duplicates the file descriptor, so the original can be closed.
+	file.Close()
+	if err != nil {
+		return nil, errors.Context(err, "failed to use socket from systemd socket-activation")
+	}
+	return listener, nil
+}
+
+// ErrNoSocketActivation indicates that no (suitable) sockets were passed by systemd
+// socket-activation.
+var ErrNoSocketActivation = errors.NewStringError("no sockets passed through systemd socket-activation")
+
+// ListenerConfig is the configuration of a single listener, each with its own mode of operation.
+type ListenerConfig struct {
+	// Address is the listening address, in any format accepted by `Listen`.
+	Address string
+	// Tunnel indicates tunnel-mode, i.e. only CONNECT-method requests are allowed.
+	Tunnel bool
+	// Allow is the access control list of clients allowed to connect. Empty allows all clients.
+	Allow string
+	// Upstream is the address of the SOCKS5 proxy to connect through. Empty indicates the default.
+	Upstream string
+	// Blocklists is the set of blocklists to use. Nil indicates the default set.
+	Blocklists []string
+}
+
+// ParseListenerConfig parses a listener specification formatted as `address[;option=value]...`.
+// Available options are:
+//   - `mode=proxy` or `mode=tunnel`,
+//   - `allow=<addresses>` for the comma-separated access control list,
+//   - `upstream=<host:port>` for the SOCKS5 proxy to connect through,
+//   - `blocklist=<filename>` for a blocklist, which may be repeated. An empty blocklist option
+//     disables the default blocklists for this listener.
+func ParseListenerConfig(spec string) (ListenerConfig, error) {
+	parts := strings.Split(spec, ";")
+	config := ListenerConfig{Address: strings.TrimSpace(parts[0])}
+	if config.Address == "" {
+		return config, errors.Context(ErrInvalidListenerConfig, "missing address")
+	}
+	for _, part := range parts[1:] {
+		key, value, found := strings.Cut(strings.TrimSpace(part), "=")
+		if !found {
+			return config, errors.Context(ErrInvalidListenerConfig, "expected option=value, got '"+part+"'")
+		}
+		switch key {
+		case "mode":
+			switch value {
+			case "proxy":
+				config.Tunnel = false
+			case "tunnel":
+				config.Tunnel = true
+			default:
+				return config, errors.Context(ErrInvalidListenerConfig, "unknown mode '"+value+"'")
+			}
+		case "allow":
+			config.Allow = value
+		case "upstream":
+			config.Upstream = value
+		case "blocklist":
+			if value == "" {
+				config.Blocklists = []string{}
+			} else {
+				config.Blocklists = append(config.Blocklists, value)
+			}
+		default:
+			return config, errors.Context(ErrInvalidListenerConfig, "unknown option '"+key+"'")
+		}
+	}
+	return config, nil
+}
+
+// ErrInvalidListenerConfig indicates that a listener specification could not be parsed.
+var ErrInvalidListenerConfig = errors.NewStringError("invalid listener configuration")
@@ -0,0 +1,33 @@
+package httprelay
+
+import (
+	"context"
+	"net"
+	"syscall"
+)
+
+// ipv6Freebind is the IPV6_FREEBIND socket option, which is not defined in package syscall.
+const ipv6Freebind = 0x4e
+
+// listenTCP opens a TCP listener with the socket configured to allow binding to addresses that are
+// not (yet) assigned to a local interface.
+func listenTCP(address string) (net.Listener, error) {
+	config := net.ListenConfig{Control: freebindControl}
+	return config.Listen(context.Background(), "tcp", address)
+}
+
+// freebindControl sets IP_FREEBIND on the socket, and IPV6_FREEBIND additionally if it is an IPv6
+// socket. The network reflects the family of the socket, which is IPv6 for wildcard addresses on
+// dual-stack hosts too.
+func freebindControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1)
+		if sockErr == nil && network == "tcp6" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Freebind, 1)
+		}
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,32 @@
+package httprelay
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestListenFreebind(t *testing.T) {
+	for _, address := range []string{":0", "0.0.0.0:0", "127.0.0.1:0", "[::]:0", "[::1]:0"} {
+		listener, err := Listen(address, UnixSocketOptions{})
+		if err != nil {
+			t.Logf("Skipping address '%s': %v", address, err)
+			continue
+		}
+		raw, err := listener.(*net.TCPListener).SyscallConn()
+		assert.Nil(t, err)
+		var domain, freebind, freebindV6 int
+		assert.Nil(t, raw.Control(func(fd uintptr) {
+			domain, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_DOMAIN)
+			freebind, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND)
+			freebindV6, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Freebind)
+		}))
+		listener.Close()
+		assert.Equal(t, freebind, 1)
+		if domain == syscall.AF_INET6 && freebindV6 != 1 {
+			t.Errorf("Expected IPV6_FREEBIND on IPv6 socket for address '%s'.", address)
+		}
+	}
+}
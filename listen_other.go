@@ -0,0 +1,10 @@
+//go:build !linux
+
+package httprelay
+
+import "net"
+
+// listenTCP opens a TCP listener. Freebind is specific to Linux, so no socket options are set.
+func listenTCP(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
@@ -0,0 +1,101 @@
+package httprelay
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+	listener, err := Listen("unix:"+path, UnixSocketOptions{Mode: 0600})
+	assert.Nil(t, err)
+	defer listener.Close()
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	conn.Close()
+}
+
+func TestListenUnixStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+	stale, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	// Prevent removal of the socket file, such that it is left behind as a stale socket.
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := Listen("unix:"+path, UnixSocketOptions{})
+	assert.Nil(t, err)
+	listener.Close()
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "regular")
+	assert.Nil(t, os.WriteFile(path, []byte("data"), 0600))
+	if _, err := Listen("unix:"+path, UnixSocketOptions{}); err == nil {
+		t.Fatal("Expected failure to listen on path of regular file.")
+	}
+	_, err := os.Stat(path)
+	assert.Nil(t, err)
+}
+
+func TestListenUnixOwnerNumeric(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relay.sock")
+	owner := strconv.Itoa(os.Getuid()) + ":" + strconv.Itoa(os.Getgid())
+	listener, err := Listen("unix:"+path, UnixSocketOptions{Owner: owner})
+	assert.Nil(t, err)
+	listener.Close()
+}
+
+func TestListenSystemdWithoutActivation(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	if _, err := Listen("systemd", UnixSocketOptions{}); err != ErrNoSocketActivation {
+		t.Fatalf("Expected no socket-activation error, but got: %+v", err)
+	}
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	if _, err := Listen("systemd", UnixSocketOptions{}); err != ErrNoSocketActivation {
+		t.Fatalf("Expected no socket-activation error for foreign pid, but got: %+v", err)
+	}
+}
+
+func TestParseListenerConfig(t *testing.T) {
+	config, err := ParseListenerConfig(":8081;mode=tunnel;allow=10.0.0.0/8,192.168.0.0/16;upstream=localhost:9050;blocklist=ads;blocklist=malware")
+	assert.Nil(t, err)
+	assert.Equal(t, config.Address, ":8081")
+	assert.Equal(t, config.Tunnel, true)
+	assert.Equal(t, config.Allow, "10.0.0.0/8,192.168.0.0/16")
+	assert.Equal(t, config.Upstream, "localhost:9050")
+	assert.Equal(t, len(config.Blocklists), 2)
+	assert.Equal(t, config.Blocklists[1], "malware")
+}
+
+func TestParseListenerConfigDefaults(t *testing.T) {
+	config, err := ParseListenerConfig("unix:/run/relay.sock")
+	assert.Nil(t, err)
+	assert.Equal(t, config.Address, "unix:/run/relay.sock")
+	assert.Equal(t, config.Tunnel, false)
+	if config.Blocklists != nil {
+		t.Fatal("Expected default blocklists.")
+	}
+	config, err = ParseListenerConfig(":8081;blocklist=")
+	assert.Nil(t, err)
+	if config.Blocklists == nil || len(config.Blocklists) != 0 {
+		t.Fatal("Expected blocklists to be disabled.")
+	}
+}
+
+func TestParseListenerConfigInvalid(t *testing.T) {
+	for _, spec := range []string{"", ";mode=proxy", ":8081;mode=bogus", ":8081;bogus=1", ":8081;mode"} {
+		if _, err := ParseListenerConfig(spec); err == nil {
+			t.Errorf("Expected error for specification '%s'", spec)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package httprelay
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxForwardsHeader is the 'Max-Forwards' header, which limits the number of times that TRACE and
+// OPTIONS requests are forwarded. (RFC 9110, section 7.6.2)
+const maxForwardsHeader = "Max-Forwards"
+
+// proxyMethods are the methods supported by HTTPProxyHandler, apart from TRACE.
+var proxyMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodPatch}
+
+// traceExcludedHeaders are the headers that are not reflected in the response to a TRACE request,
+// as they likely contain sensitive data.
+var traceExcludedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// maxForwards returns the value of the Max-Forwards header, or -1 if absent or invalid.
+func maxForwards(header http.Header) int64 {
+	values := header.Values(maxForwardsHeader)
+	if len(values) != 1 {
+		return -1
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(values[0]), 10, 64)
+	if err != nil || value < 0 {
+		return -1
+	}
+	return value
+}
+
+// allowedMethods returns the methods supported, depending on whether TRACE is enabled.
+func allowedMethods(trace bool) []string {
+	if !trace {
+		return proxyMethods
+	}
+	return append(append([]string(nil), proxyMethods...), http.MethodTrace)
+}
+
+// respondTrace responds to a TRACE request as its final recipient, by reflecting the request as
+// received back to the client. (RFC 9110, section 9.3.8)
+func respondTrace(resp http.ResponseWriter, req *http.Request) error {
+	var message bytes.Buffer
+	message.WriteString(req.Method + " " + req.RequestURI + " " + req.Proto + "\r\n")
+	message.WriteString("Host: " + req.Host + "\r\n")
+	header := req.Header.Clone()
+	for _, name := range traceExcludedHeaders {
+		header.Del(name)
+	}
+	header.Write(&message)
+	message.WriteString("\r\n")
+	resp.Header().Set("Content-Type", "message/http")
+	resp.Header().Set("Content-Length", strconv.Itoa(message.Len()))
+	resp.WriteHeader(http.StatusOK)
+	_, err := resp.Write(message.Bytes())
+	return err
+}
+
+// respondOptions responds to an OPTIONS request as its final recipient, by advertising the
+// methods supported by the proxy. (RFC 9110, section 9.3.7)
+func respondOptions(resp http.ResponseWriter, methods []string) error {
+	resp.Header().Set("Allow", strings.Join(methods, ", "))
+	resp.Header().Set("Content-Length", "0")
+	resp.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,104 @@
+package httprelay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestMaxForwards(t *testing.T) {
+	var tests = map[string]int64{
+		"":      -1,
+		"0":     0,
+		"5":     5,
+		" 10 ":  10,
+		"-1":    -1,
+		"five":  -1,
+		"1, 2":  -1,
+		"00003": 3,
+	}
+	for value, expected := range tests {
+		header := http.Header{}
+		if value != "" {
+			header.Set("Max-Forwards", value)
+		}
+		assert.Equal(t, maxForwards(header), expected)
+	}
+}
+
+func TestProxyHandlerTraceAtZero(t *testing.T) {
+	dialer := TestRecordingDialer{}
+	handler := HTTPProxyHandler{Dialer: &dialer}
+	req := httptest.NewRequest(http.MethodTrace, "http://example.com/path", nil)
+	req.Header.Set("Max-Forwards", "0")
+	req.Header.Set("X-Custom", "value")
+	req.Header.Set("Cookie", "secret=1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Header().Get("Content-Type"), "message/http")
+	body := recorder.Body.String()
+	if !strings.HasPrefix(body, "TRACE http://example.com/path HTTP/1.1\r\nHost: example.com\r\n") {
+		t.Fatalf("Unexpected reflected request: %q", body)
+	}
+	if !strings.Contains(body, "X-Custom: value\r\n") || strings.Contains(body, "secret") {
+		t.Fatalf("Unexpected reflected headers: %q", body)
+	}
+	assert.Equal(t, len(dialer.addrs), 0)
+}
+
+func TestProxyHandlerOptionsAtZero(t *testing.T) {
+	dialer := TestRecordingDialer{}
+	handler := HTTPProxyHandler{Dialer: &dialer}
+	req := httptest.NewRequest(http.MethodOptions, "http://example.com/", nil)
+	req.Header.Set("Max-Forwards", "0")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Header().Get("Allow"), "GET, HEAD, POST, PUT, DELETE, CONNECT, OPTIONS, PATCH, TRACE")
+	assert.Equal(t, len(dialer.addrs), 0)
+	handler.DisableTrace = true
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Header().Get("Allow"), "GET, HEAD, POST, PUT, DELETE, CONNECT, OPTIONS, PATCH")
+}
+
+func TestProxyHandlerMaxForwardsDecremented(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.WriteString(resp, req.Header.Get("Max-Forwards"))
+	}))
+	defer origin.Close()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}}
+	var tests = map[string]string{
+		http.MethodTrace:   "4",
+		http.MethodOptions: "4",
+		http.MethodGet:     "5",
+	}
+	for method, expected := range tests {
+		req := httptest.NewRequest(method, "http://example.com/", nil)
+		req.Header.Set("Max-Forwards", "5")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, recorder.Code, http.StatusOK)
+		assert.Equal(t, recorder.Body.String(), expected)
+	}
+}
+
+func TestProxyHandlerTraceDisabled(t *testing.T) {
+	dialer := TestRecordingDialer{}
+	handler := HTTPProxyHandler{Dialer: &dialer, DisableTrace: true}
+	for _, maxForwards := range []string{"", "0", "3"} {
+		req := httptest.NewRequest(http.MethodTrace, "http://example.com/", nil)
+		if maxForwards != "" {
+			req.Header.Set("Max-Forwards", maxForwards)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, recorder.Code, http.StatusMethodNotAllowed)
+	}
+	assert.Equal(t, len(dialer.addrs), 0)
+}
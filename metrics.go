@@ -0,0 +1,97 @@
+package httprelay
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics contains the counters for requests processed. A single instance may be shared among
+// handlers, such that the counters represent all handlers combined. All methods are safe to call
+// on a nil instance, which does not count anything.
+type Metrics struct {
+	// Requests is the number of (non-CONNECT) requests served.
+	Requests atomic.Uint64
+	// Tunnels is the number of CONNECT requests served.
+	Tunnels atomic.Uint64
+	// Blocked is the number of requests refused because of a blocked destination or URL.
+	Blocked atomic.Uint64
+	// Errors is the number of requests that failed for other reasons.
+	Errors atomic.Uint64
+	// blocklists counts the requests refused per named blocklist, as *atomic.Uint64 by name.
+	blocklists sync.Map
+}
+
+// countRequest counts a served request, tunneled or not.
+func (m *Metrics) countRequest(tunnel bool) {
+	if m == nil {
+		return
+	}
+	if tunnel {
+		m.Tunnels.Add(1)
+	} else {
+		m.Requests.Add(1)
+	}
+}
+
+// countResult counts the result of a request if it failed.
+func (m *Metrics) countResult(err error) {
+	if m == nil || err == nil {
+		return
+	}
+	if errors.Is(err, ErrBlockedHost) || errors.Is(err, ErrBlockedURL) {
+		m.Blocked.Add(1)
+		var blocked *BlockedError
+		if errors.As(err, &blocked) {
+			counter, _ := m.blocklists.LoadOrStore(blocked.List, new(atomic.Uint64))
+			counter.(*atomic.Uint64).Add(1)
+		}
+	} else {
+		m.Errors.Add(1)
+	}
+}
+
+// BlockedBy returns the number of requests refused because of the named blocklist.
+func (m *Metrics) BlockedBy(list string) uint64 {
+	if m == nil {
+		return 0
+	}
+	if counter, ok := m.blocklists.Load(list); ok {
+		return counter.(*atomic.Uint64).Load()
+	}
+	return 0
+}
+
+// metricsReport is the JSON representation of Metrics.
+type metricsReport struct {
+	Requests   uint64            `json:"requests"`
+	Tunnels    uint64            `json:"tunnels"`
+	Blocked    uint64            `json:"blocked"`
+	Errors     uint64            `json:"errors"`
+	Blocklists map[string]uint64 `json:"blocklists,omitempty"`
+}
+
+// String returns the metrics formatted as JSON object. This satisfies expvar.Var. Counts per named
+// blocklist are included once any request is refused because of a named blocklist.
+func (m *Metrics) String() string {
+	if m == nil {
+		return "{}"
+	}
+	report := metricsReport{
+		Requests: m.Requests.Load(),
+		Tunnels:  m.Tunnels.Load(),
+		Blocked:  m.Blocked.Load(),
+		Errors:   m.Errors.Load(),
+	}
+	m.blocklists.Range(func(name, counter any) bool {
+		if report.Blocklists == nil {
+			report.Blocklists = make(map[string]uint64)
+		}
+		report.Blocklists[name.(string)] = counter.(*atomic.Uint64).Load()
+		return true
+	})
+	// Encoding counters cannot fail.
+	encoded, _ := json.Marshal(&report)
+	return string(encoded)
+}
@@ -0,0 +1,51 @@
+package httprelay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cobratbq/goutils/std/errors"
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestMetricsNil(t *testing.T) {
+	var m *Metrics
+	m.countRequest(true)
+	m.countResult(ErrBlockedHost)
+	assert.Equal(t, m.String(), "{}")
+}
+
+func TestMetricsCounting(t *testing.T) {
+	var m Metrics
+	m.countRequest(true)
+	m.countRequest(false)
+	m.countRequest(false)
+	m.countResult(nil)
+	m.countResult(errors.Context(ErrBlockedHost, "host 'hello.world'"))
+	m.countResult(ErrInvalidAddress)
+	assert.Equal(t, m.String(), `{"requests":2,"tunnels":1,"blocked":1,"errors":1}`)
+}
+
+func TestConnectHandlerCountsMetrics(t *testing.T) {
+	var m Metrics
+	handler := HTTPConnectHandler{Dialer: &NopDialer{}, Metrics: &m}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodConnect, "http://hello.world:443", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://hello.world/", nil))
+	assert.Equal(t, m.Tunnels.Load(), uint64(1))
+	assert.Equal(t, m.Requests.Load(), uint64(1))
+	assert.Equal(t, m.Blocked.Load(), uint64(1))
+}
+
+func TestAdminHandlerMetrics(t *testing.T) {
+	var m Metrics
+	m.countRequest(false)
+	admin := AdminHandler{Metrics: &m}
+	recorder := httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), `{"requests":1,"tunnels":0,"blocked":0,"errors":0}`)
+	recorder = httptest.NewRecorder()
+	admin.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	assert.Equal(t, recorder.Code, http.StatusNotFound)
+}
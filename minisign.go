@@ -0,0 +1,79 @@
+package httprelay
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+
+	"github.com/cobratbq/goutils/std/errors"
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignSuffix is the suffix of the filename or URL of a minisign signature, relative to the
+// signed content.
+const minisignSuffix = ".minisig"
+
+// ErrInvalidMinisignKey indicates that a minisign public key could not be parsed.
+var ErrInvalidMinisignKey = errors.NewStringError("invalid minisign public key")
+
+// minisignKey is a minisign public key.
+type minisignKey struct {
+	id  [8]byte
+	key ed25519.PublicKey
+}
+
+// parseMinisignKey parses a base64-encoded minisign public key, as found on the second line of a
+// minisign public key file.
+func parseMinisignKey(encoded string) (*minisignKey, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.Context(ErrInvalidMinisignKey, err.Error())
+	}
+	if len(decoded) != 2+8+ed25519.PublicKeySize || string(decoded[:2]) != "Ed" {
+		return nil, errors.Context(ErrInvalidMinisignKey, "unsupported key format")
+	}
+	var key minisignKey
+	copy(key.id[:], decoded[2:10])
+	key.key = ed25519.PublicKey(decoded[10:])
+	return &key, nil
+}
+
+// verify verifies the content against the minisign signature file's content. Both signatures over
+// the content itself (legacy) and prehashed signatures (BLAKE2b-512) are supported. The trusted
+// comment is verified as well.
+func (k *minisignKey) verify(data, signature []byte) error {
+	lines := strings.Split(strings.ReplaceAll(string(signature), "\r\n", "\n"), "\n")
+	if len(lines) < 4 {
+		return errors.Context(ErrBlocklistVerification, "malformed minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.Context(ErrBlocklistVerification, "malformed minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], k.id[:]) {
+		return errors.Context(ErrBlocklistVerification, "minisign signature created with different key")
+	}
+	message := data
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		digest := blake2b.Sum512(data)
+		message = digest[:]
+	default:
+		return errors.Context(ErrBlocklistVerification, "unsupported minisign signature algorithm")
+	}
+	if !ed25519.Verify(k.key, message, sig[10:]) {
+		return errors.Context(ErrBlocklistVerification, "invalid minisign signature")
+	}
+	comment, ok := strings.CutPrefix(lines[2], "trusted comment: ")
+	if !ok {
+		return errors.Context(ErrBlocklistVerification, "missing minisign trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	signed := append(append([]byte{}, sig[10:]...), comment...)
+	if err != nil || !ed25519.Verify(k.key, signed, global) {
+		return errors.Context(ErrBlocklistVerification, "invalid minisign trusted comment signature")
+	}
+	return nil
+}
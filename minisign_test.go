@@ -0,0 +1,61 @@
+package httprelay
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+	"golang.org/x/crypto/blake2b"
+)
+
+// testMinisign generates a minisign key pair. Returns the encoded public key and a function that
+// signs the content, producing the content of a minisign signature file.
+func testMinisign(t *testing.T) (string, func(data []byte, prehashed bool) []byte) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	encodedKey := base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), public...))
+	return encodedKey, func(data []byte, prehashed bool) []byte {
+		algorithm, message := "Ed", data
+		if prehashed {
+			digest := blake2b.Sum512(data)
+			algorithm, message = "ED", digest[:]
+		}
+		signature := ed25519.Sign(private, message)
+		comment := "timestamp:1760832000"
+		global := ed25519.Sign(private, append(append([]byte{}, signature...), comment...))
+		return []byte("untrusted comment: signature from minisign secret key\n" +
+			base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), keyID...), signature...)) + "\n" +
+			"trusted comment: " + comment + "\n" +
+			base64.StdEncoding.EncodeToString(global) + "\n")
+	}
+}
+
+func TestMinisignVerify(t *testing.T) {
+	encodedKey, sign := testMinisign(t)
+	key, err := parseMinisignKey(encodedKey)
+	assert.Nil(t, err)
+	data := []byte("0.0.0.0 ads.example\n")
+	assert.Nil(t, key.verify(data, sign(data, true)))
+	assert.Nil(t, key.verify(data, sign(data, false)))
+	err = key.verify([]byte("0.0.0.0 other.example\n"), sign(data, true))
+	assert.Equal(t, errors.Is(err, ErrBlocklistVerification), true)
+	tampered := strings.Replace(string(sign(data, true)), "timestamp:", "timestamp:9", 1)
+	assert.NotNil(t, key.verify(data, []byte(tampered)))
+	assert.NotNil(t, key.verify(data, []byte("not a signature")))
+	otherKey, _ := testMinisign(t)
+	other, err := parseMinisignKey(otherKey)
+	assert.Nil(t, err)
+	assert.NotNil(t, other.verify(data, sign(data, true)))
+}
+
+func TestParseMinisignKeyInvalid(t *testing.T) {
+	for _, encoded := range []string{"", "not base64!", base64.StdEncoding.EncodeToString([]byte("Ed too short"))} {
+		_, err := parseMinisignKey(encoded)
+		assert.Equal(t, errors.Is(err, ErrInvalidMinisignKey), true)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package httprelay
+
+import (
+	"io"
+	"os"
+)
+
+// mapFile reads the file into memory, as memory-mapping is not supported.
+func mapFile(file *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(file, data)
+	return data, err
+}
+
+// unmapFile does nothing, as the memory is managed by the garbage collector.
+func unmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package httprelay
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file into memory, read-only.
+func mapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// unmapFile unmaps memory mapped by mapFile.
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -1,6 +1,7 @@
 package httprelay
 
 import (
+	"context"
 	"net"
 
 	"github.com/cobratbq/goutils/std/errors"
@@ -14,5 +15,10 @@ func (NopDialer) Dial(network, addr string) (net.Conn, error) {
 	return nil, ErrBlockedHost
 }
 
+// DialContext performs no-op dial operation.
+func (NopDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return nil, ErrBlockedHost
+}
+
 // ErrBlockedHost indicates that host is blocked.
 var ErrBlockedHost = errors.NewStringError("host is blocked")
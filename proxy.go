@@ -3,9 +3,12 @@ package httprelay
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +19,16 @@ import (
 	"golang.org/x/net/proxy"
 )
 
+// schemePorts contains the supported schemes of absolute request URIs with their default port.
+var schemePorts = map[string]string{"http": "80", "https": "443", "ws": "80", "wss": "443"}
+
+// ErrUnsupportedScheme indicates that the scheme of the request URI is not supported.
+var ErrUnsupportedScheme = errors.NewStringError("unsupported scheme")
+
+// ErrTLSOriginationDisabled indicates that a request requires TLS origination, which is disabled.
+var ErrTLSOriginationDisabled = errors.NewStringError("TLS origination is disabled")
+
+// DirectDialer creates a dialer for direct connections. Host names are resolved locally.
 func DirectDialer() net.Dialer {
 	return net.Dialer{
 		Timeout:       0,
@@ -37,6 +50,9 @@ func DirectDialer() net.Dialer {
 // which explicitly skips known hop-by-hop headers and checks 'Connection'
 // header for additional headers we need to skip.
 //
+// Max-Forwards is handled for TRACE and OPTIONS requests, such that the proxy answers these
+// requests itself when the remaining number of forwards reaches zero.
+//
 // Remarks from the blog post not covered explicitly are tested in the tests
 // assumptions_test.go
 
@@ -45,17 +61,76 @@ type HTTPProxyHandler struct {
 	// Dialer is the dialer for connecting to the SOCKS5 proxy.
 	Dialer    proxy.Dialer
 	UserAgent string
+	// TLSConfig is the configuration for originating TLS connections to the origin server for
+	// absolute `https://` and `wss://` request URIs. If nil, TLS origination is disabled and such
+	// requests are refused.
+	TLSConfig *tls.Config
+	// ExpectContinueTimeout is the maximum duration to wait for the origin server to respond to a
+	// request with `Expect: 100-continue`, before sending the request body regardless. Zero
+	// indicates the default of 1 second.
+	ExpectContinueTimeout time.Duration
+	// Via is the received-by identifier, i.e. a host name or pseudonym, that is inserted in the Via
+	// header of forwarded messages. Requests that already list this identifier are refused to
+	// prevent loops. Empty disables Via insertion and loop detection.
+	Via string
+	// Forwarded determines the treatment of headers identifying the client to the origin server.
+	Forwarded ForwardedMode
+	// Anonymize is the (optional) anonymizing profile, which removes or normalizes identifying
+	// request headers.
+	Anonymize *AnonymizeProfile
+	// HeaderRules are the (optional) rules for rewriting headers of requests and responses.
+	HeaderRules *HeaderRules
+	// URLRules are the (optional) rules for allowing or blocking requests by target URI. Blocked
+	// requests are refused before connecting.
+	URLRules *URLRules
+	// DisableTrace refuses TRACE requests, for protection against cross-site tracing.
+	DisableTrace bool
+	// Metrics is the (optional) shared metrics instance to count requests in.
+	Metrics *Metrics
+	// Cache is the (optional) shared cache for responses to GET requests.
+	Cache *Cache
+	// Interceptor is the (optional) interceptor for terminating TLS of CONNECT tunnels, such that
+	// tunneled requests are processed like other requests. Requires TLSConfig for re-originating
+	// TLS to the origin server.
+	Interceptor *Interceptor
+	// Credentials (optional) are required from clients in the Proxy-Authorization header.
+	Credentials ProxyCredentials
 }
 
 func (h *HTTPProxyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	req, err := h.Credentials.authenticate(resp, req)
+	if err != nil {
+		h.Metrics.countRequest(req.Method == http.MethodConnect)
+		h.Metrics.countResult(err)
+		log.Warnln("Error serving request:", err.Error())
+		return
+	}
+	h.serve(resp, req)
+}
+
+// serve serves the request, which carries the client information in its context.
+func (h *HTTPProxyHandler) serve(resp http.ResponseWriter, req *http.Request) {
 	var err error
-	switch req.Method {
-	case http.MethodConnect:
+	h.Metrics.countRequest(req.Method == http.MethodConnect)
+	switch {
+	case h.Via != "" && viaContains(req.Header, h.Via):
+		resp.WriteHeader(http.StatusLoopDetected)
+		err = ErrLoopDetected
+	case req.Method == http.MethodTrace && h.DisableTrace:
+		_, err = http_.RespondMethodNotAllowed(resp, allowedMethods(false), nil)
+	case req.Method == http.MethodTrace && maxForwards(req.Header) == 0:
+		err = respondTrace(resp, req)
+	case req.Method == http.MethodOptions && maxForwards(req.Header) == 0:
+		err = respondOptions(resp, allowedMethods(!h.DisableTrace))
+	case req.Method == http.MethodConnect && h.Interceptor != nil && !h.Interceptor.bypassed(req.Host):
+		err = h.processIntercept(resp, req)
+	case req.Method == http.MethodConnect:
 		// TODO Go 1.20 added an OnProxyConnect callback for use by proxies. This probably voids the use for connection hijacking. Investigate and possibly use.
-		err = processConnect(resp, req, h.Dialer.Dial)
+		err = processConnect(resp, req, h.Dialer, h.Via)
 	default:
 		err = h.processRequest(resp, req)
 	}
+	h.Metrics.countResult(err)
 	if err != nil {
 		log.Warnln("Error serving request:", err.Error())
 	}
@@ -63,92 +138,349 @@ func (h *HTTPProxyHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request
 
 // TODO append body that explains the error as is expected from 5xx http status codes
 func (h *HTTPProxyHandler) processRequest(resp http.ResponseWriter, req *http.Request) error {
-	// TODO what to do when body of request is very large?
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-		return err
-	}
-	io_.CloseLogged(req.Body, "Failed to close request body: %+v")
-	// The request body is only closed in certain error cases. In other cases, we
-	// let body be closed by during processing of request to remote host.
+	// The request body is streamed to the origin server, so it is not read until the connection is
+	// established.
+	defer io_.CloseLoggedWithIgnores(req.Body, "Error while closing request body: %+v", io.ErrClosedPipe)
 	log.Infoln(req.Proto, req.Method, req.URL.Host)
 	// Verification of requests is already handled by net/http library.
-	// Establish connection with socks proxy
-	conn, err := h.Dialer.Dial("tcp", fullHost(req.URL.Host))
-	if err == ErrBlockedHost {
+	port, ok := schemePorts[req.URL.Scheme]
+	if !ok {
+		resp.WriteHeader(http.StatusBadRequest)
+		return errors.Context(ErrUnsupportedScheme, "scheme '"+req.URL.Scheme+"'")
+	}
+	if blocked, rule := h.URLRules.Blocked(req.URL); blocked {
 		resp.WriteHeader(http.StatusForbidden)
-		return errors.Context(err, "host '"+req.URL.Host+"'")
-	} else if err != nil {
-		resp.WriteHeader(http.StatusInternalServerError)
-		return errors.Context(err, "failed to connect to host")
+		return errors.Context(ErrBlockedURL, "'"+req.URL.String()+"' by rule '"+rule+"'")
+	}
+	originateTLS := req.URL.Scheme == "https" || req.URL.Scheme == "wss"
+	if originateTLS && h.TLSConfig == nil {
+		resp.WriteHeader(http.StatusNotImplemented)
+		return errors.Context(ErrTLSOriginationDisabled, "host '"+req.URL.Host+"'")
 	}
-	defer io_.CloseLoggedWithIgnores(conn, "Error closing connection to socks proxy: %+v", io.ErrClosedPipe)
 	// Prepare request for socks proxy
-	proxyReq, err := http.NewRequest(req.Method, req.RequestURI, bytes.NewReader(body))
+	proxyReq, err := http.NewRequest(req.Method, req.RequestURI, nil)
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
+	if req.ContentLength != 0 {
+		proxyReq.Body = req.Body
+		proxyReq.ContentLength = req.ContentLength
+	}
 	// Transfer headers to proxy request
 	copyHeaders(proxyReq.Header, req.Header)
+	// Upgrade is a hop-by-hop mechanism, so it is explicitly forwarded if requested by the client.
+	upgrade := upgradeProtocols(req.Header)
+	if upgrade != "" {
+		proxyReq.Header.Set(connectionHeader, "Upgrade")
+		proxyReq.Header.Set("Upgrade", upgrade)
+	}
+	h.Anonymize.Apply(proxyReq.Header)
+	if remaining := maxForwards(req.Header); remaining > 0 && (req.Method == http.MethodTrace || req.Method == http.MethodOptions) {
+		proxyReq.Header.Set(maxForwardsHeader, strconv.FormatInt(remaining-1, 10))
+	}
+	applyForwarded(proxyReq.Header, h.Forwarded, req)
+	if h.Via != "" {
+		appendVia(proxyReq.Header, req.ProtoMajor, req.ProtoMinor, h.Via)
+	}
 	if h.UserAgent != "" {
-		// Add specified user agent as header.
-		proxyReq.Header.Add("User-Agent", h.UserAgent)
+		// Replace user agent with the one specified.
+		proxyReq.Header.Set("User-Agent", h.UserAgent)
+	}
+	h.HeaderRules.ApplyRequest(proxyReq.Header, hostname(req.URL.Host), req.Method)
+	// Serve a fresh stored response, or validate a stale stored response with the origin server.
+	var cached *cachedResponse
+	var requestTime time.Time
+	if h.Cache != nil {
+		// The cache is shared among listeners, so stored responses are subject to the blocking of
+		// this listener, which may also change at runtime.
+		if err := checkHost(req.Context(), h.Dialer, fullHost(req.URL.Host, port), true); isBlocked(err) {
+			respondBlocked(resp, err)
+			return errors.Context(err, "host '"+req.URL.Host+"'")
+		}
+		if cached = h.Cache.lookup(proxyReq); cached != nil && h.Cache.servable(cached, proxyReq.Header) {
+			return h.respondCached(resp, req, cached, cacheHit)
+		}
+		if onlyIfCached(proxyReq.Header) {
+			resp.WriteHeader(http.StatusGatewayTimeout)
+			return nil
+		}
+		if cached != nil && !addValidators(proxyReq.Header, cached) {
+			cached = nil
+		}
+		requestTime = h.Cache.now()
 	}
-	// Send request to socks proxy
-	if err = proxyReq.Write(conn); err != nil {
+	// Establish connection with socks proxy
+	conn, err := dialContext(req.Context(), h.Dialer, "tcp", fullHost(req.URL.Host, port))
+	if isBlocked(err) {
+		respondBlocked(resp, err)
+		return errors.Context(err, "host '"+req.URL.Host+"'")
+	} else if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
-		return err
+		return errors.Context(err, "failed to connect to host")
+	}
+	if originateTLS {
+		config := h.TLSConfig.Clone()
+		config.ServerName = normalizeHost(hostname(req.URL.Host))
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(req.Context()); err != nil {
+			io_.CloseLoggedWithIgnores(conn, "Error closing connection to socks proxy: %+v", io.ErrClosedPipe)
+			resp.WriteHeader(http.StatusBadGateway)
+			return errors.Context(err, "failed TLS handshake with host '"+req.URL.Host+"'")
+		}
+		conn = tlsConn
 	}
-	// Read proxy response
+	defer io_.CloseLoggedWithIgnores(conn, "Error closing connection to socks proxy: %+v", io.ErrClosedPipe)
+	// Send request to socks proxy and read proxy response
 	proxyRespReader := bufio.NewReader(conn)
-	proxyResp, err := http.ReadResponse(proxyRespReader, proxyReq)
+	proxyResp, err := h.roundTrip(conn, proxyRespReader, proxyReq)
 	if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
+	if cached != nil && proxyResp.StatusCode == http.StatusNotModified {
+		io_.CloseLoggedWithIgnores(proxyResp.Body, "Error closing response body: %+v", io.ErrClosedPipe)
+		cached = h.Cache.revalidated(proxyReq, cached, proxyResp, requestTime, h.Cache.now())
+		return h.respondCached(resp, req, cached, cacheRevalidated)
+	}
+	if upgrade != "" && proxyResp.StatusCode == http.StatusSwitchingProtocols {
+		return switchProtocols(resp, proxyResp, proxyRespReader, conn, h.Via)
+	}
 	// Transfer headers to client response
 	copyHeaders(resp.Header(), proxyResp.Header)
+	var body io.Writer = resp
+	var capture *limitedBuffer
+	var stored http.Header
+	if h.Cache != nil {
+		h.Cache.invalidate(proxyReq, proxyResp)
+		if h.Cache.cacheable(proxyReq, proxyResp, req.TLS != nil) {
+			stored = resp.Header().Clone()
+			capture = &limitedBuffer{limit: h.Cache.MaxEntrySize}
+			body = io.MultiWriter(resp, capture)
+		}
+		if req.Method == http.MethodGet {
+			resp.Header().Set(xCacheHeader, cacheMiss)
+		}
+	}
+	h.HeaderRules.ApplyResponse(resp.Header(), hostname(req.URL.Host), req.Method)
+	if h.Via != "" {
+		appendVia(resp.Header(), proxyResp.ProtoMajor, proxyResp.ProtoMinor, h.Via)
+	}
 	resp.Header().Set("Connection", "close")
 	// Verification of response is already handled by net/http library.
 	resp.WriteHeader(proxyResp.StatusCode)
-	_, err = io.Copy(resp, proxyResp.Body)
+	_, err = io.Copy(body, proxyResp.Body)
 	io_.CloseLoggedWithIgnores(proxyResp.Body, "Error closing response body: %+v", io.ErrClosedPipe)
+	if err == nil && capture != nil && !capture.exceeded {
+		h.Cache.store(proxyReq, proxyResp, stored, capture.Bytes(), requestTime, h.Cache.now())
+	}
+	return err
+}
+
+// respondCached serves the stored response, with the Age and X-Cache headers added. If the client's
+// preconditions match the stored response, 304 (Not Modified) is sent instead.
+func (h *HTTPProxyHandler) respondCached(resp http.ResponseWriter, req *http.Request, entry *cachedResponse, status string) error {
+	copyHeaders(resp.Header(), entry.Header)
+	h.HeaderRules.ApplyResponse(resp.Header(), hostname(req.URL.Host), req.Method)
+	if h.Via != "" {
+		appendVia(resp.Header(), entry.ProtoMajor, entry.ProtoMinor, h.Via)
+	}
+	resp.Header().Set("Age", strconv.FormatInt(int64(h.Cache.age(entry)/time.Second), 10))
+	resp.Header().Set(xCacheHeader, status)
+	resp.Header().Set("Connection", "close")
+	if notModified(req.Header, entry) {
+		resp.Header().Del("Content-Length")
+		resp.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	resp.WriteHeader(entry.Status)
+	_, err := resp.Write(entry.Body)
 	return err
 }
 
+// defaultExpectContinueTimeout is the default duration to wait for a response from the origin
+// server before sending a request body that is subject to `Expect: 100-continue`.
+const defaultExpectContinueTimeout = time.Second
+
+// roundTrip sends the request and reads the (final) response. The request is written concurrently,
+// such that an early response of the origin server is not blocked by the request body.
+//
+// For requests with `Expect: 100-continue`, the request body is held back until the origin server
+// responds with 100 (Continue) or the timeout expires. Only then is the body read from the client,
+// at which point net/http sends the interim 100 (Continue) response to the client. If the origin
+// server responds with a final status instead, the body is never read and the final status is
+// relayed to the client.
+func (h *HTTPProxyHandler) roundTrip(conn net.Conn, reader *bufio.Reader, proxyReq *http.Request) (*http.Response, error) {
+	var body *continueBody
+	if proxyReq.Body != nil && strings.EqualFold(proxyReq.Header.Get("Expect"), "100-continue") {
+		body = &continueBody{body: proxyReq.Body, decision: make(chan bool, 1)}
+		proxyReq.Body = body
+	}
+	written := make(chan error, 1)
+	go func() { written <- proxyReq.Write(conn) }()
+	responses := make(chan *http.Response, 1)
+	failures := make(chan error, 1)
+	readResponse := func() {
+		if proxyResp, err := http.ReadResponse(reader, proxyReq); err != nil {
+			failures <- err
+		} else {
+			responses <- proxyResp
+		}
+	}
+	go readResponse()
+	if body != nil {
+		timeout := h.ExpectContinueTimeout
+		if timeout == 0 {
+			timeout = defaultExpectContinueTimeout
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+				body.decide(true)
+			case proxyResp := <-responses:
+				if proxyResp.StatusCode != http.StatusContinue {
+					body.decide(false)
+					return proxyResp, nil
+				}
+				body.decide(true)
+				go readResponse()
+			case err := <-failures:
+				body.decide(false)
+				return nil, err
+			}
+		}
+	}
+	select {
+	case proxyResp := <-responses:
+		return proxyResp, nil
+	case err := <-failures:
+		if writeErr := <-written; writeErr != nil {
+			return nil, writeErr
+		}
+		return nil, err
+	}
+}
+
+// continueBody holds back reading of the request body until a decision is made on whether or not to
+// send the body. If declined, the body is never read.
+type continueBody struct {
+	body     io.ReadCloser
+	decision chan bool
+	once     sync.Once
+	decided  bool
+	proceed  bool
+}
+
+// decide decides whether or not to send the body. Only the first decision is effective.
+func (c *continueBody) decide(proceed bool) {
+	c.once.Do(func() { c.decision <- proceed })
+}
+
+func (c *continueBody) Read(p []byte) (int, error) {
+	if !c.decided {
+		c.proceed = <-c.decision
+		c.decided = true
+	}
+	if !c.proceed {
+		return 0, ErrExpectationDeclined
+	}
+	return c.body.Read(p)
+}
+
+func (c *continueBody) Close() error {
+	return c.body.Close()
+}
+
+// ErrExpectationDeclined indicates that the origin server declined the request body by responding
+// with a final status to a request with `Expect: 100-continue`.
+var ErrExpectationDeclined = errors.NewStringError("origin server declined request body")
+
+// switchProtocols completes a protocol upgrade by relaying the origin's 101 (Switching Protocols)
+// response to the client, then transferring data between client and origin as-is.
+func switchProtocols(resp http.ResponseWriter, proxyResp *http.Response, proxyInput io.Reader, proxyConn net.Conn, via string) error {
+	// Acquire raw connection to the client
+	clientInput, clientConn, err := http_.HijackConnection(resp)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return err
+	}
+	defer io_.CloseLoggedWithIgnores(clientConn, "Failed to close connection to local client: %+v", io.ErrClosedPipe)
+	header := http.Header{}
+	copyHeaders(header, proxyResp.Header)
+	header.Set(connectionHeader, "Upgrade")
+	header.Set("Upgrade", proxyResp.Header.Get("Upgrade"))
+	if via != "" {
+		appendVia(header, proxyResp.ProtoMajor, proxyResp.ProtoMinor, via)
+	}
+	var buffer bytes.Buffer
+	buffer.WriteString("HTTP/1.1 " + proxyResp.Status + "\r\n")
+	header.Write(&buffer)
+	buffer.WriteString("\r\n")
+	if _, err = clientConn.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+	// Start copying data from one connection to the other
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go io_.Transfer(&wg, proxyConn, clientInput)
+	go io_.Transfer(&wg, clientConn, proxyInput)
+	wg.Wait()
+	return nil
+}
+
 // "CONNECT"-only proxy, i.e. only establish tunneled connections through CONNECT-method.
 type HTTPConnectHandler struct {
 	// Dialer is the dialer for connecting to the SOCKS5 proxy.
 	Dialer    proxy.Dialer
 	UserAgent string
+	// Via is the received-by identifier that is inserted in the Via header of the response to
+	// CONNECT requests. Requests that already list this identifier are refused to prevent loops.
+	// Empty disables Via insertion and loop detection.
+	Via string
+	// Metrics is the (optional) shared metrics instance to count requests in.
+	Metrics *Metrics
+	// Credentials (optional) are required from clients in the Proxy-Authorization header.
+	Credentials ProxyCredentials
 }
 
 func (h *HTTPConnectHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	var err error
+	h.Metrics.countRequest(req.Method == http.MethodConnect)
+	req, err := h.Credentials.authenticate(resp, req)
+	if err != nil {
+		h.Metrics.countResult(err)
+		log.Warnln("Error serving request:", err.Error())
+		return
+	}
 	switch req.Method {
 	case http.MethodConnect:
+		if h.Via != "" && viaContains(req.Header, h.Via) {
+			resp.WriteHeader(http.StatusLoopDetected)
+			err = ErrLoopDetected
+			break
+		}
 		// TODO Go 1.20 added an OnProxyConnect callback for use by proxies. This probably voids the use for connection hijacking. Investigate and possibly use.
-		err = processConnect(resp, req, h.Dialer.Dial)
+		err = processConnect(resp, req, h.Dialer, h.Via)
 	case http.MethodHead, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace, http.MethodPatch:
 		_, err = http_.RespondMethodNotAllowed(resp, []string{http.MethodConnect}, nil)
 	default:
 		resp.WriteHeader(http.StatusBadRequest)
 		_, err = resp.Write([]byte("Bad or unsupported request."))
 	}
+	h.Metrics.countResult(err)
 	if err != nil {
 		log.Warnln("Error serving request:", err.Error())
 	}
 }
 
-func processConnect(resp http.ResponseWriter, req *http.Request, dial func(string, string) (net.Conn, error)) error {
+func processConnect(resp http.ResponseWriter, req *http.Request, dialer proxy.Dialer, via string) error {
 	defer io_.CloseLoggedWithIgnores(req.Body, "Error while closing request body: %+v", io.ErrClosedPipe)
 	log.Infoln(req.Proto, req.Method, req.URL.Host)
 	// Establish connection with socks proxy
-	proxyConn, err := dial("tcp", req.Host)
-	if err == ErrBlockedHost {
-		resp.WriteHeader(http.StatusForbidden)
+	proxyConn, err := dialContext(req.Context(), dialer, "tcp", req.Host)
+	if isBlocked(err) {
+		respondBlocked(resp, err)
 		return err
 	} else if err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
@@ -164,16 +496,25 @@ func processConnect(resp http.ResponseWriter, req *http.Request, dial func(strin
 	defer io_.CloseLoggedWithIgnores(clientConn, "Failed to close connection to local client: %+v", io.ErrClosedPipe)
 	// Send 200 Connection established to client to signal tunnel ready
 	// Responses to CONNECT requests MUST NOT contain any body payload.
-	// TODO add additional headers to proxy server's response? (Via)
-	if _, err = clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+	established := "HTTP/1.1 200 Connection established\r\n"
+	if via != "" {
+		established += viaHeader + ": " + strconv.Itoa(req.ProtoMajor) + "." + strconv.Itoa(req.ProtoMinor) + " " + via + "\r\n"
+	}
+	if _, err = clientConn.Write([]byte(established + "\r\n")); err != nil {
 		resp.WriteHeader(http.StatusInternalServerError)
 		return err
 	}
-	// Start copying data from one connection to the other
+	splice(clientConn, clientInput, proxyConn)
+	return nil
+}
+
+// splice copies data between the client and the remote connection, until both directions are done.
+// Data from the client is read from clientInput, such that data that is already buffered is not
+// lost.
+func splice(clientConn net.Conn, clientInput io.Reader, remoteConn net.Conn) {
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go io_.Transfer(&wg, proxyConn, clientInput)
-	go io_.Transfer(&wg, clientConn, proxyConn)
+	go io_.Transfer(&wg, remoteConn, clientInput)
+	go io_.Transfer(&wg, clientConn, remoteConn)
 	wg.Wait()
-	return nil
 }
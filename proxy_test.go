@@ -0,0 +1,332 @@
+package httprelay
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestProxyHandlerDialsIPv6Literals(t *testing.T) {
+	var tests = map[string]string{
+		"http://[2001:db8::1]/":          "[2001:db8::1]:80",
+		"http://[2001:db8::1]:8080/path": "[2001:db8::1]:8080",
+		"http://[fe80::1%25eth0]/":       "[fe80::1%eth0]:80",
+		"http://192.168.1.1/":            "192.168.1.1:80",
+	}
+	for uri, addr := range tests {
+		dialer := TestRecordingDialer{}
+		handler := HTTPProxyHandler{Dialer: &dialer}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, uri, nil))
+		assert.Equal(t, recorder.Code, http.StatusForbidden)
+		assert.Equal(t, len(dialer.addrs), 1)
+		assert.Equal(t, dialer.addrs[0], addr)
+	}
+}
+
+func TestConnectHandlerDialsIPv6Literals(t *testing.T) {
+	dialer := TestRecordingDialer{}
+	handler := HTTPConnectHandler{Dialer: &dialer}
+	req := httptest.NewRequest(http.MethodConnect, "http://[2001:db8::1]:443", nil)
+	req.Host = "[2001:db8::1]:443"
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusForbidden)
+	assert.Equal(t, len(dialer.addrs), 1)
+	assert.Equal(t, dialer.addrs[0], "[2001:db8::1]:443")
+}
+
+func TestProxyHandlerDefaultPortFromScheme(t *testing.T) {
+	var tests = map[string]string{
+		"http://www.example.com/":      "www.example.com:80",
+		"https://www.example.com/":     "www.example.com:443",
+		"ws://www.example.com/socket":  "www.example.com:80",
+		"wss://www.example.com/socket": "www.example.com:443",
+		"https://www.example.com:8443": "www.example.com:8443",
+		"https://[2001:db8::1]/":       "[2001:db8::1]:443",
+	}
+	for uri, addr := range tests {
+		dialer := TestRecordingDialer{}
+		handler := HTTPProxyHandler{Dialer: &dialer, TLSConfig: &tls.Config{}}
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, uri, nil))
+		assert.Equal(t, len(dialer.addrs), 1)
+		assert.Equal(t, dialer.addrs[0], addr)
+	}
+}
+
+func TestProxyHandlerUnsupportedScheme(t *testing.T) {
+	dialer := TestRecordingDialer{}
+	handler := HTTPProxyHandler{Dialer: &dialer}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "ftp://ftp.example.com/file", nil))
+	assert.Equal(t, recorder.Code, http.StatusBadRequest)
+	assert.Equal(t, len(dialer.addrs), 0)
+}
+
+func TestProxyHandlerTLSOriginationDisabled(t *testing.T) {
+	dialer := TestRecordingDialer{}
+	handler := HTTPProxyHandler{Dialer: &dialer}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "https://www.example.com/", nil))
+	assert.Equal(t, recorder.Code, http.StatusNotImplemented)
+	assert.Equal(t, len(dialer.addrs), 0)
+}
+
+func TestProxyHandlerTLSOrigination(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.WriteString(resp, "Hello over TLS")
+	}))
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: server.Listener.Addr().String()},
+		TLSConfig: &tls.Config{RootCAs: roots}}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "Hello over TLS")
+}
+
+func TestProxyHandlerTLSOriginationUntrusted(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		t.Error("Request must not reach untrusted origin.")
+	}))
+	defer server.Close()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: server.Listener.Addr().String()},
+		TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "https://example.com/", nil))
+	assert.Equal(t, recorder.Code, http.StatusBadGateway)
+}
+
+// TestRedirectDialer dials a fixed address, regardless of the address requested.
+type TestRedirectDialer struct {
+	addr string
+}
+
+func (d *TestRedirectDialer) Dial(network, _ string) (net.Conn, error) {
+	return net.Dial(network, d.addr)
+}
+
+func TestProxyHandlerUpgrade(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "echo" || upgradeProtocols(req.Header) == "" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := resp.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer origin.Close()
+	proxy := httptest.NewServer(&HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}})
+	defer proxy.Close()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = io.WriteString(conn, "GET ws://example.com/echo HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	assert.Nil(t, err)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusSwitchingProtocols)
+	assert.Equal(t, resp.Header.Get("Upgrade"), "echo")
+	assert.Equal(t, resp.Header.Get("Connection"), "Upgrade")
+	_, err = io.WriteString(conn, "ping")
+	assert.Nil(t, err)
+	var buf [4]byte
+	_, err = io.ReadFull(reader, buf[:])
+	assert.Nil(t, err)
+	assert.Equal(t, string(buf[:]), "ping")
+}
+
+func TestProxyHandlerUpgradeRefused(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.WriteString(resp, "no upgrade")
+	}))
+	defer origin.Close()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "no upgrade")
+}
+
+func TestProxyHandlerStreamsRequestBody(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.Copy(resp, req.Body)
+	}))
+	defer origin.Close()
+	client, closer := testProxyClient(t, origin, time.Second)
+	defer closer()
+	body := strings.Repeat("0123456789", 100000)
+	resp, err := client.Post("http://example.com/upload", "text/plain", strings.NewReader(body))
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	echoed, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, len(echoed), len(body))
+}
+
+func TestProxyHandlerExpectContinueRejected(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, req.Header.Get("Expect"), "100-continue")
+		resp.WriteHeader(http.StatusRequestEntityTooLarge)
+	}))
+	defer origin.Close()
+	client, closer := testProxyClient(t, origin, 5*time.Second)
+	defer closer()
+	body := TestTrackingReader{reader: strings.NewReader("large upload")}
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/upload", &body)
+	assert.Nil(t, err)
+	req.ContentLength = 12
+	req.Header.Set("Expect", "100-continue")
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusRequestEntityTooLarge)
+	assert.Equal(t, body.read.Load(), false)
+}
+
+func TestProxyHandlerExpectContinueAccepted(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.Copy(resp, req.Body)
+	}))
+	defer origin.Close()
+	client, closer := testProxyClient(t, origin, 5*time.Second)
+	defer closer()
+	body := TestTrackingReader{reader: strings.NewReader("small upload")}
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/upload", &body)
+	assert.Nil(t, err)
+	req.ContentLength = 12
+	req.Header.Set("Expect", "100-continue")
+	start := time.Now()
+	resp, err := client.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	echoed, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, string(echoed), "small upload")
+	if time.Since(start) > 4*time.Second {
+		t.Fatal("Expected 100 (Continue) to be relayed instead of waiting for client timeout.")
+	}
+}
+
+func TestProxyHandlerExpectContinueTimeout(t *testing.T) {
+	// The origin does not send 100 (Continue), but waits for the body instead.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+string(body))
+	}()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: listener.Addr().String()},
+		ExpectContinueTimeout: 50 * time.Millisecond}
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/upload", strings.NewReader("late body"))
+	req.Header.Set("Expect", "100-continue")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "late body")
+}
+
+// testProxyClient starts a proxy server that redirects all connections to origin, and returns a
+// client configured to use it.
+func testProxyClient(t *testing.T, origin *httptest.Server, expectContinueTimeout time.Duration) (*http.Client, func()) {
+	proxy := httptest.NewServer(&HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}})
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.Nil(t, err)
+	transport := http.Transport{Proxy: http.ProxyURL(proxyURL), ExpectContinueTimeout: expectContinueTimeout}
+	return &http.Client{Transport: &transport}, proxy.Close
+}
+
+// TestTrackingReader tracks whether the reader was read.
+type TestTrackingReader struct {
+	reader io.Reader
+	read   atomic.Bool
+}
+
+func (r *TestTrackingReader) Read(p []byte) (int, error) {
+	r.read.Store(true)
+	return r.reader.Read(p)
+}
+
+func TestProxyHandlerVia(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		io.WriteString(resp, strings.Join(req.Header.Values("Via"), ", "))
+	}))
+	defer origin.Close()
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, Via: "relay"}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Via", "1.0 fred")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "1.0 fred, 1.1 relay")
+	assert.Equal(t, recorder.Header().Get("Via"), "1.1 relay")
+}
+
+func TestProxyHandlerViaLoopDetected(t *testing.T) {
+	dialer := TestRecordingDialer{}
+	handler := HTTPProxyHandler{Dialer: &dialer, Via: "relay"}
+	for _, method := range []string{http.MethodGet, http.MethodConnect} {
+		req := httptest.NewRequest(method, "http://example.com:443", nil)
+		req.Header.Set("Via", "1.1 relay")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		assert.Equal(t, recorder.Code, http.StatusLoopDetected)
+	}
+	assert.Equal(t, len(dialer.addrs), 0)
+}
+
+func TestConnectHandlerVia(t *testing.T) {
+	origin, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer origin.Close()
+	go func() {
+		if conn, err := origin.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+	proxy := httptest.NewServer(&HTTPConnectHandler{Dialer: &TestRedirectDialer{addr: origin.Addr().String()}, Via: "relay"})
+	defer proxy.Close()
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	io.WriteString(conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	assert.Nil(t, err)
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, resp.Header.Get("Via"), "1.1 relay")
+}
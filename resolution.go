@@ -0,0 +1,47 @@
+package httprelay
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/cobratbq/goutils/std/errors"
+	"golang.org/x/net/proxy"
+)
+
+// Resolution of host names by the dialers that make up a dialer chain:
+//
+//   - BlocklistDialer, NopDialer and the PerHost dialer of WrapPerHostBlocking match addresses as
+//     provided and never resolve host names. Host names are passed on to the next dialer as-is.
+//   - The SOCKS5 dialer of `proxy.SOCKS5` and IsolatingDialer send host names to the SOCKS5 proxy,
+//     i.e. resolution is performed remotely. Only the address of the SOCKS5 proxy itself is dialed
+//     locally.
+//   - DirectDialer (`net.Dialer`) and ResolvingDialer resolve host names locally.
+//   - LiteralDialer refuses host names, therefore never resolves.
+//
+// A chain resolves locally only if a host name reaches a dialer that resolves. LiteralDialer, as
+// the base of the chain, guarantees that this never happens: any code path that would resolve
+// locally fails with ErrLocalResolution instead.
+
+// LiteralDialer dials IP-literal addresses only. Any address containing a host name is refused, as
+// dialing it would require local name resolution.
+type LiteralDialer struct {
+	Dialer proxy.Dialer
+}
+
+// Dial dials the address if it is an IP-literal address.
+func (d *LiteralDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext dials the address with context if it is an IP-literal address.
+func (d *LiteralDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if _, err := netip.ParseAddr(hostname(addr)); err != nil {
+		return nil, errors.Context(ErrLocalResolution, "'"+addr+"'")
+	}
+	return dialContext(ctx, d.Dialer, network, addr)
+}
+
+// ErrLocalResolution indicates that dialing was refused as it would require local resolution of a
+// host name.
+var ErrLocalResolution = errors.NewStringError("local name resolution is prohibited")
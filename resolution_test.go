@@ -0,0 +1,110 @@
+package httprelay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+	"golang.org/x/net/proxy"
+)
+
+func TestLiteralDialer(t *testing.T) {
+	recorder := TestRecordingDialer{}
+	dialer := LiteralDialer{Dialer: &recorder}
+	for _, addr := range []string{"example.com:80", "localhost:80", "example.com"} {
+		_, err := dialer.Dial("tcp", addr)
+		assert.Equal(t, errors.Is(err, ErrLocalResolution), true)
+	}
+	for _, addr := range []string{"1.2.3.4:80", "[2001:db8::1]:443", "[fe80::1%eth0]:80"} {
+		_, err := dialer.Dial("tcp", addr)
+		assert.Equal(t, errors.Is(err, ErrBlockedHost), true)
+	}
+	assert.Equal(t, len(recorder.addrs), 3)
+	assert.Equal(t, recorder.addrs[2], "[fe80::1%eth0]:80")
+}
+
+func TestLiteralDialerResolvingDialer(t *testing.T) {
+	dialer := LiteralDialer{Dialer: testFailingResolverDialer(t)}
+	_, err := dialer.Dial("tcp", "example.invalid:80")
+	assert.Equal(t, errors.Is(err, ErrLocalResolution), true)
+}
+
+func TestRelayChainResolvesRemotely(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	destinations := make(chan string, 1)
+	go testSOCKS5Destinations(listener, destinations)
+	base := LiteralDialer{Dialer: testFailingResolverDialer(t)}
+	var dialer proxy.Dialer
+	dialer, err = proxy.SOCKS5("tcp", listener.Addr().String(), nil, &base)
+	assert.Nil(t, err)
+	dialer = &BlocklistDialer{List: map[string]struct{}{"blocked.invalid": {}}, Dialer: dialer}
+	dialer = WrapPerHostBlocking(dialer, true, "10.0.0.0/8")
+	conn, err := dialContext(context.Background(), dialer, "tcp", "example.invalid:80")
+	assert.Nil(t, err)
+	conn.Close()
+	assert.Equal(t, <-destinations, "example.invalid:80")
+	_, err = dialer.Dial("tcp", "blocked.invalid:80")
+	assert.Equal(t, errors.Is(err, ErrBlockedHost), true)
+}
+
+func TestIsolatingDialerResolvesRemotely(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	users := make(chan string, 1)
+	go testSOCKS5Server(listener, users)
+	dialer, err := NewIsolatingDialer(listener.Addr().String(), IsolationDestination,
+		&LiteralDialer{Dialer: testFailingResolverDialer(t)})
+	assert.Nil(t, err)
+	conn, err := dialer.Dial("tcp", "example.invalid:80")
+	assert.Nil(t, err)
+	conn.Close()
+	<-users
+}
+
+// testFailingResolverDialer creates a direct dialer with a resolver that fails the test when called.
+func testFailingResolverDialer(t *testing.T) *net.Dialer {
+	return &net.Dialer{Resolver: &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			t.Error("Unexpected local name resolution.")
+			return nil, ErrLocalResolution
+		}}}
+}
+
+// testSOCKS5Destinations accepts a single connection, performs a SOCKS5 handshake without
+// authentication and reports the requested destination.
+func testSOCKS5Destinations(listener net.Listener, destinations chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	var header [5]byte
+	if _, err := io.ReadFull(conn, header[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, header[:]); err != nil || header[3] != 3 {
+		destinations <- "<not a domain name>"
+		return
+	}
+	name := make([]byte, header[4]+2)
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return
+	}
+	port := int(name[len(name)-2])<<8 | int(name[len(name)-1])
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	destinations <- net.JoinHostPort(string(name[:len(name)-2]), strconv.Itoa(port))
+}
@@ -0,0 +1,329 @@
+package httprelay
+
+import (
+	"bufio"
+	"context"
+	stderrors "errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	bufio_ "github.com/cobratbq/goutils/std/bufio"
+	"github.com/cobratbq/goutils/std/errors"
+	io_ "github.com/cobratbq/goutils/std/io"
+	"golang.org/x/net/proxy"
+)
+
+// Resolver resolves host names into IP addresses. `net.Resolver` implements Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// TTLResolver is a resolver that reports for how long its results may be cached.
+type TTLResolver interface {
+	Resolver
+	LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error)
+}
+
+// defaultAttemptDelay is the delay between connection attempts recommended by RFC 8305.
+const defaultAttemptDelay = 250 * time.Millisecond
+
+// ResolvingDialer resolves host names using its resolver, then connects to the resolved IP
+// addresses according to RFC 8305 ("Happy Eyeballs"): addresses are ordered alternating between
+// IPv6 and IPv4, and connection attempts are started one after another, separated by the attempt
+// delay, until the first connection is established. A failed attempt starts the next attempt
+// immediately. Host names are resolved locally, therefore ResolvingDialer must not be used where
+// strict remote resolution is required.
+type ResolvingDialer struct {
+	Resolver Resolver
+	Dialer   proxy.Dialer
+	// AttemptDelay is the delay before starting the next connection attempt. Zero means the
+	// default of 250 milliseconds, negative means attempts are made sequentially.
+	AttemptDelay time.Duration
+}
+
+// Dial resolves the host name of the address and dials the resolved IP addresses.
+func (d *ResolvingDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext resolves the host name of the address and dials the resolved IP addresses with
+// context. IP-literal addresses are dialed as-is.
+func (d *ResolvingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialContext(ctx, d.Dialer, network, addr)
+	}
+	addrs, err := d.Resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var targets []string
+	for _, ip := range interleaveFamilies(addrs) {
+		if (network == "tcp4" && ip.IP.To4() == nil) || (network == "tcp6" && ip.IP.To4() != nil) {
+			continue
+		}
+		targets = append(targets, net.JoinHostPort(ip.String(), port))
+	}
+	if len(targets) == 0 {
+		return nil, &net.DNSError{Err: "no suitable address", Name: host, IsNotFound: true}
+	}
+	return d.dialRace(ctx, network, targets)
+}
+
+// dialResult is the result of a single connection attempt.
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialRace starts connection attempts to the addresses in order, separated by the attempt delay,
+// and returns the first established connection. Remaining attempts are canceled, and connections
+// established afterwards are closed. If all attempts fail, the last error is returned.
+func (d *ResolvingDialer) dialRace(ctx context.Context, network string, targets []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	delay := d.AttemptDelay
+	if delay == 0 {
+		delay = defaultAttemptDelay
+	}
+	results := make(chan dialResult, len(targets))
+	var pending int
+	var err error
+	for next := 0; next < len(targets) || pending > 0; {
+		if next < len(targets) {
+			target := targets[next]
+			go func() {
+				conn, err := dialContext(ctx, d.Dialer, network, target)
+				results <- dialResult{conn: conn, err: err}
+			}()
+			next++
+			pending++
+		}
+		var timeout <-chan time.Time
+		if next < len(targets) && delay > 0 {
+			timeout = time.After(delay)
+		}
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				go closeLateConns(results, pending)
+				return result.conn, nil
+			}
+			err = result.err
+		case <-timeout:
+		case <-ctx.Done():
+			go closeLateConns(results, pending)
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+// closeLateConns closes connections of the remaining pending attempts once these complete.
+func closeLateConns(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.conn != nil {
+			io_.CloseLogged(result.conn, "Failed to close superfluous connection: %+v")
+		}
+	}
+}
+
+// interleaveFamilies orders addresses alternating between IPv6 and IPv4, starting with IPv6, as
+// recommended by RFC 8305. The relative order of addresses within a family is preserved.
+func interleaveFamilies(addrs []net.IPAddr) []net.IPAddr {
+	var ipv6, ipv4 []net.IPAddr
+	for _, addr := range addrs {
+		if addr.IP.To4() == nil {
+			ipv6 = append(ipv6, addr)
+		} else {
+			ipv4 = append(ipv4, addr)
+		}
+	}
+	ordered := make([]net.IPAddr, 0, len(addrs))
+	for i := 0; i < len(ipv6) || i < len(ipv4); i++ {
+		if i < len(ipv6) {
+			ordered = append(ordered, ipv6[i])
+		}
+		if i < len(ipv4) {
+			ordered = append(ordered, ipv4[i])
+		}
+	}
+	return ordered
+}
+
+// HostsResolver resolves host names using static entries, before falling back to its resolver.
+type HostsResolver struct {
+	Hosts    map[string][]net.IPAddr
+	Resolver Resolver
+}
+
+// LoadHostsResolver loads static entries from a `hosts`-formatted file, which take precedence over
+// the resolver.
+func LoadHostsResolver(resolver Resolver, filename string) (*HostsResolver, error) {
+	hostsFile, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Context(err, "failed to open file "+filename)
+	}
+	defer io_.CloseLogged(hostsFile, "failed to close hosts file")
+	hosts := HostsResolver{Hosts: make(map[string][]net.IPAddr), Resolver: resolver}
+	if err := hosts.Load(hostsFile); err != nil {
+		return nil, errors.Context(err, "failed to load hosts file "+filename)
+	}
+	return &hosts, nil
+}
+
+// Load loads static entries from provided reader that has content formatted like the operating
+// system 'hosts' files. A host name may be listed with multiple addresses.
+func (r *HostsResolver) Load(in io.Reader) error {
+	reader := bufio.NewReader(in)
+	var skipped uint
+	if err := bufio_.ReadStringLinesFunc(reader, '\n', func(line string) error {
+		line, _, _ = strings.Cut(line, "#")
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			// skip empty and comment lines
+			return nil
+		}
+		ip, err := netip.ParseAddr(parts[0])
+		if err != nil {
+			skipped++
+			return nil
+		}
+		addr := net.IPAddr{IP: net.IP(ip.Unmap().AsSlice()), Zone: ip.Zone()}
+		for _, host := range parts[1:] {
+			host = normalizeHost(host)
+			r.Hosts[host] = append(r.Hosts[host], addr)
+		}
+		return nil
+	}); err != nil {
+		return errors.Context(err, "failed to read hosts content")
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d lines with invalid address.", skipped)
+	}
+	log.Println("Total entries in hosts:", len(r.Hosts))
+	return nil
+}
+
+// LookupIPAddr looks up the host in the static entries, or otherwise using the resolver.
+func (r *HostsResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if addrs, ok := r.Hosts[normalizeHost(strings.TrimSuffix(host, "."))]; ok {
+		return append([]net.IPAddr(nil), addrs...), nil
+	}
+	if r.Resolver == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return r.Resolver.LookupIPAddr(ctx, host)
+}
+
+// Default time-to-live values of CachingResolver.
+const (
+	defaultCacheTTL         = time.Minute
+	defaultCacheNegativeTTL = 30 * time.Second
+	defaultCacheMaxTTL      = time.Hour
+	defaultCacheCapacity    = 4096
+)
+
+// CachingResolver caches the results of its resolver, both positive and negative (non-existent
+// hosts). Time-to-live values reported by a TTLResolver are honored, limited to MaxTTL. Results of
+// other resolvers are cached for DefaultTTL. Temporary failures are not cached.
+type CachingResolver struct {
+	Resolver Resolver
+	// DefaultTTL is the TTL for results of resolvers that do not report TTLs.
+	DefaultTTL time.Duration
+	// NegativeTTL is the TTL for non-existent hosts if the resolver does not report a TTL.
+	NegativeTTL time.Duration
+	// MaxTTL limits the TTL of any result.
+	MaxTTL time.Duration
+	// Capacity is the maximum number of cached results.
+	Capacity int
+	lock     sync.Mutex
+	entries  map[string]cacheEntry
+	now      func() time.Time
+}
+
+type cacheEntry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+}
+
+// NewCachingResolver creates a caching resolver with default time-to-live values.
+func NewCachingResolver(resolver Resolver) *CachingResolver {
+	return &CachingResolver{
+		Resolver:    resolver,
+		DefaultTTL:  defaultCacheTTL,
+		NegativeTTL: defaultCacheNegativeTTL,
+		MaxTTL:      defaultCacheMaxTTL,
+		Capacity:    defaultCacheCapacity,
+		entries:     make(map[string]cacheEntry),
+		now:         time.Now,
+	}
+}
+
+// LookupIPAddr looks up the host in the cache, or otherwise using the resolver.
+func (r *CachingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	key := normalizeHost(strings.TrimSuffix(host, "."))
+	r.lock.Lock()
+	entry, ok := r.entries[key]
+	r.lock.Unlock()
+	if ok && r.now().Before(entry.expires) {
+		return append([]net.IPAddr(nil), entry.addrs...), entry.err
+	}
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	var err error
+	if ttlResolver, ok := r.Resolver.(TTLResolver); ok {
+		addrs, ttl, err = ttlResolver.LookupIPAddrTTL(ctx, host)
+	} else {
+		if addrs, err = r.Resolver.LookupIPAddr(ctx, host); err == nil {
+			ttl = r.DefaultTTL
+		}
+	}
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !stderrors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return nil, err
+		}
+		if ttl == 0 {
+			ttl = r.NegativeTTL
+		}
+	}
+	ttl = min(ttl, r.MaxTTL)
+	if ttl > 0 {
+		r.store(key, cacheEntry{addrs: addrs, err: err, expires: r.now().Add(ttl)})
+	}
+	return append([]net.IPAddr(nil), addrs...), err
+}
+
+// store stores the entry, evicting expired entries if the cache is full. If no entries expired,
+// an arbitrary entry is evicted.
+func (r *CachingResolver) store(key string, entry cacheEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.entries) >= r.Capacity {
+		now := r.now()
+		for k, e := range r.entries {
+			if !now.Before(e.expires) {
+				delete(r.entries, k)
+			}
+		}
+		for k := range r.entries {
+			if len(r.entries) < r.Capacity {
+				break
+			}
+			delete(r.entries, k)
+		}
+	}
+	r.entries[key] = entry
+}
@@ -0,0 +1,238 @@
+package httprelay
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestResolvingDialer(t *testing.T) {
+	recorder := TestRecordingDialer{}
+	resolver := HostsResolver{Hosts: map[string][]net.IPAddr{
+		"example.test": {{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}}}
+	dialer := ResolvingDialer{Resolver: &resolver, Dialer: &recorder}
+	_, err := dialer.Dial("tcp", "Example.test:443")
+	assert.Equal(t, errors.Is(err, ErrBlockedHost), true)
+	_, err = dialer.Dial("tcp6", "example.test:80")
+	assert.Equal(t, errors.Is(err, ErrBlockedHost), true)
+	_, err = dialer.Dial("tcp", "[2001:db8::2]:80")
+	assert.Equal(t, errors.Is(err, ErrBlockedHost), true)
+	assert.Equal(t, len(recorder.addrs), 4)
+	assert.Equal(t, recorder.addrs[0], "[2001:db8::1]:443")
+	assert.Equal(t, recorder.addrs[1], "192.0.2.1:443")
+	assert.Equal(t, recorder.addrs[2], "[2001:db8::1]:80")
+	assert.Equal(t, recorder.addrs[3], "[2001:db8::2]:80")
+	_, err = dialer.Dial("tcp", "missing.test:80")
+	var dnsErr *net.DNSError
+	assert.Equal(t, errors.As(err, &dnsErr), true)
+	assert.Equal(t, len(recorder.addrs), 4)
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	var addrs []net.IPAddr
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2"} {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	var ordered []string
+	for _, addr := range interleaveFamilies(addrs) {
+		ordered = append(ordered, addr.String())
+	}
+	assert.Equal(t, strings.Join(ordered, ","), "2001:db8::1,192.0.2.1,2001:db8::2,192.0.2.2,192.0.2.3")
+}
+
+func TestResolvingDialerHappyEyeballs(t *testing.T) {
+	// The IPv6 address does not respond, the IPv4 address connects after the attempt delay.
+	dialer := TestScriptedDialer{hang: map[string]bool{"[2001:db8::1]:80": true}, canceled: make(chan string, 1)}
+	resolving := ResolvingDialer{Resolver: &HostsResolver{Hosts: map[string][]net.IPAddr{
+		"example.test": {{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}}}},
+		Dialer: &dialer, AttemptDelay: 50 * time.Millisecond}
+	start := time.Now()
+	conn, err := resolving.Dial("tcp", "example.test:80")
+	assert.Nil(t, err)
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Unexpected duration before connecting: %v", elapsed)
+	}
+	assert.Equal(t, conn.RemoteAddr().String(), "192.0.2.1:80")
+	// The hanging attempt is canceled once a connection is established.
+	assert.Equal(t, <-dialer.canceled, "[2001:db8::1]:80")
+}
+
+func TestResolvingDialerFailureStartsNextAttempt(t *testing.T) {
+	dialer := TestScriptedDialer{fail: map[string]bool{"[2001:db8::1]:80": true, "192.0.2.1:80": true}}
+	resolving := ResolvingDialer{Resolver: &HostsResolver{Hosts: map[string][]net.IPAddr{
+		"example.test": {{IP: net.ParseIP("192.0.2.1")}, {IP: net.ParseIP("2001:db8::1")}, {IP: net.ParseIP("2001:db8::2")}}}},
+		Dialer: &dialer, AttemptDelay: time.Hour}
+	conn, err := resolving.Dial("tcp", "example.test:80")
+	assert.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, conn.RemoteAddr().String(), "[2001:db8::2]:80")
+	// All attempts failing reports the last failure.
+	dialer.fail["[2001:db8::2]:80"] = true
+	_, err = resolving.Dial("tcp", "example.test:80")
+	assert.Equal(t, errors.Is(err, ErrBlockedHost), true)
+}
+
+func TestResolvingDialerStubDNS(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	resolver := HostsResolver{Hosts: map[string][]net.IPAddr{"origin.test": {{IP: net.ParseIP("127.0.0.1")}}},
+		Resolver: &DNSResolver{Protocol: DNSProtocolUDP, Server: testDNSServer(t)}}
+	dialer := ResolvingDialer{Resolver: NewCachingResolver(&resolver), Dialer: &net.Dialer{}}
+	conn, err := dialer.Dial("tcp", "origin.test:"+port)
+	assert.Nil(t, err)
+	conn.Close()
+	_, err = dialer.Dial("tcp", "missing.test:"+port)
+	assert.NotNil(t, err)
+}
+
+func TestHostsResolverLoad(t *testing.T) {
+	resolver := HostsResolver{Hosts: make(map[string][]net.IPAddr)}
+	assert.Nil(t, resolver.Load(strings.NewReader(`# static overrides
+192.0.2.1 example.test www.Example.test # web server
+2001:db8::1 example.test
+
+invalid-address other.test
+::ffff:192.0.2.2 mapped.test
+`)))
+	assert.Equal(t, len(resolver.Hosts), 3)
+	addrs, err := resolver.LookupIPAddr(context.Background(), "example.test.")
+	assert.Nil(t, err)
+	assert.Equal(t, len(addrs), 2)
+	assert.Equal(t, addrs[0].String(), "192.0.2.1")
+	assert.Equal(t, addrs[1].String(), "2001:db8::1")
+	addrs, err = resolver.LookupIPAddr(context.Background(), "mapped.test")
+	assert.Nil(t, err)
+	assert.Equal(t, addrs[0].String(), "192.0.2.2")
+	_, err = resolver.LookupIPAddr(context.Background(), "other.test")
+	assert.NotNil(t, err)
+}
+
+func TestCachingResolver(t *testing.T) {
+	resolver := TestCountingResolver{addrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, ttl: 10 * time.Second}
+	now := time.Now()
+	cache := NewCachingResolver(&resolver)
+	cache.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		addrs, err := cache.LookupIPAddr(context.Background(), "Example.test")
+		assert.Nil(t, err)
+		assert.Equal(t, len(addrs), 1)
+	}
+	assert.Equal(t, resolver.count, 1)
+	now = now.Add(10 * time.Second)
+	cache.LookupIPAddr(context.Background(), "example.test.")
+	assert.Equal(t, resolver.count, 2)
+	// A TTL of zero prohibits caching.
+	resolver.ttl = 0
+	now = now.Add(time.Hour)
+	cache.LookupIPAddr(context.Background(), "example.test")
+	cache.LookupIPAddr(context.Background(), "example.test")
+	assert.Equal(t, resolver.count, 4)
+}
+
+func TestCachingResolverNegative(t *testing.T) {
+	resolver := TestCountingResolver{err: &net.DNSError{Err: "no such host", Name: "missing.test", IsNotFound: true}}
+	now := time.Now()
+	cache := NewCachingResolver(&resolver)
+	cache.now = func() time.Time { return now }
+	_, err := cache.LookupIPAddr(context.Background(), "missing.test")
+	assert.NotNil(t, err)
+	_, err = cache.LookupIPAddr(context.Background(), "missing.test")
+	assert.NotNil(t, err)
+	assert.Equal(t, resolver.count, 1)
+	// Without TTL from the resolver, negative results are cached for NegativeTTL.
+	now = now.Add(cache.NegativeTTL)
+	cache.LookupIPAddr(context.Background(), "missing.test")
+	assert.Equal(t, resolver.count, 2)
+}
+
+func TestCachingResolverTemporaryFailure(t *testing.T) {
+	resolver := TestCountingResolver{err: &net.DNSError{Err: "timeout", Name: "example.test", IsTimeout: true}}
+	cache := NewCachingResolver(&resolver)
+	cache.LookupIPAddr(context.Background(), "example.test")
+	cache.LookupIPAddr(context.Background(), "example.test")
+	assert.Equal(t, resolver.count, 2)
+}
+
+func TestCachingResolverCapacity(t *testing.T) {
+	resolver := TestCountingResolver{addrs: []net.IPAddr{{IP: net.ParseIP("192.0.2.1")}}, ttl: time.Minute}
+	cache := NewCachingResolver(&resolver)
+	cache.Capacity = 2
+	for _, host := range []string{"a.test", "b.test", "c.test"} {
+		cache.LookupIPAddr(context.Background(), host)
+	}
+	assert.Equal(t, len(cache.entries), 2)
+	assert.KeyPresent(t, cache.entries, "c.test")
+}
+
+func TestCachingResolverStubDNS(t *testing.T) {
+	cache := NewCachingResolver(&DNSResolver{Protocol: DNSProtocolUDP, Server: testDNSServer(t)})
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	_, err := cache.LookupIPAddr(context.Background(), "www.example.test")
+	assert.Nil(t, err)
+	assert.Equal(t, cache.entries["www.example.test"].expires, now.Add(60*time.Second))
+	_, err = cache.LookupIPAddr(context.Background(), "missing.test")
+	assert.NotNil(t, err)
+	assert.Equal(t, cache.entries["missing.test"].expires, now.Add(15*time.Second))
+}
+
+type TestCountingResolver struct {
+	addrs []net.IPAddr
+	ttl   time.Duration
+	err   error
+	count int
+}
+
+func (r *TestCountingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	addrs, _, err := r.LookupIPAddrTTL(ctx, host)
+	return addrs, err
+}
+
+func (r *TestCountingResolver) LookupIPAddrTTL(ctx context.Context, host string) ([]net.IPAddr, time.Duration, error) {
+	r.count++
+	return r.addrs, r.ttl, r.err
+}
+
+// TestScriptedDialer fails dialing addresses marked to fail, hangs on addresses marked to hang until
+// canceled, and otherwise returns a pipe connection with the dialed address as remote address.
+type TestScriptedDialer struct {
+	fail     map[string]bool
+	hang     map[string]bool
+	canceled chan string
+}
+
+func (d *TestScriptedDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *TestScriptedDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.fail[addr] {
+		return nil, ErrBlockedHost
+	}
+	if d.hang[addr] {
+		<-ctx.Done()
+		d.canceled <- addr
+		return nil, ctx.Err()
+	}
+	local, remote := net.Pipe()
+	go remote.Close()
+	return &TestAddressedConn{Conn: local, remote: addr}, nil
+}
+
+type TestAddressedConn struct {
+	net.Conn
+	remote string
+}
+
+func (c *TestAddressedConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.remote)
+	return addr
+}
@@ -0,0 +1,253 @@
+package httprelay
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	bufio_ "github.com/cobratbq/goutils/std/bufio"
+	"github.com/cobratbq/goutils/std/errors"
+	io_ "github.com/cobratbq/goutils/std/io"
+)
+
+// HeaderRules is a set of rules for rewriting headers of requests and responses. Rules are
+// organized in sections, each of which selects the direction (request or response) and optionally
+// restricts its rules to destination hosts and request methods.
+//
+// The rules file is formatted as follows:
+//
+//	# Comments start with '#'.
+//	[request host=*.example.com,example.com method=GET,HEAD]
+//	remove Cookie
+//	set User-Agent: Mozilla/5.0 (compatible)
+//	add X-Api-Token: secret
+//	replace Accept-Language: ^([a-z]+)-.*$ => $1
+//
+//	[response]
+//	remove Server
+//
+// Host patterns are matched against the destination host name using `path.Match`, such that `*`
+// matches any sequence of characters. All matching sections apply, in order of appearance.
+type HeaderRules struct {
+	sections []headerSection
+}
+
+// headerSection is a section of rules with its scope.
+type headerSection struct {
+	response bool
+	hosts    []string
+	methods  []string
+	rules    []headerRule
+}
+
+// headerAction is the action performed by a header rule.
+type headerAction uint
+
+const (
+	headerSet headerAction = iota
+	headerAdd
+	headerRemove
+	headerReplace
+)
+
+// headerRule is a single rewriting rule.
+type headerRule struct {
+	action  headerAction
+	name    string
+	value   string
+	pattern *regexp.Regexp
+}
+
+// LoadHeaderRulesFile loads header rewriting rules from the specified file.
+func LoadHeaderRulesFile(filename string) (*HeaderRules, error) {
+	rulesFile, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Context(err, "failed to open file "+filename)
+	}
+	defer io_.CloseLogged(rulesFile, "failed to close header rules file")
+	return LoadHeaderRules(rulesFile)
+}
+
+// LoadHeaderRules loads header rewriting rules from provided reader.
+func LoadHeaderRules(in io.Reader) (*HeaderRules, error) {
+	var rules HeaderRules
+	var section *headerSection
+	var lineNumber int
+	if err := bufio_.ReadStringLinesFunc(bufio.NewReader(in), '\n', func(line string) error {
+		lineNumber++
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return nil
+		}
+		var err error
+		if strings.HasPrefix(line, "[") {
+			var parsed headerSection
+			if parsed, err = parseHeaderSection(line); err == nil {
+				rules.sections = append(rules.sections, parsed)
+				section = &rules.sections[len(rules.sections)-1]
+			}
+		} else if section == nil {
+			err = errors.Context(ErrInvalidHeaderRule, "rule outside of section")
+		} else {
+			var rule headerRule
+			if rule, err = parseHeaderRule(line); err == nil {
+				section.rules = append(section.rules, rule)
+			}
+		}
+		if err != nil {
+			return errors.Context(err, "line "+strconv.Itoa(lineNumber))
+		}
+		return nil
+	}); err != nil {
+		return nil, errors.Context(err, "failed to read header rules")
+	}
+	return &rules, nil
+}
+
+// parseHeaderSection parses a section header: `[request|response option=value...]`.
+func parseHeaderSection(line string) (headerSection, error) {
+	var section headerSection
+	if !strings.HasSuffix(line, "]") {
+		return section, errors.Context(ErrInvalidHeaderRule, "unterminated section header")
+	}
+	fields := strings.Fields(line[1 : len(line)-1])
+	if len(fields) == 0 {
+		return section, errors.Context(ErrInvalidHeaderRule, "empty section header")
+	}
+	switch fields[0] {
+	case "request":
+		section.response = false
+	case "response":
+		section.response = true
+	default:
+		return section, errors.Context(ErrInvalidHeaderRule, "unknown section '"+fields[0]+"'")
+	}
+	for _, option := range fields[1:] {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "host":
+			for _, pattern := range strings.Split(value, ",") {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return section, errors.Context(err, "invalid host pattern '"+pattern+"'")
+				}
+				section.hosts = append(section.hosts, strings.ToLower(pattern))
+			}
+		case "method":
+			section.methods = append(section.methods, strings.Split(strings.ToUpper(value), ",")...)
+		default:
+			return section, errors.Context(ErrInvalidHeaderRule, "unknown option '"+key+"'")
+		}
+	}
+	return section, nil
+}
+
+// parseHeaderRule parses a single rule: `remove <name>`, `set <name>: <value>`,
+// `add <name>: <value>` or `replace <name>: <regex> => <replacement>`.
+func parseHeaderRule(line string) (headerRule, error) {
+	var rule headerRule
+	action, spec, _ := strings.Cut(line, " ")
+	name, value, hasValue := strings.Cut(spec, ":")
+	rule.name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+	rule.value = strings.TrimSpace(value)
+	if rule.name == "" || strings.ContainsAny(rule.name, " \t") {
+		return rule, errors.Context(ErrInvalidHeaderRule, "invalid header name '"+rule.name+"'")
+	}
+	switch action {
+	case "remove":
+		rule.action = headerRemove
+		if hasValue {
+			return rule, errors.Context(ErrInvalidHeaderRule, "unexpected value for remove")
+		}
+		return rule, nil
+	case "set":
+		rule.action = headerSet
+	case "add":
+		rule.action = headerAdd
+	case "replace":
+		rule.action = headerReplace
+		pattern, replacement, found := strings.Cut(rule.value, " => ")
+		if !found {
+			return rule, errors.Context(ErrInvalidHeaderRule, "expected '<regex> => <replacement>'")
+		}
+		var err error
+		if rule.pattern, err = regexp.Compile(strings.TrimSpace(pattern)); err != nil {
+			return rule, errors.Context(err, "invalid regular expression")
+		}
+		rule.value = strings.TrimSpace(replacement)
+	default:
+		return rule, errors.Context(ErrInvalidHeaderRule, "unknown action '"+action+"'")
+	}
+	if !hasValue {
+		return rule, errors.Context(ErrInvalidHeaderRule, "missing value for "+action)
+	}
+	return rule, nil
+}
+
+// ErrInvalidHeaderRule indicates that the header rules could not be parsed.
+var ErrInvalidHeaderRule = errors.NewStringError("invalid header rule")
+
+// ApplyRequest applies the request rules that match destination host and method. A nil instance
+// does not apply any rules.
+func (r *HeaderRules) ApplyRequest(header http.Header, host, method string) {
+	r.apply(header, false, host, method)
+}
+
+// ApplyResponse applies the response rules that match destination host and (request) method. A nil
+// instance does not apply any rules.
+func (r *HeaderRules) ApplyResponse(header http.Header, host, method string) {
+	r.apply(header, true, host, method)
+}
+
+func (r *HeaderRules) apply(header http.Header, response bool, host, method string) {
+	if r == nil {
+		return
+	}
+	host = normalizeHost(host)
+	for i := range r.sections {
+		section := &r.sections[i]
+		if section.response != response || !section.matches(host, method) {
+			continue
+		}
+		for _, rule := range section.rules {
+			rule.apply(header)
+		}
+	}
+}
+
+// matches checks whether the section's scope includes the destination host and method.
+func (s *headerSection) matches(host, method string) bool {
+	if len(s.methods) > 0 && !slices.Contains(s.methods, method) {
+		return false
+	}
+	if len(s.hosts) == 0 {
+		return true
+	}
+	for _, pattern := range s.hosts {
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *headerRule) apply(header http.Header) {
+	switch r.action {
+	case headerSet:
+		header.Set(r.name, r.value)
+	case headerAdd:
+		header.Add(r.name, r.value)
+	case headerRemove:
+		header.Del(r.name)
+	case headerReplace:
+		values := header.Values(r.name)
+		for i, value := range values {
+			values[i] = r.pattern.ReplaceAllString(value, r.value)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package httprelay
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+const testHeaderRules = `# Header rules for testing
+[request host=*.example.com,example.com]
+remove Cookie
+
+[request host=registry.internal method=GET,HEAD]
+set Authorization: Bearer token
+add X-Registry: internal
+
+[request]
+replace User-Agent: ^([^/]+)/.*$ => $1
+replace accept-language: ^([a-z]+)-[A-Z]+ => $1
+
+[response host=example.com]
+remove Server
+set X-Rewritten: yes
+`
+
+func TestLoadHeaderRules(t *testing.T) {
+	rules, err := LoadHeaderRules(strings.NewReader(testHeaderRules))
+	assert.Nil(t, err)
+	assert.Equal(t, len(rules.sections), 4)
+	assert.Equal(t, len(rules.sections[0].hosts), 2)
+	assert.Equal(t, len(rules.sections[1].methods), 2)
+	assert.Equal(t, len(rules.sections[2].rules), 2)
+	assert.Equal(t, rules.sections[2].rules[1].name, "Accept-Language")
+	assert.Equal(t, rules.sections[3].response, true)
+}
+
+func TestLoadHeaderRulesInvalid(t *testing.T) {
+	for _, content := range []string{
+		"remove Cookie\n",
+		"[request\n",
+		"[bogus]\n",
+		"[request bogus=1]\n",
+		"[request host=[]\n",
+		"[request]\nset Cookie\n",
+		"[request]\nremove Cookie: value\n",
+		"[request]\nreplace Cookie: value\n",
+		"[request]\nreplace Cookie: ( => x\n",
+		"[request]\nappend Cookie: value\n",
+		"[request]\nset : value\n",
+	} {
+		if _, err := LoadHeaderRules(strings.NewReader(content)); err == nil {
+			t.Errorf("Expected error for rules: %q", content)
+		}
+	}
+}
+
+func TestHeaderRulesApplyRequest(t *testing.T) {
+	rules, err := LoadHeaderRules(strings.NewReader(testHeaderRules))
+	assert.Nil(t, err)
+	header := http.Header{}
+	header.Set("Cookie", "session=1")
+	header.Set("User-Agent", "curl/8.0.1")
+	header.Set("Accept-Language", "nl-NL")
+	rules.ApplyRequest(header, "www.example.com", http.MethodGet)
+	assert.KeyAbsent(t, header, "Cookie")
+	assert.Equal(t, header.Get("User-Agent"), "curl")
+	assert.Equal(t, header.Get("Accept-Language"), "nl")
+	header = http.Header{}
+	header.Set("Cookie", "session=1")
+	rules.ApplyRequest(header, "registry.internal", http.MethodGet)
+	assert.Equal(t, header.Get("Cookie"), "session=1")
+	assert.Equal(t, header.Get("Authorization"), "Bearer token")
+	assert.Equal(t, header.Get("X-Registry"), "internal")
+	header = http.Header{}
+	rules.ApplyRequest(header, "registry.internal", http.MethodPost)
+	assert.KeyAbsent(t, header, "Authorization")
+	header = http.Header{}
+	header.Set("Server", "nginx")
+	rules.ApplyRequest(header, "example.com", http.MethodGet)
+	assert.Equal(t, header.Get("Server"), "nginx")
+}
+
+func TestHeaderRulesApplyResponse(t *testing.T) {
+	rules, err := LoadHeaderRules(strings.NewReader(testHeaderRules))
+	assert.Nil(t, err)
+	header := http.Header{}
+	header.Set("Server", "nginx")
+	header.Set("User-Agent", "curl/8.0.1")
+	rules.ApplyResponse(header, "EXAMPLE.com", http.MethodGet)
+	assert.KeyAbsent(t, header, "Server")
+	assert.Equal(t, header.Get("X-Rewritten"), "yes")
+	assert.Equal(t, header.Get("User-Agent"), "curl/8.0.1")
+}
+
+func TestHeaderRulesNil(t *testing.T) {
+	var rules *HeaderRules
+	header := http.Header{}
+	header.Set("Cookie", "session=1")
+	rules.ApplyRequest(header, "example.com", http.MethodGet)
+	rules.ApplyResponse(header, "example.com", http.MethodGet)
+	assert.Equal(t, header.Get("Cookie"), "session=1")
+}
+
+func TestProxyHandlerHeaderRules(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Header().Set("Server", "test")
+		io.WriteString(resp, req.Header.Get("Cookie")+"|"+strings.Join(req.Header.Values("User-Agent"), ","))
+	}))
+	defer origin.Close()
+	rules, err := LoadHeaderRules(strings.NewReader(testHeaderRules))
+	assert.Nil(t, err)
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()},
+		UserAgent: "relay/1.0", HeaderRules: rules}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("User-Agent", "curl/8.0.1")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, recorder.Body.String(), "|relay")
+	assert.KeyAbsent(t, recorder.Header(), "Server")
+	assert.Equal(t, recorder.Header().Get("X-Rewritten"), "yes")
+}
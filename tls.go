@@ -0,0 +1,31 @@
+package httprelay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/cobratbq/goutils/std/errors"
+)
+
+// OriginTLSConfig creates the TLS configuration for originating TLS connections to origin servers.
+// Certificates are verified against the system roots, or if a CA bundle is specified, against the
+// PEM-encoded certificates in the bundle only.
+func OriginTLSConfig(caBundle string) (*tls.Config, error) {
+	config := tls.Config{MinVersion: tls.VersionTLS12}
+	if caBundle == "" {
+		return &config, nil
+	}
+	pem, err := os.ReadFile(caBundle)
+	if err != nil {
+		return nil, errors.Context(err, "failed to read CA bundle "+caBundle)
+	}
+	config.RootCAs = x509.NewCertPool()
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.Context(ErrNoCertificates, "CA bundle "+caBundle)
+	}
+	return &config, nil
+}
+
+// ErrNoCertificates indicates that no certificates were found.
+var ErrNoCertificates = errors.NewStringError("no certificates found")
@@ -0,0 +1,41 @@
+package httprelay
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+func TestOriginTLSConfigSystemRoots(t *testing.T) {
+	config, err := OriginTLSConfig("")
+	assert.Nil(t, err)
+	if config.RootCAs != nil {
+		t.Fatal("Expected system roots to be used.")
+	}
+}
+
+func TestOriginTLSConfigBundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	bundle := filepath.Join(t.TempDir(), "bundle.pem")
+	assert.Nil(t, os.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	config, err := OriginTLSConfig(bundle)
+	assert.Nil(t, err)
+	assert.NotNil(t, config.RootCAs)
+}
+
+func TestOriginTLSConfigBadBundle(t *testing.T) {
+	bundle := filepath.Join(t.TempDir(), "bundle.pem")
+	assert.Nil(t, os.WriteFile(bundle, []byte("no certificates here"), 0600))
+	if _, err := OriginTLSConfig(bundle); err == nil {
+		t.Fatal("Expected error for bundle without certificates.")
+	}
+	if _, err := OriginTLSConfig(filepath.Join(t.TempDir(), "missing.pem")); err == nil {
+		t.Fatal("Expected error for missing bundle.")
+	}
+}
@@ -0,0 +1,202 @@
+package httprelay
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	bufio_ "github.com/cobratbq/goutils/std/bufio"
+	"github.com/cobratbq/goutils/std/errors"
+	io_ "github.com/cobratbq/goutils/std/io"
+)
+
+// URLRules is an ordered list of rules that allow or block requests by their target URI. Rules are
+// evaluated in order of appearance and the first matching rule decides. Requests that match no
+// rule are allowed.
+//
+// The rules file is formatted as follows:
+//
+//	# Comments start with '#'.
+//	allow https://pypi.example.com/simple/
+//	block pypi.example.com
+//	block */wp-admin
+//	block *.example.com/*.php
+//	block example.com/search?q=*&debug
+//
+// Each rule consists of an action, `allow` or `block`, and a pattern `[scheme://]host[path][?query]`.
+// The host is matched against the destination host name (without port) using `path.Match`, such
+// that `*` matches any sequence of characters. A path without `*` or `[` matches as prefix,
+// otherwise it is matched using `path.Match` against the cleaned path, such that `*` does not match
+// `/`. Query parameters are required to be present, and if a value is specified, to match the value
+// using `path.Match`.
+type URLRules struct {
+	rules []urlRule
+}
+
+// urlRule is a single rule with its pattern split into components.
+type urlRule struct {
+	block  bool
+	source string
+	scheme string
+	host   string
+	path   string
+	glob   bool
+	query  []urlQueryParam
+}
+
+// urlQueryParam is a query parameter that must be present, optionally with a value pattern.
+type urlQueryParam struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+// ErrInvalidURLRule indicates that the URL rules could not be parsed.
+var ErrInvalidURLRule = errors.NewStringError("invalid URL rule")
+
+// ErrBlockedURL indicates that the request's target URI is blocked by a URL rule.
+var ErrBlockedURL = errors.NewStringError("URL is blocked")
+
+// LoadURLRulesFile loads URL rules from the specified file.
+func LoadURLRulesFile(filename string) (*URLRules, error) {
+	rulesFile, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Context(err, "failed to open file "+filename)
+	}
+	defer io_.CloseLogged(rulesFile, "failed to close URL rules file")
+	return LoadURLRules(rulesFile)
+}
+
+// LoadURLRules loads URL rules from provided reader.
+func LoadURLRules(in io.Reader) (*URLRules, error) {
+	var rules URLRules
+	var lineNumber int
+	if err := bufio_.ReadStringLinesFunc(bufio.NewReader(in), '\n', func(line string) error {
+		lineNumber++
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			return nil
+		}
+		rule, err := parseURLRule(line)
+		if err != nil {
+			return errors.Context(err, "line "+strconv.Itoa(lineNumber))
+		}
+		rules.rules = append(rules.rules, rule)
+		return nil
+	}); err != nil {
+		return nil, errors.Context(err, "failed to read URL rules")
+	}
+	return &rules, nil
+}
+
+// parseURLRule parses a single rule: `allow <pattern>` or `block <pattern>`.
+func parseURLRule(line string) (urlRule, error) {
+	var rule urlRule
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return rule, errors.Context(ErrInvalidURLRule, "expected '<action> <pattern>'")
+	}
+	switch fields[0] {
+	case "allow":
+		rule.block = false
+	case "block":
+		rule.block = true
+	default:
+		return rule, errors.Context(ErrInvalidURLRule, "unknown action '"+fields[0]+"'")
+	}
+	pattern := fields[1]
+	rule.source = line
+	if scheme, remainder, found := strings.Cut(pattern, "://"); found {
+		rule.scheme = strings.ToLower(scheme)
+		pattern = remainder
+	}
+	pattern, query, hasQuery := strings.Cut(pattern, "?")
+	if i := strings.IndexByte(pattern, '/'); i > -1 {
+		rule.host, rule.path = pattern[:i], pattern[i:]
+	} else {
+		rule.host = pattern
+	}
+	if rule.host == "" {
+		return rule, errors.Context(ErrInvalidURLRule, "missing host in '"+fields[1]+"'")
+	}
+	rule.host = strings.ToLower(rule.host)
+	if _, err := path.Match(rule.host, ""); err != nil {
+		return rule, errors.Context(err, "invalid host pattern '"+rule.host+"'")
+	}
+	if rule.glob = strings.ContainsAny(rule.path, "*["); rule.glob {
+		if _, err := path.Match(rule.path, ""); err != nil {
+			return rule, errors.Context(err, "invalid path pattern '"+rule.path+"'")
+		}
+	}
+	if hasQuery {
+		for _, param := range strings.Split(query, "&") {
+			key, value, hasValue := strings.Cut(param, "=")
+			if key == "" {
+				return rule, errors.Context(ErrInvalidURLRule, "empty query parameter in '"+fields[1]+"'")
+			}
+			if _, err := path.Match(value, ""); err != nil {
+				return rule, errors.Context(err, "invalid query pattern '"+value+"'")
+			}
+			rule.query = append(rule.query, urlQueryParam{key: key, value: value, hasValue: hasValue})
+		}
+	}
+	return rule, nil
+}
+
+// Blocked checks whether the target URI is blocked, i.e. whether the first matching rule is a block
+// rule. Returns the matching rule for reference. A nil instance does not block anything.
+func (r *URLRules) Blocked(u *url.URL) (bool, string) {
+	if r == nil {
+		return false, ""
+	}
+	host := normalizeHost(hostname(u.Host))
+	cleaned := path.Clean("/" + u.Path)
+	query := u.Query()
+	for i := range r.rules {
+		if rule := &r.rules[i]; rule.matches(u.Scheme, host, cleaned, query) {
+			return rule.block, rule.source
+		}
+	}
+	return false, ""
+}
+
+// matches checks whether the rule matches the URI's components. The path is expected to be cleaned.
+func (r *urlRule) matches(scheme, host, cleaned string, query url.Values) bool {
+	if r.scheme != "" && r.scheme != scheme {
+		return false
+	}
+	if matched, _ := path.Match(r.host, host); !matched {
+		return false
+	}
+	if r.glob {
+		if matched, _ := path.Match(r.path, cleaned); !matched {
+			return false
+		}
+	} else if !strings.HasPrefix(cleaned, r.path) && !strings.HasPrefix(cleaned+"/", r.path) {
+		return false
+	}
+	for _, param := range r.query {
+		values, ok := query[param.key]
+		if !ok {
+			return false
+		}
+		if param.hasValue && !matchesAny(param.value, values) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny checks whether any of the values matches the pattern.
+func matchesAny(pattern string, values []string) bool {
+	for _, value := range values {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
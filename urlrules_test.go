@@ -0,0 +1,82 @@
+package httprelay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	assert "github.com/cobratbq/goutils/std/testing"
+)
+
+const testURLRules = `# package index: only the simple API
+allow https://pypi.example.com/simple/
+block pypi.example.com
+
+block */wp-admin
+block *.example.org/*.php
+block example.net/search?q=*secret*&debug
+`
+
+func TestURLRulesBlocked(t *testing.T) {
+	rules, err := LoadURLRules(strings.NewReader(testURLRules))
+	assert.Nil(t, err)
+	var tests = []struct {
+		uri     string
+		blocked bool
+	}{
+		{"https://pypi.example.com/simple/requests/", false},
+		{"https://pypi.example.com/simple", false},
+		{"http://pypi.example.com/simple/requests/", true},
+		{"https://PyPI.example.com:443/packages/requests.whl", true},
+		{"https://pypi.example.com/simple/../packages/requests.whl", true},
+		{"http://blog.example/wp-admin", true},
+		{"http://blog.example/wp-admin/options.php", true},
+		{"http://blog.example/wp-admin.php", true},
+		{"http://blog.example/wp-content/image.png", false},
+		{"http://www.example.org/index.php", true},
+		{"http://www.example.org/app/index.php", false},
+		{"http://example.org/index.php", false},
+		{"http://example.net/search?q=top-secret-plans&debug=1", true},
+		{"http://example.net/search?q=top-secret-plans", false},
+		{"http://example.net/search?q=plans&debug", false},
+		{"http://example.net/", false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.uri)
+		assert.Nil(t, err)
+		if blocked, rule := rules.Blocked(u); blocked != test.blocked {
+			t.Errorf("Unexpected result for '%s': blocked %v by rule '%s'", test.uri, blocked, rule)
+		}
+	}
+	var nilRules *URLRules
+	blocked, _ := nilRules.Blocked(&url.URL{Scheme: "http", Host: "example.com", Path: "/"})
+	assert.Equal(t, blocked, false)
+}
+
+func TestLoadURLRulesInvalid(t *testing.T) {
+	for _, line := range []string{"block", "deny example.com", "block /path", "block [example.com", "block example.com?=value", "block example.com/a b"} {
+		_, err := LoadURLRules(strings.NewReader(line))
+		assert.NotNil(t, err)
+	}
+}
+
+func TestProxyHandlerURLRules(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/wp-admin") {
+			t.Error("Blocked request must not reach origin.")
+		}
+	}))
+	defer origin.Close()
+	rules, err := LoadURLRules(strings.NewReader("block */wp-admin\n"))
+	assert.Nil(t, err)
+	metrics := new(Metrics)
+	handler := HTTPProxyHandler{Dialer: &TestRedirectDialer{addr: origin.Listener.Addr().String()}, URLRules: rules, Metrics: metrics}
+	recorder := testServe(&handler, http.MethodGet, "http://example.com/wp-admin/", nil)
+	assert.Equal(t, recorder.Code, http.StatusForbidden)
+	assert.Equal(t, metrics.Blocked.Load(), uint64(1))
+	recorder = testServe(&handler, http.MethodGet, "http://example.com/index.html", nil)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	assert.Equal(t, metrics.Blocked.Load(), uint64(1))
+}
@@ -1,6 +1,7 @@
 package httprelay
 
 import (
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
@@ -17,14 +18,46 @@ var hopByHopHeaders = set.Create(connectionHeader, "Keep-Alive", "Proxy-Authoriz
 // headers that should be dropped as hop-by-hop headers.
 const connectionHeader = "Connection"
 
-// fullHost appends the default port to the provided host if no port is specified.
-// FIXME check if this causes problems in case of IPv6
-func fullHost(host string) string {
-	fullhost := host
-	if strings.IndexByte(host, ':') == -1 {
-		fullhost += ":80"
+// fullHost appends the default port to the provided host if no port is specified. IPv6 literals
+// with port must be bracketed, e.g. `[2001:db8::1]:80`. IPv6 literals without port are accepted
+// both bracketed and bare.
+func fullHost(host string, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
 	}
-	return fullhost
+	return net.JoinHostPort(trimBrackets(host), defaultPort)
+}
+
+// hostname extracts the host name from an address that may or may not contain a port. Brackets
+// of IPv6 literals are removed.
+func hostname(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return trimBrackets(addr)
+}
+
+// trimBrackets removes the brackets surrounding an IPv6 literal, if present.
+func trimBrackets(host string) string {
+	if len(host) >= 2 && host[0] == '[' && host[len(host)-1] == ']' {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// normalizeHost normalizes a host name for matching: host names are lower-cased, IP literals are
+// converted to their canonical form without zone.
+func normalizeHost(host string) string {
+	host = trimBrackets(host)
+	if i := strings.IndexByte(host, '%'); i > -1 {
+		if ip := net.ParseIP(host[:i]); ip != nil {
+			return ip.String()
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return strings.ToLower(host)
 }
 
 // copyHeaders copies all the headers that are not classified as hop-to-hop headers. (This satisfies
@@ -51,6 +84,19 @@ func copyHeaders(dst http.Header, src http.Header) {
 	}
 }
 
+// upgradeProtocols returns the protocols of the Upgrade header if the client requested a protocol
+// upgrade, i.e. the Connection header contains the "upgrade" option. Otherwise it returns "".
+func upgradeProtocols(header http.Header) string {
+	for _, v := range header[connectionHeader] {
+		for _, option := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				return strings.Join(header.Values("Upgrade"), ", ")
+			}
+		}
+	}
+	return ""
+}
+
 // processConnectionHdr processes the Connection header and adds all headers listed in value as
 // droppable headers.
 func processConnectionHdr(dropHdrs map[string]struct{}, value string) []string {
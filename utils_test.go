@@ -26,14 +26,64 @@ func TestFullHost(t *testing.T) {
 		"www.google.com:80":  "www.google.com:80",
 		"www.google.com:443": "www.google.com:443",
 		"google.com:8080":    "google.com:8080",
+		"[2001:db8::1]:443":  "[2001:db8::1]:443",
+		"[2001:db8::1]":      "[2001:db8::1]:80",
+		"2001:db8::1":        "[2001:db8::1]:80",
+		"::1":                "[::1]:80",
+		"[fe80::1%eth0]":     "[fe80::1%eth0]:80",
+		"[fe80::1%eth0]:80":  "[fe80::1%eth0]:80",
+		"192.168.1.1":        "192.168.1.1:80",
 	}
 	var result string
 	for src, dst := range tests {
-		result = fullHost(src)
+		result = fullHost(src, "80")
 		assert.Equal(t, result, dst)
 	}
 }
 
+func TestFullHostDefaultPort(t *testing.T) {
+	assert.Equal(t, fullHost("www.example.com", "443"), "www.example.com:443")
+	assert.Equal(t, fullHost("www.example.com:8443", "443"), "www.example.com:8443")
+	assert.Equal(t, fullHost("[2001:db8::1]", "443"), "[2001:db8::1]:443")
+}
+
+func TestHostname(t *testing.T) {
+	var tests = map[string]string{
+		"localhost":            "localhost",
+		"localhost:80":         "localhost",
+		"[2001:db8::1]:443":    "2001:db8::1",
+		"[2001:db8::1]":        "2001:db8::1",
+		"2001:db8::1":          "2001:db8::1",
+		"[fe80::1%eth0]:443":   "fe80::1%eth0",
+		"192.168.1.1:8080":     "192.168.1.1",
+		"www.example.com:8080": "www.example.com",
+	}
+	for src, dst := range tests {
+		assert.Equal(t, hostname(src), dst)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	var tests = map[string]string{
+		"Hello.World":           "hello.world",
+		"2001:0DB8:0:0::0001":   "2001:db8::1",
+		"[2001:db8::1]":         "2001:db8::1",
+		"fe80::1%eth0":          "fe80::1",
+		"::ffff:192.168.1.1":    "192.168.1.1",
+		"192.168.001.001":       "192.168.001.001",
+		"hello.world%25zone":    "hello.world%25zone",
+		"www.example.com":       "www.example.com",
+		"[fe80::abcd%25eth0]":   "fe80::abcd",
+		"0.0.0.0":               "0.0.0.0",
+		"::":                    "::",
+		"hello.world.":          "hello.world.",
+		"xn--bcher-kva.example": "xn--bcher-kva.example",
+	}
+	for src, dst := range tests {
+		assert.Equal(t, normalizeHost(src), dst)
+	}
+}
+
 func TestProcessConnectionHdrs(t *testing.T) {
 	var hdrs = map[string]struct{}{}
 	var val = "Keep-Alive  ,  \tFoo,bar"
@@ -84,3 +134,17 @@ func TestCopyHeaders(t *testing.T) {
 		assert.KeyPresent(t, dst, k)
 	}
 }
+
+func TestUpgradeProtocols(t *testing.T) {
+	header := http.Header{}
+	assert.Equal(t, upgradeProtocols(header), "")
+	header.Set("Upgrade", "websocket")
+	assert.Equal(t, upgradeProtocols(header), "")
+	header.Set("Connection", "keep-alive, Upgrade")
+	assert.Equal(t, upgradeProtocols(header), "websocket")
+	header.Set("Connection", "upgrade")
+	header.Add("Upgrade", "h2c")
+	assert.Equal(t, upgradeProtocols(header), "websocket, h2c")
+	header.Set("Connection", "close")
+	assert.Equal(t, upgradeProtocols(header), "")
+}